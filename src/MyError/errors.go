@@ -11,17 +11,37 @@ const (
 	ERROR_NOTFOUND  = "ERROR_NOTFOUND"
 	ERROR_NOTVALID  = "ERROR_NOTVALID"
 	ERROR_CNAME     = "ERROR_CNAME"
+	ERROR_FORBIDDEN = "ERROR_FORBIDDEN"
+	ERROR_AUTH      = "ERROR_AUTH"
+	ERROR_EXPIRED   = "ERROR_EXPIRED"
+	ERROR_REPLAY    = "ERROR_REPLAY"
+	ERROR_DECRYPT   = "ERROR_DECRYPT"
+	ERROR_UPSTREAM  = "ERROR_UPSTREAM" // upstream nameservers failed
+	ERROR_TIMEOUT   = "ERROR_TIMEOUT"  // upstream nameservers timed out
+	ERROR_STALE     = "ERROR_STALE"    // the cached answer is expired
 )
 
+// Msg is shown to clients, Cause is only written to the server logs
 type MyError struct {
 	ErrorNo string
 	Msg     string
+	Cause   error
 }
 
 func NewError(errno, Msg string) *MyError {
 	return &MyError{ErrorNo: errno, Msg: Msg}
 }
 
+// NewError with the error which caused it
+func Wrap(errno, Msg string, cause error) *MyError {
+	return &MyError{ErrorNo: errno, Msg: Msg, Cause: cause}
+}
+
+// The message with the cause chain
 func (e *MyError) Error() string {
-	return "Error -> : " + e.ErrorNo + " .. " + e.Msg
+	s := "Error -> : " + e.ErrorNo + " .. " + e.Msg
+	if e.Cause != nil {
+		s += " <- " + e.Cause.Error()
+	}
+	return s
 }
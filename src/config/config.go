@@ -1,17 +1,39 @@
 package config
 
 import (
+	"encoding/hex"
+	"errors"
 	"flag"
 	"fmt"
+	"net"
 	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/BurntSushi/toml"
-	"github.com/miekg/dns"
+	"github.com/op/go-logging"
 )
 
 var ConfigFile string
 var EnableProfile bool
-var RC *RuntimeConfiguration
+var reloadLock sync.Mutex
+
+// The current *RuntimeConfiguration, see GetRC
+var currentRC atomic.Value
+
+// The current configuration. It is replaced as a whole by ReloadConf and
+// never modified, a request takes it once and uses only that one
+func GetRC() *RuntimeConfiguration {
+	rc, _ := currentRC.Load().(*RuntimeConfiguration)
+	return rc
+}
+
+// Replace the current configuration, rc must not be modified afterwards
+func SetRC(rc *RuntimeConfiguration) {
+	currentRC.Store(rc)
+}
 
 type MySQLConf struct {
 	DomainsInMySQL []string `toml:"domains_in_mysql"`
@@ -22,17 +44,165 @@ type MySQLConf struct {
 	MySQLPass      string   `toml:"mysql_password"`
 }
 
+// Client of the http api, Secret is the key of HMAC signature,
+// AESKeys are hex encoded AES-128/192/256 keys of encrypted queries, all of
+// them are accepted so that keys can be rotated
+type ClientConf struct {
+	Identifier string   `toml:"identifier"`
+	Secret     string   `toml:"secret"`
+	AESKeys    []string `toml:"aes_keys"`
+}
+
+// Decoded AESKeys, invalid keys are skipped (ParseConf refuses them)
+func (c *ClientConf) GetAESKeys() [][]byte {
+	var keys [][]byte
+	for _, k := range c.AESKeys {
+		if key, e := hex.DecodeString(k); e == nil && validAESKeyLen(len(key)) {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func validAESKeyLen(l int) bool {
+	return l == 16 || l == 24 || l == 32
+}
+
+type AuthConf struct {
+	SignatureExpire int64         `toml:"signature_expire"` // seconds
+	Clients         []*ClientConf `toml:"clients"`
+}
+
+// Extra certificate of the tls listener, chosen by SNI
+type CertConf struct {
+	Cert string `toml:"cert"`
+	Key  string `toml:"key"`
+}
+
+// Admin api, listens on Bind which should not be reachable by the public.
+// Clients are identifiers of [[auth.clients]] allowed to use it, requests
+// are signed the same way as /q
+type AdminConf struct {
+	Bind    string   `toml:"bind"`
+	Clients []string `toml:"clients"`
+}
+
+// Token bucket limits of the http api, rate is domains per second and
+// burst is the size of the bucket. 0 rate disables the limit.
+type RateLimitConf struct {
+	IPRate      float64 `toml:"ip_rate"`
+	IPBurst     int     `toml:"ip_burst"`
+	IPv4Prefix  int     `toml:"ipv4_prefix"` // clients in the same prefix share one bucket
+	IPv6Prefix  int     `toml:"ipv6_prefix"`
+	ClientRate  float64 `toml:"client_rate"` // per authenticated client identifier
+	ClientBurst int     `toml:"client_burst"`
+}
+
+// Refreshes of the cached regions before they expire, 0 is the default
+type RefreshConf struct {
+	Concurrency int   `toml:"concurrency"`  // refreshes run at the same time
+	MinInterval int64 `toml:"min_interval"` // seconds between the refreshes of a region
+}
+
+// Budget of the region cache, cold regions are evicted over it. 0 is
+// unlimited
+type CacheConf struct {
+	MaxEntries  int    `toml:"max_entries"`  // domains and regions
+	MaxMemory   int64  `toml:"max_memory"`   // approximate bytes
+	ProtectHits uint32 `toml:"protect_hits"` // regions hit more often are kept, 0 is the default
+}
+
+// Snapshot file of the cache, loaded on startup and saved on shutdown and
+// every Interval seconds (0 only on shutdown). Empty path disables it
+type SnapshotConf struct {
+	Path     string `toml:"path"`
+	Interval int64  `toml:"interval"`
+}
+
 type RuntimeConfiguration struct {
-	Bind            string     `toml:"bind"`
-	Domains         []string   `toml:"domains"`
-	MySQLEnabled    bool       `toml:"mysql_enable"`
-	MySQLConf       *MySQLConf `toml:"mysql"`
-	IPDB            string     `toml:"ipdb_path"`
-	ServerLog       string     `toml:"server_log"`
-	QueryLog        string     `toml:"query_log"`
-	LogLevel        string     `toml:"log_level"`
-	QueryLogFormat  string     `toml:"querylog_format"`
-	ServerLogFormat string     `toml:"serverlog_format"`
+	Bind            string         `toml:"bind"`
+	DNSBind         string         `toml:"dns_bind"` // udp and tcp, empty to disable
+	TLSBind         string         `toml:"tls_bind"` // empty to disable
+	TLSCert         string         `toml:"tls_cert"` // default certificate
+	TLSKey          string         `toml:"tls_key"`
+	TLSCerts        []*CertConf    `toml:"tls_certs"`
+	Domains         []string       `toml:"domains"`
+	MySQLEnabled    bool           `toml:"mysql_enable"`
+	MySQLConf       *MySQLConf     `toml:"mysql"`
+	AuthEnabled     bool           `toml:"auth_enable"`
+	AuthConf        *AuthConf      `toml:"auth"`
+	TrustedProxies  []string       `toml:"trusted_proxies"`
+	ProxyProtocol   bool           `toml:"proxy_protocol"`
+	RateLimitConf   *RateLimitConf `toml:"ratelimit"`
+	AdminConf       *AdminConf     `toml:"admin"`
+	ServeStale      int64          `toml:"serve_stale"` // seconds, 0 to disable
+	RefreshConf     *RefreshConf   `toml:"refresh"`
+	CacheConf       *CacheConf     `toml:"cache"`
+	SnapshotConf    *SnapshotConf  `toml:"snapshot"`
+	IPDB            string         `toml:"ipdb_path"`
+	RegionDB        string         `toml:"region_db"` // built by mkregiondb, used instead of RegionTable
+	ServerLog       string         `toml:"server_log"`
+	QueryLog        string         `toml:"query_log"`
+	LogLevel        string         `toml:"log_level"`
+	QueryLogFormat  string         `toml:"querylog_format"`
+	ServerLogFormat string         `toml:"serverlog_format"`
+
+	TrustedProxyNets []*net.IPNet   `toml:"-"` // parsed TrustedProxies
+	WhiteList        *DomainMatcher `toml:"-"` // parsed Domains
+	MySQLDomains     *DomainMatcher `toml:"-"` // parsed MySQLConf.DomainsInMySQL
+}
+
+// Whether client id is allowed to use the admin api
+func IsAdminClient(id string) bool {
+	return GetRC().IsAdminClient(id)
+}
+
+func (rc *RuntimeConfiguration) IsAdminClient(id string) bool {
+	if rc == nil || rc.AdminConf == nil {
+		return false
+	}
+	if _, ok := rc.GetClientConf(id); !ok {
+		return false
+	}
+	for _, x := range rc.AdminConf.Clients {
+		if x == id {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether ip is in one of the trusted proxy networks
+func (rc *RuntimeConfiguration) IsTrustedProxy(ip net.IP) bool {
+	if rc == nil || ip == nil {
+		return false
+	}
+	for _, n := range rc.TrustedProxyNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Parse "10.0.0.0/8" or single ip "10.1.1.1" to *net.IPNet
+func ParseCIDRs(s []string) ([]*net.IPNet, error) {
+	var nets []*net.IPNet
+	for _, x := range s {
+		if !strings.Contains(x, "/") {
+			if ip := net.ParseIP(x); ip != nil && ip.To4() != nil {
+				x = x + "/32"
+			} else {
+				x = x + "/128"
+			}
+		}
+		_, n, e := net.ParseCIDR(x)
+		if e != nil {
+			return nil, e
+		}
+		nets = append(nets, n)
+	}
+	return nets, nil
 }
 
 func InitConfig() {
@@ -45,28 +215,66 @@ func InitConfig() {
 	}
 }
 
-//todo: complete this func
+// Whether d matches the domains whitelist, see DomainMatcher for the
+// syntax of the entries
 func InWhiteList(d string) bool {
-	d = dns.Fqdn(d)
-	for _, x := range RC.Domains {
-		if d == dns.Fqdn(x) {
-			return true
-		}
+	return GetRC().InWhiteList(d)
+}
+
+func (rc *RuntimeConfiguration) InWhiteList(d string) bool {
+	if rc == nil {
+		return false
 	}
-	return false
+	m := rc.WhiteList
+	if m == nil {
+		// configuration not built by LoadConf
+		m, _ = NewDomainMatcher(rc.Domains)
+	}
+	return m.Match(d)
 }
 
 func IsLocalMysqlBackend(d string) bool {
-	d = dns.Fqdn(d)
-	if !RC.MySQLEnabled {
+	return GetRC().IsLocalMysqlBackend(d)
+}
+
+func (rc *RuntimeConfiguration) IsLocalMysqlBackend(d string) bool {
+	if rc == nil || !rc.MySQLEnabled || rc.MySQLConf == nil {
 		return false
 	}
-	for _, x := range RC.MySQLConf.DomainsInMySQL {
-		if d == dns.Fqdn(x) {
-			return true
+	m := rc.MySQLDomains
+	if m == nil {
+		m, _ = NewDomainMatcher(rc.MySQLConf.DomainsInMySQL)
+	}
+	return m.Match(d)
+}
+
+// How long expired answers may be served when they can not be refetched
+func ServeStaleWindow() time.Duration {
+	return GetRC().ServeStaleWindow()
+}
+
+func (rc *RuntimeConfiguration) ServeStaleWindow() time.Duration {
+	if rc == nil || rc.ServeStale <= 0 {
+		return 0
+	}
+	return time.Duration(rc.ServeStale) * time.Second
+}
+
+// Get the configuration of client with identifier id
+func GetClientConf(id string) (*ClientConf, bool) {
+	return GetRC().GetClientConf(id)
+}
+
+func (rc *RuntimeConfiguration) GetClientConf(id string) (*ClientConf, bool) {
+	if rc == nil || rc.AuthConf == nil {
+		return nil, false
+	}
+	for _, c := range rc.AuthConf.Clients {
+		if c.Identifier == id {
+			return c, true
 		}
 	}
-	return false
+	return nil, false
 }
 
 func ParseCommandline() {
@@ -88,38 +296,159 @@ func ParseCommandline() {
 	}
 }
 
-func ParseConf(file string) bool {
-	if x, e := toml.DecodeFile(file, &RC); e != nil {
-		fmt.Println("Parse toml configuration file "+file+" error : ", e.Error())
-		os.Exit(1)
+// Parse and validate the configuration file, the current configuration is
+// not changed
+func LoadConf(file string) (*RuntimeConfiguration, error) {
+	rc := &RuntimeConfiguration{}
+	if x, e := toml.DecodeFile(file, rc); e != nil {
+		return nil, confError("Parse toml configuration file "+file+" error : ", e.Error())
 	} else if len(x.Undecoded()) > 0 {
-		for _, xx := range x.Undecoded() {
-			fmt.Print(xx, " ")
-		}
-		fmt.Println(" Decode failed. Please review your configuration file: ", file)
-		os.Exit(1)
+		return nil, confError(x.Undecoded(), " Decode failed. Please review your configuration file: ", file)
 	}
 	fmt.Println("Runtime Configurations:")
-	fmt.Println("\tBindTo:          ", RC.Bind)
-	fmt.Println("\tEnabled domains: ", RC.Domains)
-	fmt.Println("\tMySQL enabled:   ", RC.MySQLEnabled)
-	fmt.Println("\tIPDB Path:       ", RC.IPDB)
-	fmt.Println("\tServerLog:       ", RC.ServerLog)
-	fmt.Println("\tQueryLog:        ", RC.QueryLog)
-	fmt.Println("\tServerLogFormat:        ", RC.ServerLogFormat)
-	fmt.Println("\tQueryLogFormat:       ", RC.QueryLogFormat)
-	fmt.Println("\tLoglevel:        ", RC.LogLevel)
-	if RC.MySQLEnabled {
+	fmt.Println("\tBindTo:          ", rc.Bind)
+	fmt.Println("\tDNS BindTo:      ", rc.DNSBind)
+	fmt.Println("\tTLS BindTo:      ", rc.TLSBind)
+	if rc.TLSBind != "" && (rc.TLSCert == "" || rc.TLSKey == "") {
+		return nil, confError("tls_bind is set, but tls_cert or tls_key is empty")
+	}
+	if rc.Bind == "" && rc.TLSBind == "" {
+		return nil, confError("Neither bind nor tls_bind is set")
+	}
+	fmt.Println("\tEnabled domains: ", rc.Domains)
+	if m, e := NewDomainMatcher(rc.Domains); e != nil {
+		return nil, confError("Parse domains error: ", e.Error())
+	} else {
+		rc.WhiteList = m
+	}
+	fmt.Println("\tMySQL enabled:   ", rc.MySQLEnabled)
+	fmt.Println("\tIPDB Path:       ", rc.IPDB)
+	fmt.Println("\tRegion DB:       ", rc.RegionDB)
+	fmt.Println("\tServe stale:     ", rc.ServeStale)
+	if rc.ServeStale < 0 {
+		return nil, confError("Invalid serve_stale: ", rc.ServeStale)
+	}
+	if rc.RefreshConf != nil {
+		fmt.Println("\tRefresh concurrency/min interval: ", rc.RefreshConf.Concurrency, rc.RefreshConf.MinInterval)
+		if rc.RefreshConf.Concurrency < 0 || rc.RefreshConf.MinInterval < 0 {
+			return nil, confError("Invalid [refresh]: ", rc.RefreshConf.Concurrency, rc.RefreshConf.MinInterval)
+		}
+	}
+	if rc.CacheConf != nil {
+		fmt.Println("\tCache max entries/memory: ", rc.CacheConf.MaxEntries, rc.CacheConf.MaxMemory)
+		if rc.CacheConf.MaxEntries < 0 || rc.CacheConf.MaxMemory < 0 {
+			return nil, confError("Invalid [cache]: ", rc.CacheConf.MaxEntries, rc.CacheConf.MaxMemory)
+		}
+	}
+	if rc.SnapshotConf != nil {
+		fmt.Println("\tSnapshot path/interval: ", rc.SnapshotConf.Path, rc.SnapshotConf.Interval)
+		if rc.SnapshotConf.Interval < 0 {
+			return nil, confError("Invalid snapshot interval: ", rc.SnapshotConf.Interval)
+		}
+	}
+	fmt.Println("\tServerLog:       ", rc.ServerLog)
+	fmt.Println("\tQueryLog:        ", rc.QueryLog)
+	fmt.Println("\tServerLogFormat:        ", rc.ServerLogFormat)
+	fmt.Println("\tQueryLogFormat:       ", rc.QueryLogFormat)
+	fmt.Println("\tLoglevel:        ", rc.LogLevel)
+	if _, e := logging.LogLevel(rc.LogLevel); e != nil {
+		return nil, confError("Invalid log_level: ", rc.LogLevel)
+	}
+	if rc.MySQLEnabled && rc.MySQLConf == nil {
+		return nil, confError("mysql_enable is set, but [mysql] is not configured")
+	}
+	if rc.MySQLEnabled {
 		fmt.Println("MySQL Conf: ")
-		fmt.Println("\tMySQL Host: ", RC.MySQLConf.MySQLHost)
-		fmt.Println("\tMySQL Port: ", RC.MySQLConf.MySQLPort)
-		fmt.Println("\tMySQL DB:   ", RC.MySQLConf.MySQLDB)
-		fmt.Println("\tMySQL User: ", RC.MySQLConf.MySQLUser)
-		fmt.Println("\tMySQL Pass: ", RC.MySQLConf.MySQLPass)
-		fmt.Println("\tDomains in MySQL: ", RC.MySQLConf.DomainsInMySQL)
+		fmt.Println("\tMySQL Host: ", rc.MySQLConf.MySQLHost)
+		fmt.Println("\tMySQL Port: ", rc.MySQLConf.MySQLPort)
+		fmt.Println("\tMySQL DB:   ", rc.MySQLConf.MySQLDB)
+		fmt.Println("\tMySQL User: ", rc.MySQLConf.MySQLUser)
+		fmt.Println("\tMySQL Pass: ", "****")
+		fmt.Println("\tDomains in MySQL: ", rc.MySQLConf.DomainsInMySQL)
+		if m, e := NewDomainMatcher(rc.MySQLConf.DomainsInMySQL); e != nil {
+			return nil, confError("Parse domains_in_mysql error: ", e.Error())
+		} else {
+			rc.MySQLDomains = m
+		}
 		fmt.Println("\t\t")
 	} else {
 		fmt.Println("Notice: MySQL backend is disabled")
 	}
+	if nets, e := ParseCIDRs(rc.TrustedProxies); e != nil {
+		return nil, confError("Parse trusted_proxies error: ", e.Error())
+	} else {
+		rc.TrustedProxyNets = nets
+	}
+	fmt.Println("\tTrusted proxies: ", rc.TrustedProxies)
+	fmt.Println("\tProxy protocol:  ", rc.ProxyProtocol)
+	if rc.RateLimitConf != nil {
+		fmt.Println("RateLimit Conf: ")
+		fmt.Println("\tIP rate/burst:     ", rc.RateLimitConf.IPRate, rc.RateLimitConf.IPBurst)
+		fmt.Println("\tIP prefix v4/v6:   ", rc.RateLimitConf.IPv4Prefix, rc.RateLimitConf.IPv6Prefix)
+		fmt.Println("\tClient rate/burst: ", rc.RateLimitConf.ClientRate, rc.RateLimitConf.ClientBurst)
+	} else {
+		fmt.Println("Notice: rate limit is disabled")
+	}
+	if rc.AuthConf != nil {
+		for _, c := range rc.AuthConf.Clients {
+			for _, k := range c.AESKeys {
+				if key, e := hex.DecodeString(k); e != nil || !validAESKeyLen(len(key)) {
+					return nil, confError("Invalid aes key of client ", c.Identifier, ", must be 32/48/64 hex chars")
+				}
+			}
+		}
+	}
+	if rc.AuthEnabled {
+		if rc.AuthConf == nil || len(rc.AuthConf.Clients) < 1 {
+			return nil, confError("auth_enable is set, but no client is configured in [auth] ")
+		}
+		fmt.Println("Auth Conf: ")
+		fmt.Println("\tSignature expire: ", rc.AuthConf.SignatureExpire)
+		for _, c := range rc.AuthConf.Clients {
+			fmt.Println("\tClient: ", c.Identifier, " AES keys: ", len(c.AESKeys))
+		}
+	} else {
+		fmt.Println("Notice: client authentication is disabled")
+	}
+	if rc.AdminConf != nil && rc.AdminConf.Bind != "" {
+		for _, id := range rc.AdminConf.Clients {
+			if _, ok := rc.GetClientConf(id); !ok {
+				return nil, confError("Admin client ", id, " is not configured in [auth] ")
+			}
+		}
+		fmt.Println("Admin Conf: ")
+		fmt.Println("\tAdmin bind:    ", rc.AdminConf.Bind)
+		fmt.Println("\tAdmin clients: ", rc.AdminConf.Clients)
+	} else {
+		fmt.Println("Notice: admin api is disabled")
+	}
+	return rc, nil
+}
+
+func ParseConf(file string) bool {
+	rc, e := LoadConf(file)
+	if e != nil {
+		fmt.Println(e.Error())
+		os.Exit(1)
+	}
+	SetRC(rc)
 	return true
 }
+
+// Load ConfigFile again and replace the current configuration, which is
+// kept if the file is invalid. The old and the new one are returned
+func ReloadConf() (*RuntimeConfiguration, *RuntimeConfiguration, error) {
+	reloadLock.Lock()
+	defer reloadLock.Unlock()
+	old := GetRC()
+	rc, e := LoadConf(ConfigFile)
+	if e != nil {
+		return old, old, e
+	}
+	SetRC(rc)
+	return old, rc, nil
+}
+
+func confError(a ...interface{}) error {
+	return errors.New(strings.TrimSpace(fmt.Sprintln(a...)))
+}
@@ -14,3 +14,48 @@ func TestGet(t *testing.T) {
 		}
 	}
 }
+
+func TestDomainMatcher(t *testing.T) {
+	m, e := NewDomainMatcher([]string{"www.a.com.", "*.cdn.a.com", ".b.com.", "!x.cdn.a.com", "!*.in.b.com", "C.com"})
+	if e != nil {
+		t.Fatal(e)
+	}
+	for d, want := range map[string]bool{
+		"www.a.com.":     true,
+		"WWW.A.COM":      true,
+		"a.com.":         false,
+		"x.www.a.com.":   false,
+		"cdn.a.com.":     false,
+		"img.cdn.a.com.": true,
+		"a.b.cdn.a.com.": true,
+		"x.cdn.a.com.":   false,
+		"b.com.":         true,
+		"y.x.b.com.":     true,
+		"in.b.com.":      true,
+		"y.in.b.com.":    false,
+		"c.com.":         true,
+		"com.":           false,
+		".":              false,
+	} {
+		if m.Match(d) != want {
+			t.Log(d, want)
+			t.Fail()
+		}
+	}
+	for _, x := range []string{"", "*.", "!", "a..com"} {
+		if _, e := NewDomainMatcher([]string{x}); e == nil {
+			t.Log(x)
+			t.Fail()
+		}
+	}
+
+	SetRC(&RuntimeConfiguration{Domains: []string{".a.com"}})
+	if !InWhiteList("www.a.com") || IsLocalMysqlBackend("www.a.com") {
+		t.Fail()
+	}
+	SetRC(&RuntimeConfiguration{MySQLEnabled: true, MySQLConf: &MySQLConf{DomainsInMySQL: []string{"*.a.com", "!b.a.com"}}})
+	if !IsLocalMysqlBackend("c.a.com") || IsLocalMysqlBackend("b.a.com") {
+		t.Fail()
+	}
+	SetRC(nil)
+}
@@ -0,0 +1,108 @@
+package config
+
+import (
+	"errors"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Domain matcher of the whitelist and domains_in_mysql, entries are:
+//
+//	"www.a.com"      the domain only
+//	"*.cdn.a.com"    every subdomain of cdn.a.com, not cdn.a.com itself
+//	".a.com"         a.com and every subdomain of it
+//	"!x.cdn.a.com"   deny, any form above prefixed with "!"
+//
+// Deny entries override allow entries, whichever is more specific.
+// Entries are stored in a trie of reversed labels: com -> a -> cdn
+type DomainMatcher struct {
+	root *matcherNode
+}
+
+const (
+	MATCH_ALLOW_SELF = 1 << iota // the domain of the node
+	MATCH_ALLOW_SUB              // subdomains of the node
+	MATCH_DENY_SELF
+	MATCH_DENY_SUB
+)
+
+type matcherNode struct {
+	flags    int
+	children map[string]*matcherNode
+}
+
+func NewDomainMatcher(entries []string) (*DomainMatcher, error) {
+	m := &DomainMatcher{root: &matcherNode{}}
+	for _, x := range entries {
+		if e := m.Add(x); e != nil {
+			return nil, e
+		}
+	}
+	return m, nil
+}
+
+func (m *DomainMatcher) Add(entry string) error {
+	x := strings.ToLower(strings.TrimSpace(entry))
+	self, sub := MATCH_ALLOW_SELF, MATCH_ALLOW_SUB
+	if strings.HasPrefix(x, "!") {
+		x = x[1:]
+		self, sub = MATCH_DENY_SELF, MATCH_DENY_SUB
+	}
+	var flags int
+	switch {
+	case strings.HasPrefix(x, "*."):
+		x, flags = x[2:], sub
+	case strings.HasPrefix(x, "."):
+		x, flags = x[1:], self|sub
+	default:
+		flags = self
+	}
+	if _, ok := dns.IsDomainName(x); !ok || strings.Trim(x, ".") == "" {
+		return errors.New("invalid domain entry: " + entry)
+	}
+
+	n := m.root
+	labels := dns.SplitDomainName(x)
+	for i := len(labels) - 1; i >= 0; i-- {
+		c, ok := n.children[labels[i]]
+		if !ok {
+			if n.children == nil {
+				n.children = make(map[string]*matcherNode)
+			}
+			c = &matcherNode{}
+			n.children[labels[i]] = c
+		}
+		n = c
+	}
+	n.flags |= flags
+	return nil
+}
+
+// Whether d is allowed by an entry and not denied by any entry
+func (m *DomainMatcher) Match(d string) bool {
+	if m == nil {
+		return false
+	}
+	labels := dns.SplitDomainName(strings.ToLower(d))
+	if len(labels) == 0 {
+		return false
+	}
+	allow, deny := false, false
+	n := m.root
+	for i := len(labels) - 1; i >= 0; i-- {
+		c, ok := n.children[labels[i]]
+		if !ok {
+			break
+		}
+		n = c
+		if i == 0 {
+			allow = allow || n.flags&MATCH_ALLOW_SELF != 0
+			deny = deny || n.flags&MATCH_DENY_SELF != 0
+		} else {
+			allow = allow || n.flags&MATCH_ALLOW_SUB != 0
+			deny = deny || n.flags&MATCH_DENY_SUB != 0
+		}
+	}
+	return allow && !deny
+}
@@ -11,8 +11,8 @@ import (
 var DBFile string
 
 func init() {
-	if config.RC.IPDB != "" {
-		DBFile = config.RC.IPDB
+	if rc := config.GetRC(); rc != nil && rc.IPDB != "" {
+		DBFile = rc.IPDB
 	} else {
 		DBFile = "../conf/ip.db"
 	}
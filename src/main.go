@@ -1,7 +1,10 @@
 package main
 
 import (
+	"os"
+	"os/signal"
 	"runtime"
+	"syscall"
 
 	"github.com/pkg/profile"
 
@@ -24,10 +27,22 @@ func main() {
 
 	runtime.GOMAXPROCS(runtime.NumCPU() * 3)
 	utils.InitLogger()
-	if config.RC.MySQLEnabled {
-		query.RC_MySQLConf = config.RC.MySQLConf
-		query.InitMySQL(query.RC_MySQLConf)
+	if rc := config.GetRC(); rc.MySQLEnabled {
+		query.SetMySQLConf(rc.MySQLConf)
+	}
+	go server.Serve()
+
+	// SIGHUP reloads the configuration, SIGTERM/SIGINT drains the servers
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP, syscall.SIGTERM, syscall.SIGINT)
+	for s := range sig {
+		if s == syscall.SIGHUP {
+			server.Reload()
+			continue
+		}
+		utils.ServerLogger.Info("got signal %s, shutting down", s.String())
+		server.Shutdown(server.SHUTDOWN_TIMEOUT)
+		utils.CloseLogger()
+		return
 	}
-	server.Serve()
-
 }
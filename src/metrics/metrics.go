@@ -0,0 +1,278 @@
+package metrics
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Metrics written in the Prometheus text format (version 0.0.4): counters,
+// histograms and gauges which are computed when they are written
+
+const CONTENT_TYPE = "text/plain; version=0.0.4; charset=utf-8"
+
+// Buckets of latencies in seconds
+var DEFAULT_BUCKETS = []float64{.001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}
+
+type metric interface {
+	write(w *bufio.Writer)
+}
+
+// Registered metrics in the order of registration
+var registry = struct {
+	sync.Mutex
+	metrics []metric
+}{}
+
+func register(m metric) {
+	registry.Lock()
+	registry.metrics = append(registry.metrics, m)
+	registry.Unlock()
+}
+
+// Write all registered metrics to w
+func Write(w io.Writer) error {
+	registry.Lock()
+	metrics := registry.metrics
+	registry.Unlock()
+	b := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(b)
+	}
+	return b.Flush()
+}
+
+type CounterVec struct {
+	name   string
+	help   string
+	labels []string
+	sync.Mutex
+	values map[string]*counterValue
+}
+
+type counterValue struct {
+	labels []string
+	value  float64
+}
+
+// Counter with label names labels, it is registered
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{name: name, help: help, labels: labels, values: make(map[string]*counterValue)}
+	register(c)
+	return c
+}
+
+// Add v to the counter of label values values
+func (c *CounterVec) Add(v float64, values ...string) {
+	k := labelKey(values)
+	c.Lock()
+	x, ok := c.values[k]
+	if !ok {
+		x = &counterValue{labels: values}
+		c.values[k] = x
+	}
+	x.value += v
+	c.Unlock()
+}
+
+func (c *CounterVec) Inc(values ...string) {
+	c.Add(1, values...)
+}
+
+func (c *CounterVec) Value(values ...string) float64 {
+	c.Lock()
+	defer c.Unlock()
+	if x, ok := c.values[labelKey(values)]; ok {
+		return x.value
+	}
+	return 0
+}
+
+func (c *CounterVec) write(w *bufio.Writer) {
+	writeHeader(w, c.name, c.help, "counter")
+	c.Lock()
+	defer c.Unlock()
+	for _, k := range sortedKeys(c.values) {
+		x := c.values[k]
+		writeSample(w, c.name, c.labels, x.labels, "", "", x.value)
+	}
+}
+
+type HistogramVec struct {
+	name    string
+	help    string
+	labels  []string
+	buckets []float64
+	sync.Mutex
+	values map[string]*histogramValue
+}
+
+type histogramValue struct {
+	labels []string
+	counts []uint64 // not cumulative, counts[len(buckets)] is +Inf
+	count  uint64
+	sum    float64
+}
+
+// Histogram with upper bounds buckets (sorted) and label names labels,
+// it is registered
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{name: name, help: help, labels: labels, buckets: buckets, values: make(map[string]*histogramValue)}
+	register(h)
+	return h
+}
+
+func (h *HistogramVec) Observe(v float64, values ...string) {
+	k := labelKey(values)
+	i := sort.SearchFloat64s(h.buckets, v)
+	h.Lock()
+	x, ok := h.values[k]
+	if !ok {
+		x = &histogramValue{labels: values, counts: make([]uint64, len(h.buckets)+1)}
+		h.values[k] = x
+	}
+	x.counts[i]++
+	x.count++
+	x.sum += v
+	h.Unlock()
+}
+
+// Observe the seconds elapsed since start
+func (h *HistogramVec) ObserveSince(start time.Time, values ...string) {
+	h.Observe(time.Since(start).Seconds(), values...)
+}
+
+// Number of observations
+func (h *HistogramVec) Count(values ...string) uint64 {
+	h.Lock()
+	defer h.Unlock()
+	if x, ok := h.values[labelKey(values)]; ok {
+		return x.count
+	}
+	return 0
+}
+
+func (h *HistogramVec) write(w *bufio.Writer) {
+	writeHeader(w, h.name, h.help, "histogram")
+	h.Lock()
+	defer h.Unlock()
+	for _, k := range sortedKeys(h.values) {
+		x := h.values[k]
+		var n uint64
+		for i, c := range x.counts {
+			n += c
+			le := math.Inf(1)
+			if i < len(h.buckets) {
+				le = h.buckets[i]
+			}
+			writeSample(w, h.name+"_bucket", h.labels, x.labels, "le", formatFloat(le), float64(n))
+		}
+		writeSample(w, h.name+"_sum", h.labels, x.labels, "", "", x.sum)
+		writeSample(w, h.name+"_count", h.labels, x.labels, "", "", float64(x.count))
+	}
+}
+
+type GaugeFunc struct {
+	name  string
+	help  string
+	label string
+	f     func() map[string]float64
+}
+
+// Gauge computed by f when it is written, it is registered
+func NewGaugeFunc(name, help string, f func() float64) *GaugeFunc {
+	return NewGaugeVecFunc(name, help, "", func() map[string]float64 {
+		return map[string]float64{"": f()}
+	})
+}
+
+// Gauge with one label computed by f, the keys of the map are values of
+// label
+func NewGaugeVecFunc(name, help, label string, f func() map[string]float64) *GaugeFunc {
+	g := &GaugeFunc{name: name, help: help, label: label, f: f}
+	register(g)
+	return g
+}
+
+func (g *GaugeFunc) write(w *bufio.Writer) {
+	writeHeader(w, g.name, g.help, "gauge")
+	values := g.f()
+	keys := make([]string, 0, len(values))
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if g.label == "" {
+			writeSample(w, g.name, nil, nil, "", "", values[k])
+		} else {
+			writeSample(w, g.name, []string{g.label}, []string{k}, "", "", values[k])
+		}
+	}
+}
+
+func writeHeader(w *bufio.Writer, name, help, typ string) {
+	w.WriteString("# HELP " + name + " " + strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help) + "\n")
+	w.WriteString("# TYPE " + name + " " + typ + "\n")
+}
+
+// name{labels="values",extra="extraValue"} v
+func writeSample(w *bufio.Writer, name string, labels, values []string, extra, extraValue string, v float64) {
+	w.WriteString(name)
+	var pairs []string
+	for i, l := range labels {
+		x := ""
+		if i < len(values) {
+			x = values[i]
+		}
+		pairs = append(pairs, l+`="`+escapeLabel(x)+`"`)
+	}
+	if extra != "" {
+		pairs = append(pairs, extra+`="`+extraValue+`"`)
+	}
+	if len(pairs) > 0 {
+		w.WriteString("{" + strings.Join(pairs, ",") + "}")
+	}
+	w.WriteString(" " + formatFloat(v) + "\n")
+}
+
+func escapeLabel(s string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(s)
+}
+
+func formatFloat(v float64) string {
+	switch {
+	case math.IsInf(v, 1):
+		return "+Inf"
+	case math.IsInf(v, -1):
+		return "-Inf"
+	case math.IsNaN(v):
+		return "NaN"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func labelKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+func sortedKeys(m interface{}) []string {
+	var keys []string
+	switch x := m.(type) {
+	case map[string]*counterValue:
+		for k := range x {
+			keys = append(keys, k)
+		}
+	case map[string]*histogramValue:
+		for k := range x {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
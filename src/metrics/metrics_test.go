@@ -0,0 +1,53 @@
+package metrics
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestWrite(t *testing.T) {
+	c := NewCounterVec("test_requests_total", "Requests.", "endpoint", "status")
+	c.Inc("/q", "200")
+	c.Inc("/q", "200")
+	c.Add(3, "/b\"x", "500")
+	h := NewHistogramVec("test_duration_seconds", "Latency.", []float64{.1, 1}, "ns")
+	h.Observe(.05, "a")
+	h.Observe(.1, "a")
+	h.Observe(2, "a")
+	NewGaugeFunc("test_size", "Size.", func() float64 { return 7 })
+	NewGaugeVecFunc("test_regions", "Regions.", "type", func() map[string]float64 {
+		return map[string]float64{"AAAA": 2, "A": 1}
+	})
+
+	if c.Value("/q", "200") != 2 || c.Value("/q", "404") != 0 || h.Count("a") != 3 {
+		t.Fail()
+	}
+	var b bytes.Buffer
+	if e := Write(&b); e != nil {
+		t.Fatal(e)
+	}
+	want := `# HELP test_requests_total Requests.
+# TYPE test_requests_total counter
+test_requests_total{endpoint="/b\"x",status="500"} 3
+test_requests_total{endpoint="/q",status="200"} 2
+# HELP test_duration_seconds Latency.
+# TYPE test_duration_seconds histogram
+test_duration_seconds_bucket{ns="a",le="0.1"} 2
+test_duration_seconds_bucket{ns="a",le="1"} 2
+test_duration_seconds_bucket{ns="a",le="+Inf"} 3
+test_duration_seconds_sum{ns="a"} 2.15
+test_duration_seconds_count{ns="a"} 3
+# HELP test_size Size.
+# TYPE test_size gauge
+test_size 7
+# HELP test_regions Regions.
+# TYPE test_regions gauge
+test_regions{type="A"} 1
+test_regions{type="AAAA"} 2
+`
+	if !strings.HasSuffix(b.String(), want) {
+		t.Log(b.String())
+		t.Fail()
+	}
+}
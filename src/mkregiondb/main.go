@@ -0,0 +1,83 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"config"
+	"query"
+	"storage"
+	"utils"
+)
+
+// Build the region database of region_db from a text file of ranges or
+// from RegionTable of MySQL:
+//
+//	mkregiondb -in ranges.txt -out ip_database
+//	mkregiondb -conf httpdispacher.toml -out ip_database
+//
+// Lines of the text file are "start end id", see storage.ParseRegionRanges.
+// The database is replaced by rename, send SIGHUP to the servers to load it
+
+func main() {
+	in := flag.String("in", "", "Text file of ranges, - for stdin")
+	conf := flag.String("conf", "", "Configuration file whose [mysql] has RegionTable")
+	out := flag.String("out", storage.MMFILE, "Path of the region database")
+	flag.Parse()
+
+	ranges, e := loadRanges(*in, *conf)
+	if e != nil {
+		fmt.Fprintln(os.Stderr, "ERROR:", e)
+		os.Exit(1)
+	}
+	if e := storage.BuildRegionDB(*out, ranges); e != nil {
+		fmt.Fprintln(os.Stderr, "ERROR: build", *out, "failed:", e)
+		os.Exit(1)
+	}
+	db, e := storage.OpenRegionDB(*out)
+	if e != nil {
+		fmt.Fprintln(os.Stderr, "ERROR: check", *out, "failed:", e)
+		os.Exit(1)
+	}
+	defer db.Close()
+	fmt.Println("Region database", *out, "is built,", db.Len(), "ranges")
+}
+
+func loadRanges(in, conf string) ([]storage.RegionRange, error) {
+	switch {
+	case in != "" && conf != "":
+		return nil, fmt.Errorf("only one of -in and -conf can be set")
+	case in != "":
+		var r io.Reader = os.Stdin
+		if in != "-" {
+			f, e := os.Open(in)
+			if e != nil {
+				return nil, e
+			}
+			defer f.Close()
+			r = f
+		}
+		return storage.ParseRegionRanges(r)
+	case conf != "":
+		rc, e := config.LoadConf(conf)
+		if e != nil {
+			return nil, e
+		}
+		if rc.MySQLConf == nil {
+			return nil, fmt.Errorf("[mysql] is not configured in %s", conf)
+		}
+		config.SetRC(rc)
+		utils.InitLogger()
+		if !query.SetMySQLConf(rc.MySQLConf) {
+			return nil, fmt.Errorf("connect mysql failed")
+		}
+		ranges, ee := query.RRMySQL.GetRegionRangesFromMySQL()
+		if ee != nil {
+			return nil, ee
+		}
+		return ranges, nil
+	}
+	return nil, fmt.Errorf("-in or -conf must be set, use -h to see more help")
+}
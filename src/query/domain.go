@@ -1,9 +1,12 @@
 package query
 
 import (
+	"net"
 	"os"
 	"reflect"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/miekg/bitradix"
@@ -17,6 +20,20 @@ import (
 const DefaultRadixNetaddr = uint32(1 << 31)
 const DefaultRadixNetMask = 1
 const DefaultRadixSearchMask = 32
+const DefaultRadixSearchMask6 = 128
+
+// Address family of a Region, same values as the family of edns0 client subnet
+const (
+	FAMILY_IPV4 = uint16(1)
+	FAMILY_IPV6 = uint16(2)
+)
+
+// Where the answers of a Region came from
+const (
+	REGION_SOURCE_ECS     = "ecs"
+	REGION_SOURCE_MYSQL   = "mysql"
+	REGION_SOURCE_DEFAULT = "default"
+)
 
 type MuLLRB struct {
 	LLRB    *llrb.LLRB
@@ -24,8 +41,9 @@ type MuLLRB struct {
 }
 
 type MubitRadix struct {
-	Radix32 *bitradix.Radix32
-	RWMutex *sync.RWMutex
+	Radix32  *bitradix.Radix32
+	Radix128 *Radix128
+	RWMutex  *sync.RWMutex
 }
 
 //For domain name and Region RR
@@ -34,14 +52,16 @@ type DomainRRTree MuLLRB
 //For domain SOA and NS record
 type DomainSOATree MuLLRB
 
-//For domain Region and A/CNAME record
+//For domain Region and A/AAAA/CNAME record
+//Radix32 holds IPv4 client regions and the default region,Radix128 holds IPv6 client regions
 type RegionTree MubitRadix
 
 func NewDomainRegionTree() *RegionTree {
 	//	tbitRadix := bitradix.New32()
 	return &RegionTree{
-		Radix32: bitradix.New32(),
-		RWMutex: &sync.RWMutex{},
+		Radix32:  bitradix.New32(),
+		Radix128: NewRadix128(),
+		RWMutex:  &sync.RWMutex{},
 	}
 }
 
@@ -54,7 +74,8 @@ type Domain struct {
 
 type DomainNode struct {
 	Domain
-	DomainRegionTree *RegionTree
+	DomainRegionTree     *RegionTree // A and CNAME record
+	DomainRegionTreeAAAA *RegionTree // AAAA and CNAME record
 }
 
 func NewDomainNode(d string, soakey string, t uint32) (*DomainNode, *MyError.MyError) {
@@ -67,21 +88,53 @@ func NewDomainNode(d string, soakey string, t uint32) (*DomainNode, *MyError.MyE
 			SOAKey:     soakey,
 			TTL:        t,
 		},
-		DomainRegionTree: NewDomainRegionTree(),
+		DomainRegionTree:     NewDomainRegionTree(),
+		DomainRegionTreeAAAA: NewDomainRegionTree(),
 	}, nil
 }
 
+// Approximate memory of the DomainNode without its regions in bytes
+func (a *DomainNode) Size() int64 {
+	return int64(DOMAIN_BASE_SIZE + len(a.DomainName) + len(a.SOAKey))
+}
+
+// Number of regions in the A and AAAA region trees
+func (a *DomainNode) regionCount() int {
+	n := 0
+	for _, tree := range []*RegionTree{a.DomainRegionTree, a.DomainRegionTreeAAAA} {
+		if tree != nil {
+			n += len(tree.Regions())
+		}
+	}
+	return n
+}
+
+// Region tree of DomainNode for query type t (dns.TypeA or dns.TypeAAAA)
+func (a *DomainNode) GetRegionTreeWithType(t uint16) *RegionTree {
+	if t == dns.TypeAAAA {
+		return a.DomainRegionTreeAAAA
+	}
+	return a.DomainRegionTree
+}
+
 //TODO: redundant data types, need to be redesign
 // dns.RR && RrType && TTL
 type Region struct {
-	NetworkAddr uint32
-	NetworkMask int
+	Family       uint16
+	NetworkAddr  uint32
+	NetworkAddr6 utils.Uint128
+	NetworkMask  int
 	//	IpStart     uint32
 	//	IpEnd       uint32
 	RR         []dns.RR
 	RrType     uint16
 	TTL        uint32
 	UpdateTime time.Time
+	Source     string // REGION_SOURCE_*
+
+	hits    uint32 // since the last sweeps of the cache, see SweepCache
+	lastHit int64  // unix nano
+	created int64  // unix nano, kept across refreshes by inheritHits
 }
 
 func NewRegion(r []dns.RR, networkAddr uint32, networkMask int) (*Region, *MyError.MyError) {
@@ -94,6 +147,7 @@ func NewRegion(r []dns.RR, networkAddr uint32, networkMask int) (*Region, *MyErr
 	}
 
 	dr := &Region{
+		Family:      FAMILY_IPV4,
 		NetworkAddr: networkAddr,
 		NetworkMask: networkMask,
 		//		IpStart:     ipStart,
@@ -102,10 +156,102 @@ func NewRegion(r []dns.RR, networkAddr uint32, networkMask int) (*Region, *MyErr
 		RrType:     r[0].Header().Rrtype,
 		TTL:        r[0].Header().Ttl,
 		UpdateTime: time.Now(),
+		Source:     REGION_SOURCE_ECS,
+	}
+	dr.created = dr.UpdateTime.UnixNano()
+	if networkAddr == DefaultRadixNetaddr && networkMask == DefaultRadixNetMask {
+		dr.Source = REGION_SOURCE_DEFAULT
 	}
 	return dr, nil
 }
 
+// Same as NewRegion, but for IPv6 client networks
+func NewRegion6(r []dns.RR, networkAddr utils.Uint128, networkMask int) (*Region, *MyError.MyError) {
+	if len(r) < 1 {
+		return nil, MyError.NewError(MyError.ERROR_PARAM, "cap of r ([]dns.RR) can not be less than 1 ")
+	}
+	utils.ServerLogger.Debug("NewRegion6: r: ", r, " networkAddr: ", networkAddr, " networkMask: ", networkMask)
+
+	dr := &Region{
+		Family:       FAMILY_IPV6,
+		NetworkAddr6: networkAddr.Mask(networkMask),
+		NetworkMask:  networkMask,
+		RR:           r,
+		RrType:       r[0].Header().Rrtype,
+		TTL:          r[0].Header().Ttl,
+		UpdateTime:   time.Now(),
+		Source:       REGION_SOURCE_ECS,
+	}
+	dr.created = dr.UpdateTime.UnixNano()
+	return dr, nil
+}
+
+// Client network of the region, "1.2.3.0/24" or "2001:db8::/56"
+func (r *Region) Network() string {
+	if r.Family == FAMILY_IPV6 {
+		return utils.Uint128ToIP6(r.NetworkAddr6).String() + "/" + strconv.Itoa(r.NetworkMask)
+	}
+	return utils.Int32ToIP4(r.NetworkAddr).String() + "/" + strconv.Itoa(r.NetworkMask)
+}
+
+// Prefix length of the client networks the region is valid for, 0 for the
+// default region
+func (r *Region) Scope() int {
+	if r.Source == REGION_SOURCE_DEFAULT {
+		return 0
+	}
+	return r.NetworkMask
+}
+
+// TTL left of the region since UpdateTime, 0 when it is expired
+func (r *Region) RemainingTTL() uint32 {
+	elapsed := time.Since(r.UpdateTime).Seconds()
+	if elapsed < 0 {
+		return r.TTL
+	}
+	if elapsed >= float64(r.TTL) {
+		return uint32(0)
+	}
+	return r.TTL - uint32(elapsed)
+}
+
+// Count a lookup of the region
+func (r *Region) Hit() {
+	atomic.AddUint32(&r.hits, 1)
+	atomic.StoreInt64(&r.lastHit, time.Now().UnixNano())
+}
+
+// Last hit, or the creation of the region if it is never hit. Refreshes do
+// not count as a use
+func (r *Region) lastUsed() int64 {
+	if h := atomic.LoadInt64(&r.lastHit); h > 0 {
+		return h
+	}
+	return r.created
+}
+
+// Approximate memory of the region in bytes
+func (r *Region) Size() int {
+	n := REGION_BASE_SIZE
+	for _, rr := range r.RR {
+		n += dns.Len(rr)
+	}
+	return n
+}
+
+func (r *Region) Expired() bool {
+	return r.RemainingTTL() == 0
+}
+
+// How long the region has been expired, 0 if it is not
+func (r *Region) StaleFor() time.Duration {
+	d := time.Since(r.UpdateTime) - time.Duration(r.TTL)*time.Second
+	if d < 0 {
+		return 0
+	}
+	return d
+}
+
 type RRNew struct {
 	RrType uint16
 	Class  uint16
@@ -191,6 +337,11 @@ func InitCache() *MyError.MyError {
 	return nil
 }
 
+// Whether InitCache is done
+func CacheInitialized() bool {
+	return DomainRRCache != nil && DomainSOACache != nil
+}
+
 func (a *DomainNode) Less(b llrb.Item) bool {
 	if x, ok := b.(*DomainNode); ok {
 		return a.DomainName < x.DomainName
@@ -210,13 +361,14 @@ func (a *Domain) Less(b llrb.Item) bool {
 }
 
 // 1,Trust d.DomainName is really a DomainName, so, have not use dns.IsDomainName for checking
-// Check if d is already in the DomainRRTree,if so,make sure update d.DomainRegionTree = dt.DomainRegionTree
+// Check if d is already in the DomainRRTree,if so,make sure update d.DomainRegionTree(AAAA) = dt.DomainRegionTree(AAAA)
 func (DT *DomainRRTree) StoreDomainNodeToCache(d *DomainNode) (bool, *MyError.MyError) {
 	dt, err := DT.GetDomainNodeFromCacheWithName(d.DomainName)
 	if dt != nil && err == nil {
 		//fmt.Println(utils.GetDebugLine(), "DomainRRCache already has DomainNode of d "+d.DomainName)
 		utils.ServerLogger.Debug("DomainRRCache already has DomainNode of d %s", d.DomainName)
 		d.DomainRegionTree = dt.DomainRegionTree
+		d.DomainRegionTreeAAAA = dt.DomainRegionTreeAAAA
 		return true, nil
 
 	} else if err.ErrorNo != MyError.ERROR_NOTFOUND || err.ErrorNo != MyError.ERROR_TYPE {
@@ -263,6 +415,7 @@ func (DT *DomainRRTree) UpdateDomainNode(d *DomainNode) (bool, *MyError.MyError)
 	if _, ok := dns.IsDomainName(d.DomainName); ok {
 		if dt, err := DT.GetDomainNodeFromCache(&d.Domain); dt != nil && err == nil {
 			d.DomainRegionTree = dt.DomainRegionTree
+			d.DomainRegionTreeAAAA = dt.DomainRegionTreeAAAA
 			DT.RWMutex.Lock()
 			r := DT.LLRB.ReplaceOrInsert(d)
 			DT.RWMutex.Unlock()
@@ -361,13 +514,45 @@ func (a *DomainNode) InitRegionTree() (bool, *MyError.MyError) {
 	if a.DomainRegionTree == nil {
 		a.DomainRegionTree = NewDomainRegionTree()
 	}
+	if a.DomainRegionTreeAAAA == nil {
+		a.DomainRegionTreeAAAA = NewDomainRegionTree()
+	}
 	return true, nil
 }
 
 func (RT *RegionTree) GetRegionFromCache(r *Region) (*Region, *MyError.MyError) {
+	if r.Family == FAMILY_IPV6 {
+		return RT.GetRegionFromCacheWithAddr6(r.NetworkAddr6, r.NetworkMask)
+	}
 	return RT.GetRegionFromCacheWithAddr(r.NetworkAddr, r.NetworkMask)
 }
 
+// Search the region of client ip, both IPv4 and IPv6 are supported
+func (RT *RegionTree) GetRegionFromCacheWithIP(ip net.IP) (*Region, *MyError.MyError) {
+	if utils.IsIPv4(ip) {
+		return RT.GetRegionFromCacheWithAddr(utils.Ip4ToInt32(ip), DefaultRadixSearchMask)
+	} else if utils.IsIPv6(ip) {
+		return RT.GetRegionFromCacheWithAddr6(utils.Ip6ToUint128(ip), DefaultRadixSearchMask6)
+	}
+	return nil, MyError.NewError(MyError.ERROR_PARAM, "Not valid ip "+ip.String())
+}
+
+// Search IPv6 region in Radix128, fall back to the default region in Radix32,
+// which is shared by all clients
+func (RT *RegionTree) GetRegionFromCacheWithAddr6(addr utils.Uint128, mask int) (*Region, *MyError.MyError) {
+	RT.RWMutex.RLock()
+	r := RT.Radix128.Find(addr, mask)
+	RT.RWMutex.RUnlock()
+	if r != nil && r.Value != nil {
+		utils.ServerLogger.Debug("GetRegionFromCacheWithAddr6: ", r.Key(), r.Bits(), addr, mask)
+		if rr, ok := r.Value.(*Region); ok {
+			return rr, nil
+		}
+		return nil, MyError.NewError(MyError.ERROR_NOTVALID, "Found result but not valid,need check !")
+	}
+	return RT.GetRegionFromCacheWithAddr(DefaultRadixNetaddr, DefaultRadixNetMask)
+}
+
 func (RT *RegionTree) GetRegionFromCacheWithAddr(addr uint32, mask int) (*Region, *MyError.MyError) {
 	RT.RWMutex.RLock()
 	defer RT.RWMutex.RUnlock()
@@ -398,8 +583,19 @@ func (RT *RegionTree) AddRegionToCache(r *Region) bool {
 	if ok := CheckRegionFromCache(r); !ok {
 		//Todo: add split region logic
 	}
+	defer regionInserted()
 	RT.RWMutex.Lock()
 	defer RT.RWMutex.Unlock()
+	if r.Family == FAMILY_IPV6 {
+		if x := RT.Radix128.Find(r.NetworkAddr6, r.NetworkMask); x != nil {
+			r.inheritHits(x.Value)
+		}
+		RT.Radix128.Insert(r.NetworkAddr6, r.NetworkMask, r)
+		return true
+	}
+	if x := RT.Radix32.Find(r.NetworkAddr, r.NetworkMask); x != nil {
+		r.inheritHits(x.Value)
+	}
 	RT.Radix32.Insert(r.NetworkAddr, r.NetworkMask, r)
 	//fmt.Println(utils.GetDebugLine(), "AddRegionToCache : ",
 	//	" NetworkAddr: ", r.NetworkAddr, " NetworkMask: ", r.NetworkMask, " RR: ", r.RR)
@@ -410,6 +606,10 @@ func (RT *RegionTree) UpdateRegionToCache(r *Region) bool {
 	if rnode, e := RT.GetRegionFromCache(r); e == nil && rnode != nil {
 		RT.RWMutex.Lock()
 		defer RT.RWMutex.Unlock()
+		if r.Family == FAMILY_IPV6 {
+			RT.Radix128.Insert(r.NetworkAddr6, r.NetworkMask, r)
+			return true
+		}
 		RT.Radix32.Remove(r.NetworkAddr, r.NetworkMask)
 		RT.Radix32.Insert(r.NetworkAddr, r.NetworkMask, r)
 	} else {
@@ -419,9 +619,15 @@ func (RT *RegionTree) UpdateRegionToCache(r *Region) bool {
 }
 
 func (RT *RegionTree) DelRegionFromCache(r *Region) (bool, *MyError.MyError) {
-	if rnode, e := RT.GetRegionFromCache(r); rnode != nil && e == nil {
+	// GetRegionFromCache is a longest prefix match, only the region of
+	// exactly the same network can be removed
+	if rnode, e := RT.GetRegionFromCache(r); rnode != nil && e == nil && rnode.Network() == r.Network() {
 		RT.RWMutex.Lock()
-		RT.Radix32.Remove(r.NetworkAddr, r.NetworkMask)
+		if r.Family == FAMILY_IPV6 {
+			RT.Radix128.Remove(r.NetworkAddr6, r.NetworkMask)
+		} else {
+			RT.Radix32.Remove(r.NetworkAddr, r.NetworkMask)
+		}
 		RT.RWMutex.Unlock()
 		//fmt.Println(utils.GetDebugLine(), "Remove Region from RegionCache "+string(r.NetworkAddr)+":"+string(r.NetworkMask))
 		utils.ServerLogger.Debug("Remove Region from RegionCache %s : %s", string(r.NetworkAddr), string(r.NetworkMask))
@@ -432,6 +638,54 @@ func (RT *RegionTree) DelRegionFromCache(r *Region) (bool, *MyError.MyError) {
 
 }
 
+// Keep the hits and the creation time of the region v replaced by r, so
+// that a refreshed region stays protected from eviction only if it is used
+func (r *Region) inheritHits(v interface{}) {
+	if old, ok := v.(*Region); ok && old != r && old.Family == r.Family && old.Network() == r.Network() {
+		atomic.StoreUint32(&r.hits, atomic.LoadUint32(&old.hits))
+		atomic.StoreInt64(&r.lastHit, atomic.LoadInt64(&old.lastHit))
+		if old.created > 0 && old.created < r.created {
+			r.created = old.created
+		}
+	}
+}
+
+// Remove r if it is still the region of its network
+func (RT *RegionTree) evictRegion(r *Region) bool {
+	RT.RWMutex.Lock()
+	defer RT.RWMutex.Unlock()
+	if r.Family == FAMILY_IPV6 {
+		if x := RT.Radix128.Find(r.NetworkAddr6, r.NetworkMask); x == nil || x.Value != interface{}(r) {
+			return false
+		}
+		RT.Radix128.Remove(r.NetworkAddr6, r.NetworkMask)
+		return true
+	}
+	if x := RT.Radix32.Find(r.NetworkAddr, r.NetworkMask); x == nil || x.Value != interface{}(r) {
+		return false
+	}
+	RT.Radix32.Remove(r.NetworkAddr, r.NetworkMask)
+	return true
+}
+
+// All regions of the tree, ipv4 networks first
+func (RT *RegionTree) Regions() []*Region {
+	var regions []*Region
+	RT.RWMutex.RLock()
+	defer RT.RWMutex.RUnlock()
+	RT.Radix32.Do(func(r1 *bitradix.Radix32, i int) {
+		if r, ok := r1.Value.(*Region); ok && r != nil {
+			regions = append(regions, r)
+		}
+	})
+	RT.Radix128.Do(func(r1 *Radix128, i int) {
+		if r, ok := r1.Value.(*Region); ok && r != nil {
+			regions = append(regions, r)
+		}
+	})
+	return regions
+}
+
 func (RT *RegionTree) TraverseRegionTree() {
 	RT.Radix32.Do(func(r1 *bitradix.Radix32, i int) {
 		//fmt.Println(utils.GetDebugLine(), r1.Key(),
@@ -440,4 +694,7 @@ func (RT *RegionTree) TraverseRegionTree() {
 		//	r1.Leaf(), i)
 		utils.ServerLogger.Debug("TraverseRegionTree: ", r1.Value, r1.Bits(), r1.Leaf(), i)
 	})
+	RT.Radix128.Do(func(r1 *Radix128, i int) {
+		utils.ServerLogger.Debug("TraverseRegionTree: ", r1.Value, r1.Bits(), r1.Leaf(), i)
+	})
 }
@@ -4,6 +4,7 @@ import (
 	"net"
 	"reflect"
 	"testing"
+	"time"
 	"utils"
 
 	"MyError"
@@ -360,3 +361,54 @@ func TestMubitRadix(t *testing.T) {
 		t.Log(r1.Key(), r1.Value, r1.Bits())
 	})
 }
+
+func TestRegionTree6(t *testing.T) {
+	rt := NewDomainRegionTree()
+	aaaa := []dns.RR{&dns.AAAA{Hdr: dns.RR_Header{Name: "www.a.com.", Rrtype: dns.TypeAAAA, Ttl: 60}, AAAA: net.ParseIP("2001:db8::53")}}
+	def := []dns.RR{&dns.AAAA{Hdr: dns.RR_Header{Name: "www.a.com.", Rrtype: dns.TypeAAAA, Ttl: 60}, AAAA: net.ParseIP("2001:db8::1")}}
+
+	_, ipnet, _ := net.ParseCIDR("240e:1234:5600::/40")
+	addr, mask := utils.IpNetToUint128(ipnet)
+	r, _ := NewRegion6(aaaa, addr, mask)
+	rt.AddRegionToCache(r)
+	d, _ := NewRegion(def, DefaultRadixNetaddr, DefaultRadixNetMask)
+	rt.AddRegionToCache(d)
+
+	x, e := rt.GetRegionFromCacheWithIP(net.ParseIP("240e:1234:5678::1"))
+	if e != nil || x != r {
+		t.Log(x, e)
+		t.Fail()
+	}
+	// other IPv6 clients fall back to the default region
+	x, e = rt.GetRegionFromCacheWithIP(net.ParseIP("2400:cb00::1"))
+	if e != nil || x != d {
+		t.Log(x, e)
+		t.Fail()
+	}
+
+	rt.DelRegionFromCache(r)
+	x, e = rt.GetRegionFromCacheWithIP(net.ParseIP("240e:1234:5678::1"))
+	if e != nil || x != d {
+		t.Log(x, e)
+		t.Fail()
+	}
+}
+
+func TestRegionRemainingTTL(t *testing.T) {
+	a := []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "www.a.com.", Rrtype: dns.TypeA, Ttl: 60}, A: net.ParseIP("1.1.1.1")}}
+	r, _ := NewRegion(a, DefaultRadixNetaddr, DefaultRadixNetMask)
+	if x := r.RemainingTTL(); x != 60 {
+		t.Log(x)
+		t.Fail()
+	}
+	r.UpdateTime = r.UpdateTime.Add(-20 * time.Second)
+	if x := r.RemainingTTL(); x != 40 {
+		t.Log(x)
+		t.Fail()
+	}
+	r.UpdateTime = r.UpdateTime.Add(-60 * time.Second)
+	if x := r.RemainingTTL(); x != 0 {
+		t.Log(x)
+		t.Fail()
+	}
+}
@@ -0,0 +1,214 @@
+package query
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"config"
+	"utils"
+)
+
+// Eviction of cold regions when the cache is over the budget of [cache].
+// The usage is computed by a sweep of the cache, run every
+// CACHE_SWEEP_INTERVAL or after CACHE_SWEEP_INSERTS regions are added.
+// Regions are evicted by hits since the last sweeps (halved by each sweep)
+// and then by the last use, regions from MySQL and regions hit at least
+// protect_hits times are kept
+
+const (
+	CACHE_SWEEP_INTERVAL = 10 * time.Second
+	CACHE_SWEEP_INSERTS  = 256
+	CACHE_LOW_WATERMARK  = 0.9 // evict down to 90% of the budget
+	DEFAULT_PROTECT_HITS = 16
+
+	// approximate memory of a region, a domain and their tree nodes, the
+	// records are added
+	REGION_BASE_SIZE = 192
+	DOMAIN_BASE_SIZE = 320
+)
+
+// Entries and approximate bytes of the cache, 0 is unlimited
+type CacheBudget struct {
+	MaxEntries  int
+	MaxMemory   int64
+	ProtectHits uint32
+}
+
+func (b CacheBudget) Enabled() bool {
+	return b.MaxEntries > 0 || b.MaxMemory > 0
+}
+
+func (b CacheBudget) over(entries int, bytes int64, ratio float64) bool {
+	return (b.MaxEntries > 0 && float64(entries) > float64(b.MaxEntries)*ratio) ||
+		(b.MaxMemory > 0 && float64(bytes) > float64(b.MaxMemory)*ratio)
+}
+
+// Result of a sweep
+type CacheUsage struct {
+	Domains        int
+	Regions        int
+	Bytes          int64
+	EvictedRegions int
+	EvictedDomains int
+}
+
+func (u CacheUsage) Entries() int {
+	return u.Domains + u.Regions
+}
+
+var cacheBudget = struct {
+	sync.Mutex
+	budget  CacheBudget
+	started bool
+	wake    chan struct{}
+	usage   CacheUsage // of the last sweep
+}{wake: make(chan struct{}, 1)}
+
+var regionInserts int64
+
+// Apply [cache] of the configuration and start the sweeps, nil is no limit
+func InitCacheBudget(rc *config.CacheConf) {
+	b := CacheBudget{ProtectHits: DEFAULT_PROTECT_HITS}
+	if rc != nil {
+		b.MaxEntries, b.MaxMemory = rc.MaxEntries, rc.MaxMemory
+		if rc.ProtectHits > 0 {
+			b.ProtectHits = rc.ProtectHits
+		}
+	}
+	cacheBudget.Lock()
+	cacheBudget.budget = b
+	if !cacheBudget.started {
+		cacheBudget.started = true
+		go sweepLoop()
+	}
+	cacheBudget.Unlock()
+	triggerSweep()
+}
+
+// Usage of the cache computed by the last sweep
+func LastCacheUsage() CacheUsage {
+	cacheBudget.Lock()
+	defer cacheBudget.Unlock()
+	return cacheBudget.usage
+}
+
+func triggerSweep() {
+	select {
+	case cacheBudget.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Called when a region is added to a region tree
+func regionInserted() {
+	if atomic.AddInt64(&regionInserts, 1)%CACHE_SWEEP_INSERTS == 0 {
+		triggerSweep()
+	}
+}
+
+func sweepLoop() {
+	ticker := time.NewTicker(CACHE_SWEEP_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-cacheBudget.wake:
+		}
+		cacheBudget.Lock()
+		b := cacheBudget.budget
+		cacheBudget.Unlock()
+		u := SweepCache(b)
+		cacheBudget.Lock()
+		cacheBudget.usage = u
+		cacheBudget.Unlock()
+	}
+}
+
+type sweepRegion struct {
+	r         *Region
+	tree      *RegionTree
+	dn        *DomainNode
+	qtype     uint16
+	hits      uint32
+	lastUsed  int64
+	protected bool
+}
+
+// Compute the usage of the cache and evict the coldest regions until it is
+// within CACHE_LOW_WATERMARK of b. Domains left without regions by the
+// eviction are removed as well. The hits of the regions are halved
+func SweepCache(b CacheBudget) CacheUsage {
+	var u CacheUsage
+	if DomainRRCache == nil {
+		return u
+	}
+	nodes := cachedDomainNodes()
+	var regions []*sweepRegion
+	for _, dn := range nodes {
+		u.Domains++
+		u.Bytes += dn.Size()
+		mysql := config.IsLocalMysqlBackend(dn.DomainName)
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			tree := dn.GetRegionTreeWithType(qtype)
+			if tree == nil {
+				continue
+			}
+			for _, r := range tree.Regions() {
+				hits := atomic.LoadUint32(&r.hits)
+				regions = append(regions, &sweepRegion{r: r, tree: tree, dn: dn, qtype: qtype, hits: hits, lastUsed: r.lastUsed(),
+					protected: mysql || r.Source == REGION_SOURCE_MYSQL || hits >= b.ProtectHits})
+				atomic.StoreUint32(&r.hits, hits/2)
+				u.Regions++
+				u.Bytes += int64(r.Size())
+			}
+		}
+	}
+	if !b.Enabled() || !b.over(u.Entries(), u.Bytes, 1) {
+		return u
+	}
+
+	sort.Slice(regions, func(i, j int) bool {
+		if regions[i].hits != regions[j].hits {
+			return regions[i].hits < regions[j].hits
+		}
+		return regions[i].lastUsed < regions[j].lastUsed
+	})
+	emptied := map[*DomainNode]bool{}
+	for _, x := range regions {
+		if !b.over(u.Entries(), u.Bytes, CACHE_LOW_WATERMARK) {
+			break
+		}
+		if x.protected || !x.tree.evictRegion(x.r) {
+			continue
+		}
+		u.Regions--
+		u.Bytes -= int64(x.r.Size())
+		u.EvictedRegions++
+		cacheEvictions.Inc("region")
+		Refresher.Cancel(RefreshKey{Domain: x.dn.DomainName, Qtype: x.qtype, Network: x.r.Network()})
+		emptied[x.dn] = true
+	}
+	for dn := range emptied {
+		if dn.regionCount() > 0 || config.IsLocalMysqlBackend(dn.DomainName) {
+			continue
+		}
+		DomainRRCache.DelDomainNode(&dn.Domain)
+		Refresher.CancelDomain(dn.DomainName)
+		u.Domains--
+		u.Bytes -= dn.Size()
+		u.EvictedDomains++
+		cacheEvictions.Inc("domain")
+	}
+	if b.over(u.Entries(), u.Bytes, 1) {
+		utils.ServerLogger.Warning("cache is over the budget after eviction, entries: %d bytes: %d, the rest are protected",
+			u.Entries(), u.Bytes)
+	} else {
+		utils.ServerLogger.Info("cache eviction: %d regions and %d domains are evicted, entries: %d bytes: %d",
+			u.EvictedRegions, u.EvictedDomains, u.Entries(), u.Bytes)
+	}
+	return u
+}
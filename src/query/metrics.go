@@ -0,0 +1,122 @@
+package query
+
+import (
+	"time"
+
+	"github.com/petar/GoLLRB/llrb"
+
+	"MyError"
+	"metrics"
+)
+
+// Results of GetRegionFromCacheWithType
+const (
+	CACHE_HIT       = "hit"
+	CACHE_CNAME     = "cname"     // the region holds a CNAME record
+	CACHE_MISS      = "miss"      // the domain is cached but not the region of the client
+	CACHE_EXPIRED   = "expired"   // the region of the client is expired
+	CACHE_NO_DOMAIN = "no_domain" // the domain is not cached
+)
+
+var (
+	cacheLookups = metrics.NewCounterVec("httpdispacher_cache_lookups_total",
+		"Lookups of the region cache by query type and result.", "type", "result")
+	cacheEvictions = metrics.NewCounterVec("httpdispacher_cache_evictions_total",
+		"Regions and domains evicted from the cache over the budget of [cache].", "kind")
+	upstreamQueryDuration = metrics.NewHistogramVec("httpdispacher_upstream_query_duration_seconds",
+		"Latency of dns queries to the upstream nameservers.", metrics.DEFAULT_BUCKETS, "nameserver")
+	upstreamQueryErrors = metrics.NewCounterVec("httpdispacher_upstream_query_errors_total",
+		"Dns queries to the upstream nameservers failed in transport or answered with SERVFAIL/REFUSED.", "nameserver")
+	mysqlQueryDuration = metrics.NewHistogramVec("httpdispacher_mysql_query_duration_seconds",
+		"Latency of MySQL backend queries by table.", metrics.DEFAULT_BUCKETS, "query")
+	mysqlQueryErrors = metrics.NewCounterVec("httpdispacher_mysql_query_errors_total",
+		"Failed MySQL backend queries by table, not found is not an error.", "query")
+)
+
+func init() {
+	metrics.NewGaugeFunc("httpdispacher_cache_domains", "Domains in DomainRRCache.", func() float64 {
+		return float64(cacheLen((*MuLLRB)(DomainRRCache)))
+	})
+	metrics.NewGaugeFunc("httpdispacher_cache_soa", "SOA records in DomainSOACache.", func() float64 {
+		return float64(cacheLen((*MuLLRB)(DomainSOACache)))
+	})
+	metrics.NewGaugeVecFunc("httpdispacher_cache_regions", "Regions in the region trees by query type.", "type",
+		func() map[string]float64 {
+			n4, n6 := CacheRegions()
+			return map[string]float64{"A": float64(n4), "AAAA": float64(n6)}
+		})
+	metrics.NewGaugeFunc("httpdispacher_cache_entries", "Domains and regions in the cache at the last sweep.", func() float64 {
+		return float64(LastCacheUsage().Entries())
+	})
+	metrics.NewGaugeFunc("httpdispacher_cache_bytes", "Approximate memory of the cache at the last sweep.", func() float64 {
+		return float64(LastCacheUsage().Bytes)
+	})
+	metrics.NewGaugeFunc("httpdispacher_refresh_queue", "Pending refreshes of the cached regions.", func() float64 {
+		return float64(Refresher.Len())
+	})
+	metrics.NewGaugeFunc("httpdispacher_refresh_running", "Refreshes of the cached regions being run.", func() float64 {
+		return float64(Refresher.Running())
+	})
+}
+
+func cacheLen(t *MuLLRB) int {
+	if t == nil {
+		return 0
+	}
+	t.RWMutex.RLock()
+	defer t.RWMutex.RUnlock()
+	return t.LLRB.Len()
+}
+
+// Number of regions in the A and AAAA region trees of all cached domains
+func CacheRegions() (int, int) {
+	if DomainRRCache == nil {
+		return 0, 0
+	}
+	n4, n6 := 0, 0
+	for _, dn := range cachedDomainNodes() {
+		if dn.DomainRegionTree != nil {
+			n4 += len(dn.DomainRegionTree.Regions())
+		}
+		if dn.DomainRegionTreeAAAA != nil {
+			n6 += len(dn.DomainRegionTreeAAAA.Regions())
+		}
+	}
+	return n4, n6
+}
+
+// All DomainNodes of DomainRRCache
+func cachedDomainNodes() []*DomainNode {
+	var nodes []*DomainNode
+	DomainRRCache.RWMutex.RLock()
+	DomainRRCache.LLRB.AscendGreaterOrEqual(&Domain{}, func(i llrb.Item) bool {
+		if dn, ok := i.(*DomainNode); ok {
+			nodes = append(nodes, dn)
+		}
+		return true
+	})
+	DomainRRCache.RWMutex.RUnlock()
+	return nodes
+}
+
+func cacheLookupResult(dn *DomainNode, e *MyError.MyError) string {
+	switch {
+	case e == nil:
+		return CACHE_HIT
+	case e.ErrorNo == MyError.ERROR_CNAME:
+		return CACHE_CNAME
+	case e.ErrorNo == MyError.ERROR_STALE:
+		return CACHE_EXPIRED
+	case dn == nil:
+		return CACHE_NO_DOMAIN
+	}
+	return CACHE_MISS
+}
+
+// Record a query of the MySQL backend started at start, e is its result
+func observeMySQL(q string, start time.Time, e *MyError.MyError) {
+	mysqlQueryDuration.ObserveSince(start, q)
+	if e != nil && e.ErrorNo != MyError.ERROR_NOTFOUND && e.ErrorNo != MyError.ERROR_NORESULT {
+		mysqlQueryErrors.Inc(q)
+	}
+}
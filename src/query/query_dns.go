@@ -1,6 +1,7 @@
 package query
 
 import (
+	"errors"
 	"net"
 	"strconv"
 	"strings"
@@ -20,9 +21,14 @@ const (
 	UDP                 = "udp"
 	TCP                 = "tcp"
 	DEFAULT_SOURCEMASK  = 32
+	DEFAULT_SOURCEMASK6 = 56
 	DEFAULT_SOURCESCOPE = 0
 )
 
+// Port of the authoritative nameservers of the SOA records, tests point
+// it to local nameservers
+var NSServerPort = NS_SERVER_PORT
+
 // type Query , dns Query type and Query result
 type Query struct {
 	QueryType     uint16
@@ -69,13 +75,19 @@ func RenewDnsMsg(m *dns.Msg) {
 	m.Question = nil
 }
 
+// Family of the edns0 client subnet is 1 for IPv4 ip and 2 for IPv6 ip
 func PackEdns0SubnetOPT(ip string, sourceNetmask, sourceScope uint8) *dns.OPT {
 	edns0subnet := &dns.EDNS0_SUBNET{
 		Code:          dns.EDNS0SUBNET,
 		SourceScope:   sourceScope,
 		SourceNetmask: sourceNetmask,
-		Address:       net.ParseIP(ip).To4(),
-		Family:        1,
+	}
+	if x := net.ParseIP(ip); utils.IsIPv4(x) {
+		edns0subnet.Family = FAMILY_IPV4
+		edns0subnet.Address = x.To4().Mask(net.CIDRMask(int(sourceNetmask), 32))
+	} else {
+		edns0subnet.Family = FAMILY_IPV6
+		edns0subnet.Address = x.To16().Mask(net.CIDRMask(int(sourceNetmask), 128))
 	}
 	o := &dns.OPT{
 		Hdr: dns.RR_Header{
@@ -131,50 +143,77 @@ func GenerateParentDomain(d string) (string, *MyError.MyError) {
 	return d, MyError.NewError(MyError.ERROR_UNKNOWN, d+" unknown error")
 }
 
-func doQuery(c dns.Client, m dns.Msg, ds, dp string, queryType uint16, close chan struct{}) *dns.Msg {
+// Answer of a nameserver, or the last error of it. NXDOMAIN and NODATA are
+// answers, not errors
+type upstreamResult struct {
+	r *dns.Msg
+	e error
+}
+
+func doQuery(c dns.Client, m dns.Msg, ds, dp string, queryType uint16, close chan struct{}) upstreamResult {
 	//	r := &dns.Msg{}
 	//	var ee error
 	//fmt.Println(utils.GetDebugLine(), " doQuery: ", " m.Question: ", m.Question,
 	//	" ds: ", ds, " dp: ", dp, " queryType ", queryType)
 	utils.ServerLogger.Debug(" doQuery: m.Question: %v ds: %s dp: %s queryType: %v", m.Question, ds, dp, queryType)
+	var last error
 	select {
 	case <-close:
-		return nil
+		return upstreamResult{e: errors.New("query to " + ds + " is canceled")}
 	default:
 		for l := 0; l < 3; l++ {
+			start := time.Now()
 			r, _, ee := c.Exchange(&m, ds+":"+dp)
-			if (ee != nil) || (r == nil) || (r.Answer == nil) {
-				utils.ServerLogger.Error(" doQuery: retry: %s times error: %s", strconv.Itoa(l), ee.Error())
-				if (queryType == dns.TypeA) || (queryType == dns.TypeCNAME) {
-					if strings.Contains(ee.Error(), "connection refused") {
-						if c.Net == TCP {
-							c.Net = UDP
-						}
-					} else if (ee == dns.ErrTruncated) && queryType == dns.TypeA {
-						utils.ServerLogger.Error(" doQuery: response truncated: %v", r)
-						//					m.SetEdns0(4096,false)
-						//					m.SetQuestion(dns.Fqdn(domainName),dns.TypeCNAME)
-						c.Net = TCP
+			upstreamQueryDuration.ObserveSince(start, ds)
+			// NXDOMAIN and NODATA are final, the other servers answer the same
+			if ee == nil && r != nil && (r.Rcode == dns.RcodeSuccess || r.Rcode == dns.RcodeNameError) {
+				return upstreamResult{r: r}
+			}
+			if upstreamFailed(r, ee) {
+				upstreamQueryErrors.Inc(ds)
+			}
+			if ee == nil && r != nil {
+				ee = errors.New(dns.RcodeToString[r.Rcode] + " from " + ds)
+			} else if ee == nil {
+				ee = errors.New("no answer from " + ds)
+			}
+			last = ee
+			utils.ServerLogger.Error(" doQuery: retry: %s times error: %s", strconv.Itoa(l), ee.Error())
+			if (queryType == dns.TypeA) || (queryType == dns.TypeAAAA) || (queryType == dns.TypeCNAME) {
+				if strings.Contains(ee.Error(), "connection refused") {
+					if c.Net == TCP {
+						c.Net = UDP
+					}
+				} else if (ee == dns.ErrTruncated) && (queryType == dns.TypeA || queryType == dns.TypeAAAA) {
+					utils.ServerLogger.Error(" doQuery: response truncated: %v", r)
+					//					m.SetEdns0(4096,false)
+					//					m.SetQuestion(dns.Fqdn(domainName),dns.TypeCNAME)
+					c.Net = TCP
+				} else {
+					if c.Net == TCP {
+						c.Net = UDP
 					} else {
-						if c.Net == TCP {
-							c.Net = UDP
-						} else {
-							c.Net = TCP
-						}
+						c.Net = TCP
 					}
 				}
-			} else {
-				return r
 			}
 		}
 	}
 
-	return nil
+	return upstreamResult{e: last}
+}
+
+// Whether a query to an upstream nameserver failed, for the error metric:
+// transport errors and SERVFAIL/REFUSED. NXDOMAIN and NODATA are answers
+func upstreamFailed(r *dns.Msg, e error) bool {
+	return e != nil || r == nil || r.Rcode == dns.RcodeServerFailure || r.Rcode == dns.RcodeRefused
 }
 
 // General Query for dns upstream query
 // param: t string ["tcp"|"udp]
 // 		  queryType uint16 dns.QueryType
+// NXDOMAIN returns ERROR_NOTFOUND and NODATA returns ERROR_NORESULT, with
+// the answer for its authority section
 func DoQuery(
 	domainName string,
 	domainResolverIP []string,
@@ -207,7 +246,7 @@ func DoQuery(
 	if queryOpt != nil {
 		m.Extra = append(m.Extra, queryOpt)
 	}
-	var x = make(chan *dns.Msg)
+	var x = make(chan upstreamResult)
 	var closesig = make(chan struct{})
 	for _, ds := range domainResolverIP {
 		go func(c *dns.Client, m *dns.Msg, ds, dp string, queryType uint16, closesig chan struct{}) {
@@ -218,11 +257,18 @@ func DoQuery(
 		}(c, m, ds, domainResolverPort, queryType, closesig)
 	}
 
-	if r := <-x; r != nil {
+	if r := <-x; r.r != nil {
 		close(closesig)
-		return r, nil
+		if r.r.Rcode == dns.RcodeNameError {
+			return r.r, MyError.NewError(MyError.ERROR_NOTFOUND, domainName+" does not exist")
+		} else if len(r.r.Answer) == 0 {
+			return r.r, MyError.NewError(MyError.ERROR_NORESULT, domainName+" has no "+dns.TypeToString[queryType]+" record")
+		}
+		return r.r, nil
+	} else if ne, ok := r.e.(net.Error); ok && ne.Timeout() {
+		return nil, MyError.Wrap(MyError.ERROR_TIMEOUT, "Query timeout "+domainName, r.e)
 	} else {
-		return nil, MyError.NewError(MyError.ERROR_UNKNOWN, "Query failed "+domainName)
+		return nil, MyError.Wrap(MyError.ERROR_UPSTREAM, "Query failed "+domainName, r.e)
 	}
 }
 
@@ -241,7 +287,11 @@ func preQuery(d, srcIP string) (*dns.OPT, *MyError.MyError) {
 
 	var o *dns.OPT
 	if len(srcIP) > 0 {
-		o = PackEdns0SubnetOPT(srcIP, DEFAULT_SOURCEMASK, DEFAULT_SOURCESCOPE)
+		if utils.IsIPv6(net.ParseIP(srcIP)) {
+			o = PackEdns0SubnetOPT(srcIP, DEFAULT_SOURCEMASK6, DEFAULT_SOURCESCOPE)
+		} else {
+			o = PackEdns0SubnetOPT(srcIP, DEFAULT_SOURCEMASK, DEFAULT_SOURCESCOPE)
+		}
 	} else {
 		o = nil
 	}
@@ -261,16 +311,21 @@ func QuerySOA(d string) (*dns.SOA, []*dns.NS, *MyError.MyError) {
 
 	var soa *dns.SOA
 	var ns_a []*dns.NS
+	var last *MyError.MyError // last upstream error
 	for c := 0; (soa == nil) && (c < 3); c++ {
 
 		soa, ns_a = nil, nil
 		r, e := DoQuery(d, cf.Servers, cf.Port, dns.TypeSOA, nil, UDP)
 		//		fmt.Println(r)
-		if e != nil {
+		if e != nil && e.ErrorNo == MyError.ERROR_NOTFOUND {
+			return nil, nil, e
+		} else if e != nil && e.ErrorNo != MyError.ERROR_NORESULT {
 			utils.QueryLogger.Error("QeurySOA got error : "+e.Error()+
 				". Param: %s , %v, %s, %v ", d, cf.Servers, cf.Port, dns.TypeSOA)
+			last = e
 			continue
 		} else {
+			// NODATA has the SOA of the zone in the authority section
 			var rr []dns.RR
 			if r.Answer != nil {
 				rr = append(rr, r.Answer...)
@@ -324,6 +379,9 @@ func QuerySOA(d string) (*dns.SOA, []*dns.NS, *MyError.MyError) {
 			}
 		}
 	}
+	if last != nil {
+		return nil, nil, MyError.Wrap(last.ErrorNo, d+" QuerySOA failed", last)
+	}
 	return nil, nil, MyError.NewError(MyError.ERROR_UNKNOWN, d+" QuerySOA faild with unknow error")
 }
 
@@ -363,6 +421,49 @@ func ParseSOA(d string, r []dns.RR) (*dns.SOA, []*dns.NS, *MyError.MyError) {
 	}
 }
 
+// Send a SOA query of the root zone to the nameservers of
+// DEFAULT_RESOLV_FILE, see ProbeUpstream
+func ProbeResolvers(timeout time.Duration) (string, *MyError.MyError) {
+	cf, e := dns.ClientConfigFromFile(DEFAULT_RESOLV_FILE)
+	if e != nil {
+		return "", MyError.NewError(MyError.ERROR_UNKNOWN, "Get dns config from file "+DEFAULT_RESOLV_FILE+" failed: "+e.Error())
+	}
+	return ProbeUpstream(cf.Servers, cf.Port, timeout)
+}
+
+// Send a SOA query of the root zone to all servers at once, the first one
+// which answers within timeout is returned
+func ProbeUpstream(servers []string, port string, timeout time.Duration) (string, *MyError.MyError) {
+	if len(servers) == 0 {
+		return "", MyError.NewError(MyError.ERROR_PARAM, "No upstream nameserver")
+	}
+	m := new(dns.Msg)
+	m.SetQuestion(".", dns.TypeSOA)
+	x := make(chan string, len(servers))
+	for _, ds := range servers {
+		go func(ds string) {
+			c := &dns.Client{Net: UDP, Timeout: timeout}
+			start := time.Now()
+			r, _, e := c.Exchange(m.Copy(), net.JoinHostPort(ds, port))
+			upstreamQueryDuration.ObserveSince(start, ds)
+			if upstreamFailed(r, e) {
+				upstreamQueryErrors.Inc(ds)
+			}
+			if e != nil || r == nil || r.Rcode != dns.RcodeSuccess {
+				x <- ""
+				return
+			}
+			x <- ds
+		}(ds)
+	}
+	for range servers {
+		if ds := <-x; ds != "" {
+			return ds, nil
+		}
+	}
+	return "", MyError.NewError(MyError.ERROR_UNKNOWN, "No upstream nameserver answers: "+strings.Join(servers, ","))
+}
+
 //
 func QueryNS(d string) ([]*dns.NS, *MyError.MyError) {
 	//	ds, dp, _, e := preQuery(d, false)
@@ -400,8 +501,17 @@ func ParseNS(ns []dns.RR) (bool, []*dns.NS) {
 }
 
 func QueryA(d, srcIp string, ds []string, dp string) ([]dns.RR, *dns.RR_Header, *dns.EDNS0_SUBNET, *MyError.MyError) {
+	return QueryRR(d, srcIp, ds, dp, dns.TypeA)
+}
+
+func QueryAAAA(d, srcIp string, ds []string, dp string) ([]dns.RR, *dns.RR_Header, *dns.EDNS0_SUBNET, *MyError.MyError) {
+	return QueryRR(d, srcIp, ds, dp, dns.TypeAAAA)
+}
+
+// Query record of queryType(dns.TypeA or dns.TypeAAAA) with edns0 client subnet of srcIp
+func QueryRR(d, srcIp string, ds []string, dp string, queryType uint16) ([]dns.RR, *dns.RR_Header, *dns.EDNS0_SUBNET, *MyError.MyError) {
 	o, e := preQuery(d, srcIp)
-	r, e := DoQuery(d, ds, dp, dns.TypeA, o, UDP)
+	r, e := DoQuery(d, ds, dp, queryType, o, UDP)
 	if e != nil || r == nil {
 		//		fmt.Println(r)
 		return nil, nil, nil, e
@@ -434,6 +544,23 @@ func ParseA(a []dns.RR, d string) ([]*dns.A, bool) {
 	return nil, false
 }
 
+func ParseAAAA(a []dns.RR, d string) ([]*dns.AAAA, bool) {
+	var aaaa_rr []*dns.AAAA
+	for _, aa := range a {
+		if x, ok := aa.(*dns.AAAA); ok {
+			if x.Hdr.Name == dns.Fqdn(d) {
+				aaaa_rr = append(aaaa_rr, x)
+			} else {
+				utils.ServerLogger.Debug("ParseAAAA: %s", x)
+			}
+		}
+	}
+	if len(aaaa_rr) > 0 {
+		return aaaa_rr, true
+	}
+	return nil, false
+}
+
 // Query
 func QueryCNAME(d, srcIP string, ds []string, dp string) ([]*dns.CNAME, *dns.RR_Header, *dns.EDNS0_SUBNET, *MyError.MyError) {
 	o, e := preQuery(d, srcIP)
@@ -6,8 +6,10 @@ import (
 	"utils"
 
 	"strconv"
+	"sync"
 
 	"config"
+	"storage"
 
 	_ "github.com/go-sql-driver/mysql"
 	"github.com/miekg/dns"
@@ -37,6 +39,9 @@ type MySQLRR struct {
 var RRMySQL *RR_MySQL
 var RC_MySQLConf *config.MySQLConf
 
+// Guards RRMySQL and RC_MySQLConf, which are replaced on reload
+var mysqlLock sync.RWMutex
+
 //todo: "InitMySQL(config.RC.MySQLConf)" need to be refact. use RC in logic func is not so good!
 
 //func init() {
@@ -44,7 +49,7 @@ var RC_MySQLConf *config.MySQLConf
 //	if config.RC != nil {
 //		if config.RC.MySQLEnabled {
 //			RC_MySQLConf = config.RC.MySQLConf
-//			InitMySQL(RC_MySQLConf)
+//			InitMySQL(mySQLConf())
 //		}
 //	}else {
 //		panic("config.RC is nil")
@@ -56,7 +61,9 @@ func InitMySQL(mcf *config.MySQLConf) bool {
 		db, err := sql.Open("mysql", mcf.MySQLUser+":"+mcf.MySQLPass+
 			"@tcp("+mcf.MySQLHost+":"+strconv.Itoa(int(mcf.MySQLPort))+")/"+mcf.MySQLDB)
 		if err == nil {
+			mysqlLock.Lock()
 			RRMySQL = &RR_MySQL{DB: db}
+			mysqlLock.Unlock()
 			return true
 		} else {
 			utils.QueryLogger.Error("Connect MySQL faile with conf: %v, error: %v", mcf, err.Error())
@@ -65,9 +72,42 @@ func InitMySQL(mcf *config.MySQLConf) bool {
 	return false
 }
 
+// Use mcf for the connections from now on and connect to MySQL with it
+func SetMySQLConf(mcf *config.MySQLConf) bool {
+	mysqlLock.Lock()
+	RC_MySQLConf = mcf
+	mysqlLock.Unlock()
+	return InitMySQL(mcf)
+}
+
+func mySQLConf() *config.MySQLConf {
+	mysqlLock.RLock()
+	defer mysqlLock.RUnlock()
+	return RC_MySQLConf
+}
+
+// The current connection of MySQL, nil if it is not initialized
+func mySQL() *RR_MySQL {
+	mysqlLock.RLock()
+	defer mysqlLock.RUnlock()
+	return RRMySQL
+}
+
+// Check the connection of RRMySQL
+func PingMySQL() *MyError.MyError {
+	db := mySQL()
+	if db == nil || db.DB == nil {
+		return MyError.NewError(MyError.ERROR_UNKNOWN, "MySQL is not initialized")
+	}
+	if e := db.DB.Ping(); e != nil {
+		return MyError.NewError(MyError.ERROR_UNKNOWN, "Ping MySQL error: "+e.Error())
+	}
+	return nil
+}
+
 func (D *RR_MySQL) GetDomainIDFromMySQL(d string) (int, *MyError.MyError) {
 	if e := D.DB.Ping(); e != nil {
-		if ok := InitMySQL(RC_MySQLConf); ok != true {
+		if ok := InitMySQL(mySQLConf()); ok != true {
 			return 0, MyError.NewError(MyError.ERROR_UNKNOWN, "Connect MySQL Error")
 		}
 	}
@@ -89,7 +129,7 @@ func (D *RR_MySQL) GetDomainIDFromMySQL(d string) (int, *MyError.MyError) {
 
 func (D *RR_MySQL) GetRegionWithIPFromMySQL(ip uint32) (*MySQLRegion, *MyError.MyError) {
 	if e := D.DB.Ping(); e != nil {
-		if ok := InitMySQL(RC_MySQLConf); ok != true {
+		if ok := InitMySQL(mySQLConf()); ok != true {
 			return nil, MyError.NewError(MyError.ERROR_UNKNOWN, "Connect MySQL Error")
 		}
 	}
@@ -120,9 +160,35 @@ func (D *RR_MySQL) GetRegionWithIPFromMySQL(ip uint32) (*MySQLRegion, *MyError.M
 	return nil, MyError.NewError(MyError.ERROR_UNKNOWN, "Unknown error!")
 }
 
+// All ranges of RegionTable, to build the region database
+func (D *RR_MySQL) GetRegionRangesFromMySQL() ([]storage.RegionRange, *MyError.MyError) {
+	if e := D.DB.Ping(); e != nil {
+		if ok := InitMySQL(mySQLConf()); ok != true {
+			return nil, MyError.NewError(MyError.ERROR_UNKNOWN, "Connect MySQL Error")
+		}
+	}
+	rows, e := D.DB.Query("Select idRegion, StartIP, EndIP From " + RegionTable)
+	if e != nil {
+		return nil, MyError.NewError(MyError.ERROR_UNKNOWN, e.Error())
+	}
+	defer rows.Close()
+	var ranges []storage.RegionRange
+	for rows.Next() {
+		var r storage.RegionRange
+		if e := rows.Scan(&r.ID, &r.Start, &r.End); e != nil {
+			return nil, MyError.NewError(MyError.ERROR_UNKNOWN, e.Error())
+		}
+		ranges = append(ranges, r)
+	}
+	if e := rows.Err(); e != nil {
+		return nil, MyError.NewError(MyError.ERROR_UNKNOWN, e.Error())
+	}
+	return ranges, nil
+}
+
 func (D *RR_MySQL) GetRRFromMySQL(domainId, regionId uint32) (*MySQLRR, *MyError.MyError) {
 	if e := D.DB.Ping(); e != nil {
-		if ok := InitMySQL(RC_MySQLConf); ok != true {
+		if ok := InitMySQL(mySQLConf()); ok != true {
 			return nil, MyError.NewError(MyError.ERROR_UNKNOWN, "Connect MySQL Error")
 		}
 	}
@@ -172,6 +238,7 @@ func (D *RR_MySQL) GetRRFromMySQL(domainId, regionId uint32) (*MySQLRR, *MyError
 					RR: &RRNew{
 						RrType: w,
 						Class:  x,
+						Ttl:    v,
 						Target: zz,
 					},
 				}
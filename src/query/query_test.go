@@ -24,8 +24,8 @@ var ttlmap = map[string]uint32{
 
 func TestMain(m *testing.M) {
 	config.ParseConf("/Users/chunsheng/GooleDrive/Work/github/16.httpDispacher/conf/httpdispacher.toml")
-	if config.RC.MySQLEnabled {
-		RC_MySQLConf = config.RC.MySQLConf
+	if config.GetRC().MySQLEnabled {
+		RC_MySQLConf = config.GetRC().MySQLConf
 		InitMySQL(RC_MySQLConf)
 	}
 	utils.InitLogger()
@@ -267,7 +267,7 @@ func TestQuerySOA(t *testing.T) {
 }
 
 func TestInitMySQL(t *testing.T) {
-	if config.RC.MySQLEnabled {
+	if config.GetRC().MySQLEnabled {
 		db := InitMySQL(RC_MySQLConf)
 		if db != false {
 			t.Log("InitMySQL OK")
@@ -288,7 +288,7 @@ func TestGetDomainIDFromMySQL(t *testing.T) {
 		"ww2.sinaimg.cn",
 	}
 
-	if config.RC.MySQLEnabled {
+	if config.GetRC().MySQLEnabled {
 		for _, d := range d_a {
 
 			t.Log(d)
@@ -306,7 +306,7 @@ func TestGetDomainIDFromMySQL(t *testing.T) {
 }
 
 func TestGetRegionWithIPFromMySQL(t *testing.T) {
-	if config.RC.MySQLEnabled {
+	if config.GetRC().MySQLEnabled {
 		// d_a := []string{"www.sina.com.cn", "www.baidu.com", "www.a.shifen.com", "api.weibo.cn", "weibo.cn", "sinaedge.com"}
 		ipuint32 := uint32(1790519448)
 		id, e := RRMySQL.GetRegionWithIPFromMySQL(ipuint32)
@@ -319,7 +319,7 @@ func TestGetRegionWithIPFromMySQL(t *testing.T) {
 }
 
 func TestGetRRFromMySQL(t *testing.T) {
-	if config.RC.MySQLEnabled {
+	if config.GetRC().MySQLEnabled {
 		t.Log("Test..")
 		d_a := []uint32{1, 2, 6, 7, 9}
 		r_a := []uint32{0, 1, 2, 6, 7, 8}
@@ -450,3 +450,20 @@ func TestGetRRFromMySQL(t *testing.T) {
 //		}
 //	}
 //}
+
+func TestPackEdns0SubnetOPT6(t *testing.T) {
+	o := PackEdns0SubnetOPT("240e:1234:5678::1", DEFAULT_SOURCEMASK6, DEFAULT_SOURCESCOPE)
+	t.Log(o)
+	subnet := o.Option[0].(*dns.EDNS0_SUBNET)
+	if subnet.Family != 2 || subnet.SourceNetmask != DEFAULT_SOURCEMASK6 {
+		t.Fail()
+	}
+	if subnet.Address.String() != "240e:1234:5678::" {
+		t.Log(subnet.Address)
+		t.Fail()
+	}
+	o = PackEdns0SubnetOPT("124.207.129.171", DEFAULT_SOURCEMASK, DEFAULT_SOURCESCOPE)
+	if o.Option[0].(*dns.EDNS0_SUBNET).Family != 1 {
+		t.Fail()
+	}
+}
@@ -0,0 +1,105 @@
+package query
+
+import (
+	"utils"
+)
+
+// Radix128 is a binary radix tree for IPv6 prefixes, it has the same methods
+// as bitradix.Radix32 which only handles 32 bit keys.
+type Radix128 struct {
+	branch [2]*Radix128
+	parent *Radix128
+	key    utils.Uint128
+	bits   int
+	Value  interface{}
+}
+
+func NewRadix128() *Radix128 {
+	return &Radix128{}
+}
+
+func (r *Radix128) Key() utils.Uint128 {
+	return r.key
+}
+
+func (r *Radix128) Bits() int {
+	return r.bits
+}
+
+// Leaf returns true if a value is stored in this node
+func (r *Radix128) Leaf() bool {
+	return r.Value != nil
+}
+
+// Insert v for the prefix n/bits, an existing value is replaced
+func (r *Radix128) Insert(n utils.Uint128, bits int, v interface{}) *Radix128 {
+	x := r
+	for i := 0; i < bits; i++ {
+		b := n.Bit(i)
+		if x.branch[b] == nil {
+			x.branch[b] = &Radix128{
+				parent: x,
+				key:    n.Mask(i + 1),
+				bits:   i + 1,
+			}
+		}
+		x = x.branch[b]
+	}
+	x.Value = v
+	return x
+}
+
+// Find the longest prefix of n/bits that has a value
+func (r *Radix128) Find(n utils.Uint128, bits int) *Radix128 {
+	var found *Radix128
+	x := r
+	for i := 0; x != nil; i++ {
+		if x.Value != nil {
+			found = x
+		}
+		if i >= bits {
+			break
+		}
+		x = x.branch[n.Bit(i)]
+	}
+	return found
+}
+
+// Remove the value of exactly n/bits and prune the empty branch
+func (r *Radix128) Remove(n utils.Uint128, bits int) *Radix128 {
+	x := r
+	for i := 0; i < bits && x != nil; i++ {
+		x = x.branch[n.Bit(i)]
+	}
+	if x == nil || x.Value == nil {
+		return nil
+	}
+	removed := &Radix128{key: x.key, bits: x.bits, Value: x.Value}
+	x.Value = nil
+	for x.parent != nil && x.Value == nil && x.branch[0] == nil && x.branch[1] == nil {
+		p := x.parent
+		if p.branch[0] == x {
+			p.branch[0] = nil
+		} else {
+			p.branch[1] = nil
+		}
+		x = p
+	}
+	return removed
+}
+
+// Do calls f for every node that has a value, i is the depth of the node
+func (r *Radix128) Do(f func(*Radix128, int)) {
+	r.do(f, 0)
+}
+
+func (r *Radix128) do(f func(*Radix128, int), i int) {
+	if r.Value != nil {
+		f(r, i)
+	}
+	for _, b := range r.branch {
+		if b != nil {
+			b.do(f, i+1)
+		}
+	}
+}
@@ -0,0 +1,246 @@
+package query
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+
+	"config"
+	"utils"
+)
+
+// Refreshes of the cached regions before they expire. One goroutine waits
+// for the earliest refresh in a heap, refreshes of the same domain, type and
+// client network are merged and at most concurrency of them run at the
+// same time
+
+const (
+	REFRESH_AHEAD                = 5 * time.Second // refresh before the ttl runs out
+	DEFAULT_REFRESH_CONCURRENCY  = 16
+	DEFAULT_REFRESH_MIN_INTERVAL = 10 * time.Second
+)
+
+type RefreshKey struct {
+	Domain  string
+	Qtype   uint16
+	Network string // Region.Network
+}
+
+type refreshTask struct {
+	key   RefreshKey
+	due   time.Time
+	f     func()
+	index int // in refreshHeap
+}
+
+type refreshHeap []*refreshTask
+
+func (h refreshHeap) Len() int           { return len(h) }
+func (h refreshHeap) Less(i, j int) bool { return h[i].due.Before(h[j].due) }
+func (h refreshHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index, h[j].index = i, j
+}
+
+func (h *refreshHeap) Push(x interface{}) {
+	t := x.(*refreshTask)
+	t.index = len(*h)
+	*h = append(*h, t)
+}
+
+func (h *refreshHeap) Pop() interface{} {
+	old := *h
+	t := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	t.index = -1
+	return t
+}
+
+type RefreshScheduler struct {
+	sync.Mutex
+	tasks       map[RefreshKey]*refreshTask
+	queue       refreshHeap
+	running     int
+	concurrency int
+	minInterval time.Duration
+	wake        chan struct{}
+	started     bool
+	stopped     bool
+}
+
+// Refreshes of the cached regions, see AddRefresh
+var Refresher = NewRefreshScheduler(DEFAULT_REFRESH_CONCURRENCY, DEFAULT_REFRESH_MIN_INTERVAL)
+
+// Scheduler running at most concurrency refreshes at the same time, a
+// refresh is not scheduled sooner than minInterval
+func NewRefreshScheduler(concurrency int, minInterval time.Duration) *RefreshScheduler {
+	s := &RefreshScheduler{tasks: make(map[RefreshKey]*refreshTask), wake: make(chan struct{}, 1)}
+	s.SetLimits(concurrency, minInterval)
+	return s
+}
+
+// Change the limits, values <= 0 are the defaults
+func (s *RefreshScheduler) SetLimits(concurrency int, minInterval time.Duration) {
+	if concurrency <= 0 {
+		concurrency = DEFAULT_REFRESH_CONCURRENCY
+	}
+	if minInterval <= 0 {
+		minInterval = DEFAULT_REFRESH_MIN_INTERVAL
+	}
+	s.Lock()
+	s.concurrency, s.minInterval = concurrency, minInterval
+	s.Unlock()
+	s.signal()
+}
+
+// Call f REFRESH_AHEAD before ttl seconds run out, but not sooner than the
+// minimum interval. A pending refresh of the same key is replaced
+func (s *RefreshScheduler) Schedule(key RefreshKey, ttl uint32, f func()) {
+	s.Lock()
+	defer s.Unlock()
+	if s.stopped {
+		return
+	}
+	d := time.Duration(ttl)*time.Second - REFRESH_AHEAD
+	if d < s.minInterval {
+		d = s.minInterval
+	}
+	due := time.Now().Add(d)
+	if t, ok := s.tasks[key]; ok {
+		t.due, t.f = due, f
+		heap.Fix(&s.queue, t.index)
+	} else {
+		t = &refreshTask{key: key, due: due, f: f}
+		heap.Push(&s.queue, t)
+		s.tasks[key] = t
+	}
+	if !s.started {
+		s.started = true
+		go s.run()
+	}
+	s.signal()
+}
+
+// Remove the pending refresh of key
+func (s *RefreshScheduler) Cancel(key RefreshKey) bool {
+	s.Lock()
+	defer s.Unlock()
+	t, ok := s.tasks[key]
+	if ok {
+		s.remove(t)
+	}
+	return ok
+}
+
+// Remove the pending refreshes of domain d, returns the number of them
+func (s *RefreshScheduler) CancelDomain(d string) int {
+	s.Lock()
+	defer s.Unlock()
+	n := 0
+	for k, t := range s.tasks {
+		if k.Domain == d {
+			s.remove(t)
+			n++
+		}
+	}
+	return n
+}
+
+func (s *RefreshScheduler) remove(t *refreshTask) {
+	heap.Remove(&s.queue, t.index)
+	delete(s.tasks, t.key)
+}
+
+// Number of pending refreshes
+func (s *RefreshScheduler) Len() int {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.tasks)
+}
+
+// Number of refreshes being run
+func (s *RefreshScheduler) Running() int {
+	s.Lock()
+	defer s.Unlock()
+	return s.running
+}
+
+// Drop the pending refreshes, returns the number of them. Running ones are
+// not interrupted and no refresh can be scheduled after it
+func (s *RefreshScheduler) Stop() int {
+	s.Lock()
+	defer s.Unlock()
+	s.stopped = true
+	n := len(s.tasks)
+	s.tasks = make(map[RefreshKey]*refreshTask)
+	s.queue = nil
+	s.signal()
+	return n
+}
+
+func (s *RefreshScheduler) signal() {
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+}
+
+func (s *RefreshScheduler) run() {
+	timer := time.NewTimer(time.Hour)
+	for {
+		wait := time.Hour
+		s.Lock()
+		if s.stopped {
+			s.Unlock()
+			timer.Stop()
+			return
+		}
+		now := time.Now()
+		for len(s.queue) > 0 && s.running < s.concurrency {
+			t := s.queue[0]
+			if t.due.After(now) {
+				wait = t.due.Sub(now)
+				break
+			}
+			s.remove(t)
+			s.running++
+			go s.do(t)
+		}
+		s.Unlock()
+
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(wait)
+		select {
+		case <-timer.C:
+		case <-s.wake:
+		}
+	}
+}
+
+func (s *RefreshScheduler) do(t *refreshTask) {
+	defer func() {
+		if e := recover(); e != nil {
+			utils.ServerLogger.Error("refresh %v panic: %v", t.key, e)
+		}
+		s.Lock()
+		s.running--
+		s.Unlock()
+		s.signal()
+	}()
+	t.f()
+}
+
+// Apply [refresh] of the configuration, nil is the defaults
+func InitRefresher(rc *config.RefreshConf) {
+	if rc == nil {
+		Refresher.SetLimits(0, 0)
+		return
+	}
+	Refresher.SetLimits(rc.Concurrency, time.Duration(rc.MinInterval)*time.Second)
+}
@@ -0,0 +1,61 @@
+package query
+
+import (
+	"sync"
+
+	"MyError"
+	"storage"
+	"utils"
+)
+
+// Region database of region_db, it is used instead of RegionTable of MySQL
+var regionDB = struct {
+	sync.RWMutex
+	db *storage.RegionDB
+}{}
+
+// Map the region database path in place of the current one, which is
+// unmapped. Empty path closes it
+func OpenRegionDB(path string) *MyError.MyError {
+	var db *storage.RegionDB
+	if path != "" {
+		var e error
+		if db, e = storage.OpenRegionDB(path); e != nil {
+			return MyError.Wrap(MyError.ERROR_NOTVALID, "open region database "+path+" failed", e)
+		}
+		utils.ServerLogger.Info("region database %s built at %s is loaded, %d ranges", path, db.Built().String(), db.Len())
+	}
+	regionDB.Lock()
+	old := regionDB.db
+	regionDB.db = db
+	regionDB.Unlock()
+	if old != nil {
+		old.Close()
+	}
+	return nil
+}
+
+// Number of ranges of the region database, -1 if it is not loaded
+func RegionDBLen() int {
+	regionDB.RLock()
+	defer regionDB.RUnlock()
+	if regionDB.db == nil {
+		return -1
+	}
+	return regionDB.db.Len()
+}
+
+// Region of ip from the region database, loaded is false if there is no
+// database. ERROR_NOTFOUND if no range has ip, like RegionTable
+func GetRegionWithIPFromRegionDB(ip uint32) (region *MySQLRegion, loaded bool, e *MyError.MyError) {
+	regionDB.RLock()
+	defer regionDB.RUnlock()
+	if regionDB.db == nil {
+		return nil, false, nil
+	}
+	id, start, end, ok := regionDB.db.Lookup(ip)
+	if !ok {
+		return nil, true, MyError.NewError(MyError.ERROR_NOTFOUND, "Not found Region in region database for IP: "+utils.Int32ToIP4(ip).String())
+	}
+	return &MySQLRegion{IdRegion: id, Region: &RegionNew{StarIP: start, EndIP: end}}, true, nil
+}
@@ -0,0 +1,167 @@
+package query
+
+import (
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/petar/GoLLRB/llrb"
+
+	"MyError"
+	"storage"
+	"utils"
+)
+
+// Snapshot of DomainSOACache and DomainRRCache with the regions
+func BuildSnapshot() *storage.Snapshot {
+	s := &storage.Snapshot{Time: time.Now()}
+	if !CacheInitialized() {
+		return s
+	}
+	DomainSOACache.RWMutex.RLock()
+	DomainSOACache.LLRB.AscendGreaterOrEqual(&DomainSOANode{}, func(i llrb.Item) bool {
+		if x, ok := i.(*DomainSOANode); ok && x.SOA != nil {
+			if !storage.PackableRR(x.SOA) || !storage.PackableRR(nsRR(x.NS)...) {
+				utils.ServerLogger.Warning("skip SOA %s of the snapshot, the records are not valid", x.SOAKey)
+				return true
+			}
+			s.SOA = append(s.SOA, &storage.SOAEntry{Key: x.SOAKey, SOA: x.SOA, NS: x.NS})
+		}
+		return true
+	})
+	DomainSOACache.RWMutex.RUnlock()
+
+	for _, dn := range cachedDomainNodes() {
+		d := &storage.DomainEntry{Name: dn.DomainName, SOAKey: dn.SOAKey, TTL: dn.TTL}
+		for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+			tree := dn.GetRegionTreeWithType(qtype)
+			if tree == nil {
+				continue
+			}
+			for _, r := range tree.Regions() {
+				if !storage.PackableRR(r.RR...) {
+					utils.ServerLogger.Warning("skip region %s of %s of the snapshot, the records are not valid", r.Network(), dn.DomainName)
+					continue
+				}
+				d.Regions = append(d.Regions, &storage.RegionEntry{
+					Qtype:      qtype,
+					Family:     r.Family,
+					Addr:       r.NetworkAddr,
+					Addr6:      r.NetworkAddr6,
+					Mask:       r.NetworkMask,
+					TTL:        r.TTL,
+					UpdateTime: r.UpdateTime,
+					Source:     r.Source,
+					RR:         r.RR,
+				})
+			}
+		}
+		s.Domains = append(s.Domains, d)
+	}
+	return s
+}
+
+// Load the entries of s into the cache, regions whose ttl has run out are
+// discarded, so are SOA records and domains whose ttl ran out since the
+// snapshot was taken (0 ttl of a domain does not run out). Entries already
+// in the cache are kept. Returns the number of domains and regions loaded
+func RestoreSnapshot(s *storage.Snapshot) (int, int) {
+	now := time.Now()
+	alive := func(ttl uint32) bool {
+		return s.Time.Add(time.Duration(ttl) * time.Second).After(now)
+	}
+	for _, x := range s.SOA {
+		if !alive(x.SOA.Hdr.Ttl) {
+			continue
+		}
+		if _, e := DomainSOACache.GetDomainSOANodeFromCacheWithDomainName(x.Key); e == nil {
+			continue
+		}
+		DomainSOACache.StoreDomainSOANodeToCache(&DomainSOANode{SOAKey: x.Key, SOA: x.SOA, NS: x.NS})
+	}
+
+	domains, regions := 0, 0
+	for _, d := range s.Domains {
+		if d.TTL > 0 && !alive(d.TTL) {
+			continue
+		}
+		if _, e := DomainRRCache.GetDomainNodeFromCacheWithName(d.Name); e == nil {
+			continue
+		}
+		dn, e := NewDomainNode(d.Name, d.SOAKey, d.TTL)
+		if e != nil {
+			utils.ServerLogger.Warning("restore domain %s of the snapshot error: %s", d.Name, e.Error())
+			continue
+		}
+		for _, x := range d.Regions {
+			if x.ExpiredAt(now) || len(x.RR) == 0 {
+				continue
+			}
+			r := &Region{
+				Family:       x.Family,
+				NetworkAddr:  x.Addr,
+				NetworkAddr6: x.Addr6,
+				NetworkMask:  x.Mask,
+				RR:           x.RR,
+				RrType:       x.RR[0].Header().Rrtype,
+				TTL:          x.TTL,
+				UpdateTime:   x.UpdateTime,
+				Source:       x.Source,
+				created:      x.UpdateTime.UnixNano(),
+			}
+			tree := dn.GetRegionTreeWithType(x.Qtype)
+			tree.AddRegionToCache(r)
+			addRestoredRefresh(dn.DomainName, x.Qtype, r, tree)
+			regions++
+		}
+		DomainRRCache.StoreDomainNodeToCache(dn)
+		domains++
+	}
+	return domains, regions
+}
+
+// Refresh a restored region before its remaining ttl runs out, like the
+// regions of the backends, with the network address as the client. Without
+// it the restored regions expire and miss around the same time
+func addRestoredRefresh(d string, qtype uint16, r *Region, tree *RegionTree) {
+	srcIP := utils.Int32ToIP4(r.NetworkAddr).String()
+	if r.Family == FAMILY_IPV6 {
+		srcIP = utils.Uint128ToIP6(r.NetworkAddr6).String()
+	}
+	if r.Source == REGION_SOURCE_MYSQL {
+		AddRefresh(d, srcIP, qtype, r, func() { GetAFromMySQLBackend(d, srcIP, tree) })
+		return
+	}
+	AddRefresh(d, srcIP, qtype, r, func() { GetRRFromDNSBackend(d, srcIP, qtype) })
+}
+
+// Write the cache to the snapshot file path
+func SaveCacheSnapshot(path string) *MyError.MyError {
+	start := time.Now()
+	s := BuildSnapshot()
+	if e := storage.SaveSnapshot(path, s); e != nil {
+		return MyError.Wrap(MyError.ERROR_UNKNOWN, "save cache snapshot "+path+" failed", e)
+	}
+	utils.ServerLogger.Info("cache snapshot %s saved, %d SOA records and %d domains in %s",
+		path, len(s.SOA), len(s.Domains), time.Since(start).String())
+	return nil
+}
+
+// Load the snapshot file path into the cache, see RestoreSnapshot
+func LoadCacheSnapshot(path string) *MyError.MyError {
+	s, e := storage.LoadSnapshot(path)
+	if e != nil {
+		return MyError.Wrap(MyError.ERROR_NOTVALID, "load cache snapshot "+path+" failed", e)
+	}
+	domains, regions := RestoreSnapshot(s)
+	utils.ServerLogger.Info("cache snapshot %s of %s loaded, %d domains and %d regions are alive",
+		path, s.Time.String(), domains, regions)
+	return nil
+}
+
+func nsRR(ns []*dns.NS) []dns.RR {
+	rr := make([]dns.RR, len(ns))
+	for i, x := range ns {
+		rr[i] = x
+	}
+	return rr
+}
@@ -1,12 +1,12 @@
 package query
 
 import (
+	"math"
 	"net"
 	"reflect"
 	"strconv"
 	"time"
 
-	"github.com/chunshengster/httpDispacher/src/query"
 	"github.com/miekg/dns"
 
 	"MyError"
@@ -58,27 +58,109 @@ func GetSOARecord(d string) (*DomainSOANode, *MyError.MyError) {
 		return soa, nil
 	}
 	// QuerySOA fail
+	if e != nil {
+		errno := e.ErrorNo
+		if errno == MyError.ERROR_NORESULT {
+			// no SOA record, the domain does not exist
+			errno = MyError.ERROR_NOTFOUND
+		}
+		return nil, MyError.Wrap(errno, "GetSOARecord failed: "+d, e)
+	}
 	return nil, MyError.NewError(MyError.ERROR_UNKNOWN, "Finally GetSOARecord failed")
 }
 
 func GetARecord(d string, srcIP string) (bool, []dns.RR, *MyError.MyError) {
-	var Regiontree *RegionTree
+	return GetRecord(d, srcIP, dns.TypeA)
+}
+
+func GetAAAARecord(d string, srcIP string) (bool, []dns.RR, *MyError.MyError) {
+	return GetRecord(d, srcIP, dns.TypeAAAA)
+}
+
+// Get A or AAAA (qtype) record of d for client srcIP, follow the CNAME chain
+// within CNAME_CHAIN_LENGTH. srcIP can be IPv4 or IPv6 address.
+func GetRecord(d string, srcIP string, qtype uint16) (bool, []dns.RR, *MyError.MyError) {
+	ok, RR, _, e := GetRecordWithTTL(d, srcIP, qtype)
+	return ok, RR, e
+}
+
+// Same as GetRecord, and return the remaining TTL of the result, which is
+// the smallest remaining TTL of the cached regions (or fresh answers) along
+// the CNAME chain
+func GetRecordWithTTL(d string, srcIP string, qtype uint16) (bool, []dns.RR, uint32, *MyError.MyError) {
+	ok, RR, ttl, _, e := GetRecordWithScope(d, srcIP, qtype)
+	return ok, RR, ttl, e
+}
+
+// Same as GetRecordWithTTL, and return the prefix length of client networks
+// the result is valid for (the ECS scope), which is the longest network of
+// the cached regions along the CNAME chain. Answers from the backends are
+// only known to be valid for srcIP, the host prefix length is used for them.
+func GetRecordWithScope(d string, srcIP string, qtype uint16) (bool, []dns.RR, uint32, int, *MyError.MyError) {
+	ok, x, e := GetRecordResult(d, srcIP, qtype)
+	if !ok {
+		return false, nil, 0, 0, e
+	}
+	return true, x.RR, x.TTL, x.Scope, nil
+}
+
+// Result of GetRecordResult
+type RecordResult struct {
+	CNAME []dns.RR // CNAME records followed from d to the answers
+	RR    []dns.RR
+	TTL   uint32 // see GetRecordWithTTL
+	Scope int    // see GetRecordWithScope
+	Stale bool   // expired regions are served because the backends failed
+}
+
+// TTL of the answers from expired regions, as RFC 8767 recommends
+const STALE_ANSWER_TTL = 30
+
+func GetRecordResult(d string, srcIP string, qtype uint16) (bool, *RecordResult, *MyError.MyError) {
 	var bigloopflag bool = false // big loop flag
 	var c = 0                    //big loop count
+	var ttl uint32 = math.MaxUint32
+	minTTL := func(t uint32) {
+		if t < ttl {
+			ttl = t
+		}
+	}
+	scope := 0
+	maxScope := func(s int) {
+		if s > scope {
+			scope = s
+		}
+	}
+	var cnames []dns.RR
+	var last *MyError.MyError // last backend error, returned when retries run out
+	stale := false
+	hostScope := DefaultRadixSearchMask
+	if utils.IsIPv6(utils.StrToIP(srcIP)) {
+		hostScope = DefaultRadixSearchMask6
+	}
 
 	//Can't loop for CNAME chain than bigger than CNAME_CHAIN_LENGTH
 	for dst := d; (bigloopflag == false) && (c < CNAME_CHAIN_LENGTH); c++ {
 		utils.ServerLogger.Debug("Trying GetARecord : %s srcIP: %s", dst, srcIP)
 
-		dn, RR, e := GetAFromCache(dst, srcIP)
-		utils.ServerLogger.Debug("GetAFromCache return: ", dn, RR, e)
+		dn, region, e := GetRegionFromCacheWithType(dst, srcIP, qtype)
+		var RR []dns.RR
+		if region != nil {
+			RR = region.RR
+		}
+		utils.ServerLogger.Debug("GetRegionFromCacheWithType return: ", dn, RR, e)
 		if e == nil {
 			// All is right and especilly RR is A record
-			return true, RR, nil
+			minTTL(region.RemainingTTL())
+			maxScope(region.Scope())
+			return true, &RecordResult{CNAME: cnames, RR: RR, TTL: ttl, Scope: scope, Stale: stale}, nil
 		} else {
 			//Return Cname record
 			if (e.ErrorNo == MyError.ERROR_CNAME) && (dn != nil) && (RR != nil) {
 				if dst_cname, ok := RR[0].(*dns.CNAME); ok {
+					minTTL(region.RemainingTTL())
+					maxScope(region.Scope())
+					cnames = append(cnames, dst_cname)
 					dst = dst_cname.Target
 					continue
 				} else {
@@ -90,64 +172,167 @@ func GetARecord(d string, srcIP string) (bool, []dns.RR, *MyError.MyError) {
 			}
 		}
 
+		var staleRegion *Region
+		fatal := false // the backend error is not retried
+		if e != nil && e.ErrorNo == MyError.ERROR_STALE && region != nil {
+			staleRegion = region
+		}
+
 		utils.ServerLogger.Info("Need to get dst from backend: ", dst, " srcIP: ", srcIP)
 		//fmt.Println(utils.GetDebugLine(), "++++++++++++++++++++++++++++++++++++++++++++++")
-		if config.IsLocalMysqlBackend(dst) {
+		if config.IsLocalMysqlBackend(dst) && qtype != dns.TypeA {
+			return false, nil, MyError.NewError(MyError.ERROR_TYPE,
+				"MySQL backend only supports A record, dst: "+dst)
+		} else if config.IsLocalMysqlBackend(dst) {
 			//fmt.Println(utils.GetDebugLine(), "**********************************************")
 			//need pass dn to GetAFromMySQLBackend, to fill th dn.RegionTree node
-			ok, RR, rtype, ee := GetAFromMySQLBackend(dst, srcIP, Regiontree)
+			mdn, ee := getOrStoreDomainNode(dst)
+			if ee != nil {
+				return false, nil, ee
+			}
+			ok, RR, rtype, ee := GetAFromMySQLBackend(dst, srcIP, mdn.DomainRegionTree)
 			//fmt.Println(utils.GetDebugLine(), " Debug: GetAFromMySQLBackend: return ", ok,
 			//	" RR: ", RR, " error: ", ee)
 			utils.ServerLogger.Debug("GetAFromMySQLBackend: return ", ok, RR, rtype, ee)
 			if !ok {
 				//fmt.Println(utils.GetDebugLine(), "Error: GetAFromMySQL error : ", ee)
 				utils.ServerLogger.Error("Error: GetAFromMySQL error : ", ee)
+				last = ee
 			} else if rtype == dns.TypeA {
 				//fmt.Println(utils.GetDebugLine(), "Info: Got A record, : ", RR)
 				utils.ServerLogger.Debug("Got A record: ", RR)
-				return true, RR, nil
+				minTTL(RR[0].Header().Ttl)
+				maxScope(hostScope)
+				return true, &RecordResult{CNAME: cnames, RR: RR, TTL: ttl, Scope: scope, Stale: stale}, nil
 			} else if rtype == dns.TypeCNAME {
 				//fmt.Println(utils.GetDebugLine(), "Info: Got CNAME record, ReGet dst : ", dst, RR)
 				utils.ServerLogger.Debug("Got CNAME record, ReGet dst: ", dst, RR)
+				minTTL(RR[0].Header().Ttl)
+				maxScope(hostScope)
+				cnames = append(cnames, RR[0])
 				dst = RR[0].(*dns.CNAME).Target
 				continue
 			}
 		} else {
 			//fmt.Println(utils.GetDebugLine(), "Info: Got dst: ", dst, " srcIP: ", srcIP, " soa.NS: ", soa.NS)
 
-			ok, rr_i, rtype, ee := GetAFromDNSBackend(dst, srcIP)
+			ok, rr_i, rtype, ee := GetRRFromDNSBackend(dst, srcIP, qtype)
 			//go func() {
 			//	AddAToCache()
 			//}()
-			if ok && rtype == dns.TypeA {
-				return true, rr_i, nil
+			if ok && rtype == qtype {
+				minTTL(rr_i[0].Header().Ttl)
+				maxScope(hostScope)
+				return true, &RecordResult{CNAME: cnames, RR: rr_i, TTL: ttl, Scope: scope, Stale: stale}, nil
 			} else if ok && rtype == dns.TypeCNAME {
+				minTTL(rr_i[0].Header().Ttl)
+				maxScope(hostScope)
+				cnames = append(cnames, rr_i[0])
 				dst = rr_i[0].(*dns.CNAME).Target
 				continue
-			} else if !ok && rr_i == nil && ee != nil && ee.ErrorNo == MyError.ERROR_NORESULT {
-				continue
+			} else if ee != nil {
+				// NXDOMAIN and NODATA are answers of the nameservers, not retried
+				last, fatal = ee, true
 			} else {
-				return false, nil, MyError.NewError(MyError.ERROR_UNKNOWN, "Unknown error")
+				last, fatal = MyError.NewError(MyError.ERROR_UNKNOWN, "Unknown error"), true
 			}
 		}
+
+		// an answer of the backend replaces the expired region even if it is
+		// NXDOMAIN or NODATA, only failures keep it
+		if staleRegion != nil && !backendFailed(last) {
+			removeRegion(dn, qtype, staleRegion)
+			staleRegion = nil
+		}
+		// the backend failed, serve the expired region within the serve-stale window
+		if staleRegion != nil {
+			utils.ServerLogger.Warning("serve stale region of %s for %s, backend error: %v", dst, srcIP, last)
+			stale = true
+			minTTL(STALE_ANSWER_TTL)
+			maxScope(staleRegion.Scope())
+			if staleRegion.RrType == dns.TypeCNAME {
+				cnames = append(cnames, staleRegion.RR[0])
+				dst = staleRegion.RR[0].(*dns.CNAME).Target
+				continue
+			}
+			return true, &RecordResult{CNAME: cnames, RR: staleRegion.RR, TTL: ttl, Scope: scope, Stale: stale}, nil
+		}
+		if fatal {
+			return false, nil, last
+		}
 	}
 	//fmt.Println(utils.GetDebugLine(), "GetARecord: ", Regiontree)
+	if last != nil {
+		return false, nil, MyError.Wrap(last.ErrorNo, "No result for "+d, last)
+	}
 	return false, nil, MyError.NewError(MyError.ERROR_UNKNOWN, "Unknown error")
 }
 
+// Whether e is a failure or timeout of the upstream nameservers or MySQL,
+// for which expired regions may be served (RFC 8767). NXDOMAIN, NODATA and
+// missing records of MySQL are answers
+func backendFailed(e *MyError.MyError) bool {
+	if e == nil {
+		return false
+	}
+	switch e.ErrorNo {
+	case MyError.ERROR_NOTFOUND, MyError.ERROR_NORESULT:
+		return false
+	}
+	return true
+}
+
+// Remove region r of the qtype tree of dn and its pending refresh
+func removeRegion(dn *DomainNode, qtype uint16, r *Region) {
+	if tree := dn.GetRegionTreeWithType(qtype); tree != nil {
+		tree.DelRegionFromCache(r)
+	}
+	Refresher.Cancel(RefreshKey{Domain: dn.DomainName, Qtype: qtype, Network: r.Network()})
+}
+
 func GetAFromCache(dst, srcIP string) (*DomainNode, []dns.RR, *MyError.MyError) {
+	return GetRRFromCache(dst, srcIP, dns.TypeA)
+}
+
+func GetRRFromCache(dst, srcIP string, qtype uint16) (*DomainNode, []dns.RR, *MyError.MyError) {
+	dn, r, e := GetRegionFromCacheWithType(dst, srcIP, qtype)
+	if r != nil {
+		return dn, r.RR, e
+	}
+	return dn, nil, e
+}
+
+// Search the cached region of dst for client srcIP in the region tree of
+// qtype, ERROR_CNAME is returned with the region if it holds CNAME record.
+// ERROR_STALE is returned for an expired region, with the region if it is
+// within the serve-stale window, otherwise it is removed from the cache
+func GetRegionFromCacheWithType(dst, srcIP string, qtype uint16) (*DomainNode, *Region, *MyError.MyError) {
+	dn, r, e := getRegionFromCacheWithType(dst, srcIP, qtype)
+	cacheLookups.Inc(dns.Type(qtype).String(), cacheLookupResult(dn, e))
+	return dn, r, e
+}
+
+func getRegionFromCacheWithType(dst, srcIP string, qtype uint16) (*DomainNode, *Region, *MyError.MyError) {
 	dn, e := DomainRRCache.GetDomainNodeFromCacheWithName(dst)
-	if e == nil && dn != nil && dn.DomainRegionTree != nil {
+	if e == nil && dn != nil && dn.GetRegionTreeWithType(qtype) != nil {
 		//Get DomainNode succ,
-		r, e := dn.DomainRegionTree.GetRegionFromCacheWithAddr(
-			utils.Ip4ToInt32(net.ParseIP(srcIP)), DefaultRadixSearchMask)
-		if e == nil && len(r.RR) > 0 {
-			if r.RrType == dns.TypeA {
+		r, e := dn.GetRegionTreeWithType(qtype).GetRegionFromCacheWithIP(net.ParseIP(srcIP))
+		if e == nil && len(r.RR) > 0 && r.Expired() {
+			// a miss, the region is returned to be served if the refetch fails
+			if r.StaleFor() > config.ServeStaleWindow() {
+				removeRegion(dn, qtype, r)
+				r = nil
+			}
+			return dn, r, MyError.NewError(MyError.ERROR_STALE,
+				"Region expired, dst :"+dst+" srcIP "+srcIP)
+		} else if e == nil && len(r.RR) > 0 {
+			r.Hit()
+			if r.RrType == qtype {
 				utils.ServerLogger.Debug("GetAFromCache: Goooot A ", dst, srcIP, r.RR)
-				return dn, r.RR, nil
+				return dn, r, nil
 			} else if r.RrType == dns.TypeCNAME {
 				utils.ServerLogger.Debug("GetAFromCache: Goooot CNAME ", dst, srcIP, r.RR)
-				return dn, r.RR, MyError.NewError(MyError.ERROR_CNAME,
+				return dn, r, MyError.NewError(MyError.ERROR_CNAME,
 					"Get CNAME From,Requery A for "+r.RR[0].(*dns.CNAME).Target)
 			}
 		}
@@ -155,7 +340,7 @@ func GetAFromCache(dst, srcIP string) (*DomainNode, []dns.RR, *MyError.MyError)
 		return dn, nil, MyError.NewError(MyError.ERROR_NOTFOUND,
 			"Not found R in cache, dst :"+dst+" srcIP "+srcIP)
 		// return
-	} else if e == nil && dn != nil && dn.DomainRegionTree == nil {
+	} else if e == nil && dn != nil && dn.GetRegionTreeWithType(qtype) == nil {
 		// Get domainNode in cache tree,but no RR in region tree,need query with NS
 		// if RegionTree is nil, init RegionTree First
 		ok, e := dn.InitRegionTree()
@@ -184,25 +369,65 @@ func GetAFromCache(dst, srcIP string) (*DomainNode, []dns.RR, *MyError.MyError)
 	return nil, nil, MyError.NewError(MyError.ERROR_UNKNOWN, "Unknown error!")
 }
 
+// DomainNode of dst in DomainRRCache, stored first if it is not cached.
+// Domains of the MySQL backend have no SOA record to create it
+func getOrStoreDomainNode(dst string) (*DomainNode, *MyError.MyError) {
+	if dn, e := DomainRRCache.GetDomainNodeFromCacheWithName(dst); e == nil {
+		return dn, nil
+	}
+	dn, e := NewDomainNode(dst, "", 0)
+	if e != nil {
+		return nil, e
+	}
+	// the trees of a node stored meanwhile are taken over
+	DomainRRCache.StoreDomainNodeToCache(dn)
+	return dn, nil
+}
+
 func GetAFromMySQLBackend(dst, srcIP string, regionTree *RegionTree) (bool, []dns.RR, uint16, *MyError.MyError) {
-	domainId, e := RRMySQL.GetDomainIDFromMySQL(dst)
+	db := mySQL()
+	if db == nil {
+		return false, nil, uint16(0), MyError.NewError(MyError.ERROR_UNKNOWN, "MySQL is not initialized")
+	}
+	start := time.Now()
+	domainId, e := db.GetDomainIDFromMySQL(dst)
+	observeMySQL("domain", start, e)
 	if e != nil {
 		//todo:
 		//fmt.Println(utils.GetDebugLine(), "Error, GetDomainIDFromMySQL:", e)
 		return false, nil, uint16(0), e
 	}
-	region, ee := RRMySQL.GetRegionWithIPFromMySQL(utils.Ip4ToInt32(utils.StrToIP(srcIP)))
-	if ee != nil {
-		//fmt.Println(utils.GetDebugLine(), "Error GetRegionWithIPFromMySQL:", ee)
-		return false, nil, uint16(0), MyError.NewError(ee.ErrorNo, "GetRegionWithIPFromMySQL return "+ee.Error())
+	// RegionTable only has IPv4 ranges, IPv6 clients use the default region
+	region := &MySQLRegion{
+		IdRegion: uint32(0),
+		Region:   &RegionNew{StarIP: DefaultRadixNetaddr, EndIP: DefaultRadixNetaddr},
+	}
+	if utils.IsIPv4(utils.StrToIP(srcIP)) {
+		ip := utils.Ip4ToInt32(utils.StrToIP(srcIP))
+		r, loaded, ee := GetRegionWithIPFromRegionDB(ip)
+		if loaded {
+			region = r
+		} else {
+			start = time.Now()
+			region, ee = db.GetRegionWithIPFromMySQL(ip)
+			observeMySQL("region", start, ee)
+		}
+		if ee != nil {
+			//fmt.Println(utils.GetDebugLine(), "Error GetRegionWithIPFromMySQL:", ee)
+			return false, nil, uint16(0), MyError.NewError(ee.ErrorNo, "GetRegionWithIPFromMySQL return "+ee.Error())
+		}
 	}
-	RR, eee := RRMySQL.GetRRFromMySQL(uint32(domainId), region.IdRegion)
+	start = time.Now()
+	RR, eee := db.GetRRFromMySQL(uint32(domainId), region.IdRegion)
+	observeMySQL("rr", start, eee)
 	if eee != nil && eee.ErrorNo == MyError.ERROR_NORESULT {
 		//fmt.Println(utils.GetDebugLine(), "Error GetRRFromMySQL with DomainID:", domainId,
 		//	"RegionID:", region.IdRegion, eee)
 		//fmt.Println(utils.GetDebugLine(), "Try to GetRRFromMySQL with Default Region")
 		utils.ServerLogger.Debug("Try to GetRRFromMySQL with Default Region")
-		RR, eee = RRMySQL.GetRRFromMySQL(uint32(domainId), uint32(0))
+		start = time.Now()
+		RR, eee = db.GetRRFromMySQL(uint32(domainId), uint32(0))
+		observeMySQL("rr", start, eee)
 		if eee != nil {
 			//fmt.Println(utils.GetDebugLine(), "Error GetRRFromMySQL with DomainID:", domainId,
 			//	"RegionID:", 0, eee)
@@ -250,26 +475,26 @@ func GetAFromMySQLBackend(dst, srcIP string, regionTree *RegionTree) (bool, []dn
 	}
 
 	if len(R) > 0 {
-		//Add timer for auto refrech the RegionCache
-		go func(dst, srcIP string, r dns.RR, regionTree *RegionTree) {
-			//fmt.Println(utils.GetDebugLine(), " Refresh record after ", r.Header().Ttl-5,
-			//	" Second, dst: ", dst, " srcIP: ", srcIP, "add timer ")
-			time.AfterFunc(time.Duration(r.Header().Ttl-5)*time.Second,
-				func() { GetAFromMySQLBackend(dst, srcIP, regionTree) })
-		}(dst, srcIP, R[0], regionTree)
-
 		go func(regionTree *RegionTree, R []dns.RR, srcIP string) {
 			//fmt.Println(utils.GetDebugLine(), "GetAFromMySQLBackend: ", e)
 
 			startIP, endIP := region.Region.StarIP, region.Region.EndIP
 			cidrmask := utils.GetCIDRMaskWithUint32Range(startIP, endIP)
+			if region.IdRegion == uint32(0) {
+				startIP, cidrmask = DefaultRadixNetaddr, DefaultRadixNetMask
+			}
 
 			//fmt.Println(utils.GetDebugLine(), " GetRegionWithIPFromMySQL with srcIP: ",
 			//	srcIP, " StartIP : ", startIP, "==", utils.Int32ToIP4(startIP).String(),
 			//	" EndIP: ", endIP, "==", utils.Int32ToIP4(endIP).String(), " cidrmask : ", cidrmask)
 			//				netaddr, mask := DefaultNetaddr, DefaultMask
 			r, _ := NewRegion(R, startIP, cidrmask)
+			if region.IdRegion != uint32(0) {
+				r.Source = REGION_SOURCE_MYSQL
+			}
 			regionTree.AddRegionToCache(r)
+			//Refresh the RegionCache before it expires
+			AddRefresh(dst, srcIP, dns.TypeA, r, func() { GetAFromMySQLBackend(dst, srcIP, regionTree) })
 			//fmt.Println(utils.GetDebugLine(), "GetAFromMySQLBackend: ", r)
 			//				fmt.Println(regionTree.GetRegionFromCacheWithAddr(startIP, cidrmask))
 		}(regionTree, R, srcIP)
@@ -281,16 +506,24 @@ func GetAFromMySQLBackend(dst, srcIP string, regionTree *RegionTree) (bool, []dn
 
 func GetAFromDNSBackend(
 	dst, srcIP string) (bool, []dns.RR, uint16, *MyError.MyError) {
+	return GetRRFromDNSBackend(dst, srcIP, dns.TypeA)
+}
+
+func GetRRFromDNSBackend(
+	dst, srcIP string, qtype uint16) (bool, []dns.RR, uint16, *MyError.MyError) {
 
 	var reE *MyError.MyError = nil
 	var rtype uint16
 	soa, e := GetSOARecord(dst)
 	utils.ServerLogger.Debug("GetSOARecord return: ", soa, " error: ", e)
-	if e != nil || len(soa.NS) <= 0 {
+	if e != nil {
 		//GetSOA failed , need log and return
 		utils.ServerLogger.Error("GetSOARecord error: %s", e.Error())
+		return false, nil, dns.TypeNone, MyError.Wrap(e.ErrorNo,
+			"GetARecord func GetSOARecord failed: "+dst, e)
+	} else if len(soa.NS) <= 0 {
 		return false, nil, dns.TypeNone, MyError.NewError(MyError.ERROR_UNKNOWN,
-			"GetARecord func GetSOARecord failed: "+dst)
+			"GetARecord func GetSOARecord has no NS: "+dst)
 	}
 
 	var ns_a []string
@@ -299,14 +532,14 @@ func GetAFromDNSBackend(
 		ns_a = append(ns_a, x.Ns)
 	}
 
-	rr, edns_h, edns, e := QueryA(dst, srcIP, ns_a, query.NS_SERVER_PORT)
+	rr, edns_h, edns, e := QueryRR(dst, srcIP, ns_a, NSServerPort, qtype)
 	//todo: ends_h ends need to be parsed and returned!
-	utils.QueryLogger.Info("QueryA(): dst:", dst, "srcIP:", srcIP, "ns_a:", ns_a, " returned rr:", rr, "edns_h:", edns_h,
+	utils.QueryLogger.Info("QueryRR(): qtype:", dns.TypeToString[qtype], " dst:", dst, "srcIP:", srcIP, "ns_a:", ns_a, " returned rr:", rr, "edns_h:", edns_h,
 		"edns:", edns, "e:", e)
 	if e == nil && rr != nil {
 		var rr_i []dns.RR
 		//todo:if you add both "A" and "CNAME" record to a domain name,this should be wrong!
-		if a, ok := ParseA(rr, dst); ok {
+		if a, ok := ParseA(rr, dst); ok && qtype == dns.TypeA {
 			//rr is A record
 			utils.ServerLogger.Debug("GetAFromDNSBackend : typeA record: ", a, " dns.TypeA: ", ok)
 			for _, i := range a {
@@ -315,6 +548,12 @@ func GetAFromDNSBackend(
 			//if A ,need parse edns client subnet
 			//			return true,rr_i,nil
 			rtype = dns.TypeA
+		} else if aaaa, ok := ParseAAAA(rr, dst); ok && qtype == dns.TypeAAAA {
+			utils.ServerLogger.Debug("GetRRFromDNSBackend : typeAAAA record: ", aaaa)
+			for _, i := range aaaa {
+				rr_i = append(rr_i, dns.RR(i))
+			}
+			rtype = dns.TypeAAAA
 		} else if b, ok := ParseCNAME(rr, dst); ok {
 			//rr is CNAME record
 			//fmt.Println(utils.GetDebugLine(), "GetAFromDNSBackend: typeCNAME record: ", b, " dns.TypeCNAME: ", ok)
@@ -337,14 +576,22 @@ func GetAFromDNSBackend(
 		}
 		utils.ServerLogger.Debug("Add A record to Region Cache: dst:", dst, "srcIP:", srcIP,
 			"rr_i:", rr_i, "ends_h", edns_h, "edns:", edns)
-		go AddAToRegionCache(dst, srcIP, rr_i, edns_h, edns)
+		go AddRRToRegionCache(dst, srcIP, qtype, rr_i, edns_h, edns)
 
 		return true, rr_i, rtype, reE
+	} else if e != nil {
+		return false, nil, dns.TypeNone, MyError.Wrap(e.ErrorNo, "QueryRR failed: "+dst, e)
 	}
 	return false, nil, dns.TypeNone, MyError.NewError(MyError.ERROR_UNKNOWN, utils.GetDebugLine()+"Unknown error")
 }
 
 func AddAToRegionCache(dst string, srcIP string, R []dns.RR, edns_h *dns.RR_Header, edns *dns.EDNS0_SUBNET) {
+	AddRRToRegionCache(dst, srcIP, dns.TypeA, R, edns_h, edns)
+}
+
+// Store R into the region tree of dst for qtype, the region is the client
+// subnet in edns (IPv4 or IPv6), or the default region without edns
+func AddRRToRegionCache(dst string, srcIP string, qtype uint16, R []dns.RR, edns_h *dns.RR_Header, edns *dns.EDNS0_SUBNET) {
 
 	var dn *DomainNode
 	var domainNodeExist bool = false
@@ -380,7 +627,7 @@ func AddAToRegionCache(dst string, srcIP string, R []dns.RR, edns_h *dns.RR_Head
 	} else {
 		//dn.InitRegionTree()
 		utils.ServerLogger.Debug("Got dn :", dn)
-		regiontree := dn.DomainRegionTree
+		regiontree := dn.GetRegionTreeWithType(qtype)
 
 		////todo: Need to be combined with the go func within GetAFromMySQLBackend
 		//var startIP, endIP uint32
@@ -402,12 +649,25 @@ func AddAToRegionCache(dst string, srcIP string, R []dns.RR, edns_h *dns.RR_Head
 		//fmt.Println(utils.GetDebugLine(), "Search client region info with srcIP: ",
 		//	srcIP, " StartIP : ", startIP, "==", utils.Int32ToIP4(startIP).String(),
 		//	" EndIP: ", endIP, "==", utils.Int32ToIP4(endIP).String(), " cidrmask : ", cidrmask)
-		if edns != nil {
+		var r *Region
+		if edns != nil && edns.Family == FAMILY_IPV6 {
+			ipnet, e := utils.ParseEdnsIPNet(edns.Address, edns.SourceScope, edns.Family)
+			if e != nil {
+				// not cached, a nil ipnet would be ::/0 and answer every client
+				utils.ServerLogger.Error("utils.ParseEdnsIPNet error:", edns)
+				return
+			}
+			netaddr, mask := utils.IpNetToUint128(ipnet)
+			utils.ServerLogger.Debug("Got Edns client subnet from ecs query, netaddr6 : ", netaddr, " mask : ", mask)
+			r, _ = NewRegion6(R, netaddr, mask)
+			regiontree.AddRegionToCache(r)
+		} else if edns != nil {
 			var ipnet *net.IPNet
 
 			ipnet, e := utils.ParseEdnsIPNet(edns.Address, edns.SourceScope, edns.Family)
 			if e != nil {
 				utils.ServerLogger.Error("utils.ParseEdnsIPNet error:", edns)
+				return
 			}
 			netaddr, mask := utils.IpNetToInt32(ipnet)
 			//fmt.Println(utils.GetDebugLine(), "Got Edns client subnet from ecs query, netaddr : ", netaddr,
@@ -423,7 +683,7 @@ func AddAToRegionCache(dst string, srcIP string, R []dns.RR, edns_h *dns.RR_Head
 			//	startIP = netaddr
 			//	cidrmask = mask
 			//}
-			r, _ := NewRegion(R, netaddr, mask)
+			r, _ = NewRegion(R, netaddr, mask)
 
 			// Parse edns client subnet
 			utils.ServerLogger.Debug("GetAFromDNSBackend: ", " edns_h: ", edns_h, " edns: ", edns)
@@ -434,29 +694,115 @@ func AddAToRegionCache(dst string, srcIP string, R []dns.RR, edns_h *dns.RR_Head
 			//todo: get StartIP/EndIP from iplookup module
 
 			//				netaddr, mask := DefaultNetaddr, DefaultMask
-			r, _ := NewRegion(R, DefaultRadixNetaddr, DefaultRadixNetMask)
+			r, _ = NewRegion(R, DefaultRadixNetaddr, DefaultRadixNetMask)
 			//todo: modify to go func,so you can cathe the result
 			regiontree.AddRegionToCache(r)
 			//fmt.Println(utils.GetDebugLine(), "GetAFromDNSBackend: AddRegionToCache: ", r)
 			//fmt.Println(regionTree.GetRegionFromCacheWithAddr(startIP, cidrmask))
 		}
-		//todo: modify to go func,so you can cathe the result
-		//Add timer for auto refrech the RegionCache
-		go func(dst, srcIP string, r dns.RR, regionTree *RegionTree) {
-			//fmt.Println(utils.GetDebugLine(), " Refresh record after ", r.Header().Ttl-5,
-			//	" Second, dst: ", dst, " srcIP: ", srcIP, " ns_a: ", ns_a, "add timer ")
-			time.AfterFunc((time.Duration(r.Header().Ttl-5))*time.Second,
-				func() {
-					GetAFromDNSBackend(dst, srcIP)
-					//todo:add timer for update region cache
-					utils.QueryLogger.Info("Need to refresh for domain:", dst, " srcIP: ", srcIP)
-				})
-		}(dst, srcIP, R[0], regiontree)
+		//Refresh the RegionCache before it expires
+		AddRefresh(dst, srcIP, qtype, r, func() {
+			utils.QueryLogger.Info("Need to refresh for domain:", dst, " srcIP: ", srcIP)
+			GetRRFromDNSBackend(dst, srcIP, qtype)
+		})
 	}
 
 }
 
+// Refresh region r of dst for client srcIP with f before its remaining ttl
+// runs out, the refresh is skipped if dst is no longer cached
+func AddRefresh(dst, srcIP string, qtype uint16, r *Region, f func()) {
+	if r == nil {
+		return
+	}
+	d := dns.Fqdn(dst)
+	Refresher.Schedule(RefreshKey{Domain: d, Qtype: qtype, Network: r.Network()}, r.RemainingTTL(), func() {
+		if _, e := DomainRRCache.GetDomainNodeFromCacheWithName(d); e != nil {
+			utils.QueryLogger.Info("Skip refresh of removed domain:", d, " srcIP: ", srcIP)
+			return
+		}
+		f()
+	})
+}
+
 //func temp()  {
 //
 
 //}
+
+// Remove the DomainNode of d and all of its regions from DomainRRCache
+func PurgeDomain(d string) *MyError.MyError {
+	dn, e := DomainRRCache.GetDomainNodeFromCacheWithName(d)
+	if e != nil {
+		return e
+	}
+	DomainRRCache.DelDomainNode(&dn.Domain)
+	n := Refresher.CancelDomain(dn.DomainName)
+	utils.ServerLogger.Info("Purge domain %s from DomainRRCache, %d refreshes are canceled", dn.DomainName, n)
+	return nil
+}
+
+// Remove the region of exactly ipnet from the region tree of d for qtype
+// (A or AAAA)
+func PurgeRegion(d string, ipnet *net.IPNet, qtype uint16) *MyError.MyError {
+	dn, e := DomainRRCache.GetDomainNodeFromCacheWithName(d)
+	if e != nil {
+		return e
+	}
+	r := &Region{Family: FAMILY_IPV4}
+	if ipnet.IP.To4() != nil {
+		r.NetworkAddr, r.NetworkMask = utils.IpNetToInt32(ipnet)
+	} else {
+		r.Family = FAMILY_IPV6
+		r.NetworkAddr6, r.NetworkMask = utils.IpNetToUint128(ipnet)
+	}
+	tree := dn.GetRegionTreeWithType(qtype)
+	if tree == nil {
+		return MyError.NewError(MyError.ERROR_NOTFOUND, "Not found region tree of "+dn.DomainName)
+	}
+	if _, e := tree.DelRegionFromCache(r); e != nil {
+		return e
+	}
+	Refresher.Cancel(RefreshKey{Domain: dn.DomainName, Qtype: qtype, Network: r.Network()})
+	utils.ServerLogger.Info("Purge region %s of domain %s", r.Network(), dn.DomainName)
+	return nil
+}
+
+// Query the backend of d for client srcIP again, the cached region is
+// replaced by the new answers
+func RefreshRecord(d, srcIP string, qtype uint16) (bool, []dns.RR, *MyError.MyError) {
+	dst := dns.Fqdn(d)
+	if config.IsLocalMysqlBackend(dst) {
+		if qtype != dns.TypeA {
+			return false, nil, MyError.NewError(MyError.ERROR_TYPE,
+				"MySQL backend only supports A record, dst: "+dst)
+		}
+		dn, e := DomainRRCache.GetDomainNodeFromCacheWithName(dst)
+		if e != nil {
+			return false, nil, e
+		}
+		ok, RR, _, e := GetAFromMySQLBackend(dst, srcIP, dn.DomainRegionTree)
+		return ok, RR, e
+	}
+	ok, RR, _, e := GetRRFromDNSBackend(dst, srcIP, qtype)
+	if ok && e != nil && e.ErrorNo == MyError.ERROR_NOTVALID {
+		// CNAME answers are cached as well
+		e = nil
+	}
+	return ok, RR, e
+}
+
+// Remove the DomainSOANode of d, d is a SOA key ("weibo.cn.") or a cached
+// domain whose SOA key is used
+func DropSOA(d string) *MyError.MyError {
+	key := dns.Fqdn(d)
+	if dn, e := DomainRRCache.GetDomainNodeFromCacheWithName(d); e == nil && dn.SOAKey != "" {
+		key = dn.SOAKey
+	}
+	if _, e := DomainSOACache.GetDomainSOANodeFromCacheWithDomainName(key); e != nil {
+		return e
+	}
+	DomainSOACache.DelDomainSOANode(&DomainSOANode{SOAKey: key})
+	utils.ServerLogger.Info("Drop SOA %s from DomainSOACache", key)
+	return nil
+}
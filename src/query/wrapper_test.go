@@ -1,8 +1,24 @@
 package query
 
 import (
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 	"time"
+
+	"github.com/miekg/dns"
+
+	"MyError"
+	"config"
+	"storage"
+	"utils"
 )
 
 func GetClientIP() string {
@@ -56,3 +72,380 @@ func BenchmarkGetARecord(b *testing.B) {
 	b.StopTimer()
 	b.ReportAllocs()
 }
+
+func TestRefreshScheduler(t *testing.T) {
+	s := NewRefreshScheduler(1, 20*time.Millisecond)
+	ran := make(chan string, 10)
+	a := RefreshKey{Domain: "a.com.", Qtype: 1, Network: "0.0.0.0/0"}
+	b := RefreshKey{Domain: "b.com.", Qtype: 1, Network: "1.2.3.0/24"}
+	// ttl below REFRESH_AHEAD waits for the min interval
+	s.Schedule(a, 1, func() { ran <- "old" })
+	s.Schedule(a, 0, func() { ran <- "a" })
+	s.Schedule(b, 0, func() { ran <- "b" })
+	if s.Len() != 2 || s.CancelDomain("b.com.") != 1 || s.Cancel(b) {
+		t.FailNow()
+	}
+	select {
+	case x := <-ran:
+		if x != "a" {
+			t.Fatal(x)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("not refreshed")
+	}
+	time.Sleep(50 * time.Millisecond)
+	if len(ran) != 0 || s.Len() != 0 {
+		t.Fail()
+	}
+
+	// at most one refresh runs at the same time
+	release := make(chan bool)
+	for _, n := range []string{"1.0.0.0/8", "2.0.0.0/8", "3.0.0.0/8"} {
+		s.Schedule(RefreshKey{Domain: "c.com.", Qtype: 1, Network: n}, 0, func() { <-release })
+	}
+	time.Sleep(100 * time.Millisecond)
+	if s.Running() != 1 || s.Len() != 2 {
+		t.Log(s.Running(), s.Len())
+		t.Fail()
+	}
+	close(release)
+	if n := s.Stop(); n > 2 {
+		t.Fail()
+	}
+	s.Schedule(a, 0, func() {})
+	if s.Len() != 0 {
+		t.Fail()
+	}
+}
+
+func TestSweepCache(t *testing.T) {
+	InitCache()
+	a := func(d string) []dns.RR {
+		return []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: d, Rrtype: dns.TypeA, Ttl: 600}, A: net.ParseIP("1.1.1.1")}}
+	}
+	cold, _ := NewDomainNode("cold.evict.com.", "evict.com.", 600)
+	for _, n := range []uint32{0x01020300, 0x01020400, 0x01020500} {
+		r, _ := NewRegion(a("cold.evict.com."), n, 24)
+		cold.DomainRegionTree.AddRegionToCache(r)
+	}
+	hot, _ := NewDomainNode("hot.evict.com.", "evict.com.", 600)
+	r, _ := NewRegion(a("hot.evict.com."), 0x01020300, 24)
+	hot.DomainRegionTree.AddRegionToCache(r)
+	for i := 0; i < 8; i++ {
+		r.Hit()
+	}
+	// a refreshed region keeps the hits
+	r, _ = NewRegion(a("hot.evict.com."), 0x01020300, 24)
+	hot.DomainRegionTree.AddRegionToCache(r)
+	mysql, _ := NewDomainNode("mysql.evict.com.", "evict.com.", 600)
+	r, _ = NewRegion(a("mysql.evict.com."), 0x01020300, 24)
+	r.Source = REGION_SOURCE_MYSQL
+	mysql.DomainRegionTree.AddRegionToCache(r)
+	for _, dn := range []*DomainNode{cold, hot, mysql} {
+		DomainRRCache.StoreDomainNodeToCache(dn)
+	}
+	if r.Size() <= REGION_BASE_SIZE {
+		t.Fail()
+	}
+
+	u := SweepCache(CacheBudget{ProtectHits: 2})
+	if u.Regions < 5 || u.Domains < 3 || u.EvictedRegions != 0 || u.Bytes <= 0 {
+		t.Log(u)
+		t.FailNow()
+	}
+	// hits are halved, 4 are left
+	u = SweepCache(CacheBudget{MaxEntries: 1, ProtectHits: 4})
+	if u.EvictedRegions < 3 || u.EvictedDomains < 1 {
+		t.Log(u)
+		t.Fail()
+	}
+	if _, e := DomainRRCache.GetDomainNodeFromCacheWithName("cold.evict.com."); e == nil {
+		t.Fail()
+	}
+	for _, d := range []string{"hot.evict.com.", "mysql.evict.com."} {
+		if _, r, e := GetRegionFromCacheWithType(d, "1.2.3.4", dns.TypeA); e != nil || r == nil {
+			t.Log(d, e)
+			t.Fail()
+		}
+	}
+}
+
+func TestRegionDB(t *testing.T) {
+	dir, e := ioutil.TempDir("", "regiondb")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, storage.MMFILE)
+	ip := utils.Ip4ToInt32(net.ParseIP("1.2.3.4"))
+	if e := storage.BuildRegionDB(path, []storage.RegionRange{{Start: ip &^ 0xff, End: ip | 0xff, ID: 7}}); e != nil {
+		t.Fatal(e)
+	}
+	if e := OpenRegionDB(path); e != nil {
+		t.Fatal(e)
+	}
+	defer OpenRegionDB("")
+	if RegionDBLen() != 1 {
+		t.FailNow()
+	}
+	r, loaded, ee := GetRegionWithIPFromRegionDB(ip)
+	if !loaded || ee != nil || r.IdRegion != 7 || r.Region.StarIP != ip&^0xff || r.Region.EndIP != ip|0xff {
+		t.Fatal(r, ee)
+	}
+	if _, loaded, ee := GetRegionWithIPFromRegionDB(ip + 0x100); !loaded || ee == nil || ee.ErrorNo != MyError.ERROR_NOTFOUND {
+		t.Fatal(ee)
+	}
+	OpenRegionDB("")
+	if _, loaded, _ := GetRegionWithIPFromRegionDB(ip); loaded || RegionDBLen() != -1 {
+		t.Fail()
+	}
+}
+
+func TestUpstreamFailed(t *testing.T) {
+	m := func(rcode int) *dns.Msg {
+		x := new(dns.Msg)
+		x.SetRcode(new(dns.Msg).SetQuestion("www.a.com.", dns.TypeA), rcode)
+		return x
+	}
+	for _, x := range []struct {
+		r      *dns.Msg
+		e      error
+		failed bool
+	}{
+		{m(dns.RcodeSuccess), nil, false},
+		{m(dns.RcodeNameError), nil, false},
+		{m(dns.RcodeServerFailure), nil, true},
+		{m(dns.RcodeRefused), nil, true},
+		{nil, errors.New("i/o timeout"), true},
+	} {
+		if upstreamFailed(x.r, x.e) != x.failed {
+			t.Log(x.r, x.e)
+			t.Fail()
+		}
+	}
+}
+
+func TestAddRRToRegionCacheBadECS(t *testing.T) {
+	InitCache()
+	dn, _ := NewDomainNode("www.ecs.com.", "ecs.com.", 600)
+	DomainRRCache.StoreDomainNodeToCache(dn)
+	aaaa := []dns.RR{&dns.AAAA{Hdr: dns.RR_Header{Name: "www.ecs.com.", Rrtype: dns.TypeAAAA, Ttl: 600}, AAAA: net.ParseIP("::1")}}
+	a := []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "www.ecs.com.", Rrtype: dns.TypeA, Ttl: 600}, A: net.ParseIP("1.1.1.1")}}
+	// the address is not valid, nothing is cached instead of a region for
+	// every client
+	AddRRToRegionCache("www.ecs.com.", "::1", dns.TypeAAAA, aaaa, nil, &dns.EDNS0_SUBNET{Family: FAMILY_IPV6, SourceScope: 48})
+	AddRRToRegionCache("www.ecs.com.", "1.2.3.4", dns.TypeA, a, nil, &dns.EDNS0_SUBNET{Family: 1, SourceScope: 24})
+	if n := len(dn.DomainRegionTreeAAAA.Regions()) + len(dn.DomainRegionTree.Regions()); n != 0 {
+		t.Log(n)
+		t.Fail()
+	}
+}
+
+func TestRegionLastUsed(t *testing.T) {
+	a := []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "www.lru.com.", Rrtype: dns.TypeA, Ttl: 600}, A: net.ParseIP("1.1.1.1")}}
+	tree := NewDomainRegionTree()
+	old, _ := NewRegion(a, 0x01020300, 24)
+	tree.AddRegionToCache(old)
+	created := old.lastUsed()
+	if created != old.UpdateTime.UnixNano() {
+		t.FailNow()
+	}
+	// a refresh is not a use
+	time.Sleep(time.Millisecond)
+	r, _ := NewRegion(a, 0x01020300, 24)
+	tree.AddRegionToCache(r)
+	if r.lastUsed() != created {
+		t.Log(r.lastUsed(), created)
+		t.Fail()
+	}
+	r.Hit()
+	r2, _ := NewRegion(a, 0x01020300, 24)
+	tree.AddRegionToCache(r2)
+	if r2.lastUsed() <= created || r2.lastUsed() != r.lastUsed() {
+		t.Log(r2.lastUsed(), created)
+		t.Fail()
+	}
+}
+
+// database/sql driver with the tables of MySQL for one domain, 1.2.3.0/24
+// is region 7
+type testMySQLDriver struct{}
+type testMySQLConn struct{}
+type testMySQLStmt struct{ query string }
+type testMySQLRows struct{ rows [][]driver.Value }
+
+func (testMySQLDriver) Open(string) (driver.Conn, error) { return testMySQLConn{}, nil }
+
+func (testMySQLConn) Prepare(q string) (driver.Stmt, error) { return &testMySQLStmt{query: q}, nil }
+func (testMySQLConn) Close() error                          { return nil }
+func (testMySQLConn) Begin() (driver.Tx, error)             { return nil, errors.New("not supported") }
+
+func (s *testMySQLStmt) Close() error  { return nil }
+func (s *testMySQLStmt) NumInput() int { return -1 }
+func (s *testMySQLStmt) Exec([]driver.Value) (driver.Result, error) {
+	return nil, errors.New("not supported")
+}
+
+func (s *testMySQLStmt) Query(args []driver.Value) (driver.Rows, error) {
+	r := &testMySQLRows{}
+	switch {
+	case strings.Contains(s.query, DomainTable):
+		if args[0] == "mysql.test.com." {
+			r.rows = [][]driver.Value{{int64(1)}}
+		}
+	case strings.Contains(s.query, RegionTable):
+		ip := args[0].(int64)
+		if start := int64(0x01020300); ip >= start && ip <= start+0xff {
+			r.rows = [][]driver.Value{{int64(7), start, start + 0xff, start, int64(24)}}
+		}
+	case strings.Contains(s.query, RRTable):
+		target := map[int64]string{7: "1.1.1.1", 0: "2.2.2.2"}[args[1].(int64)]
+		r.rows = [][]driver.Value{{int64(1), int64(dns.TypeA), int64(dns.ClassINET), int64(600), target}}
+	}
+	return r, nil
+}
+
+func (r *testMySQLRows) Columns() []string {
+	if len(r.rows) == 0 {
+		return []string{"x"}
+	}
+	return make([]string, len(r.rows[0]))
+}
+func (r *testMySQLRows) Close() error { return nil }
+func (r *testMySQLRows) Next(dest []driver.Value) error {
+	if len(r.rows) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.rows[0])
+	r.rows = r.rows[1:]
+	return nil
+}
+
+func init() {
+	sql.Register("testmysql", testMySQLDriver{})
+}
+
+// Use the test driver as the MySQL backend of mysql.test.com until the
+// returned func is called
+func useTestMySQL(t *testing.T) func() {
+	db, e := sql.Open("testmysql", "")
+	if e != nil {
+		t.Fatal(e)
+	}
+	rc := config.GetRC()
+	x := &config.RuntimeConfiguration{}
+	if rc != nil {
+		*x = *rc
+	}
+	x.MySQLEnabled, x.MySQLConf, x.MySQLDomains = true, &config.MySQLConf{DomainsInMySQL: []string{"mysql.test.com."}}, nil
+	config.SetRC(x)
+	mysqlLock.Lock()
+	old := RRMySQL
+	RRMySQL = &RR_MySQL{DB: db}
+	mysqlLock.Unlock()
+	return func() {
+		mysqlLock.Lock()
+		RRMySQL = old
+		mysqlLock.Unlock()
+		config.SetRC(rc)
+		Refresher.CancelDomain("mysql.test.com.")
+	}
+}
+
+// Wait for the region of srcIP cached by the goroutine of GetAFromMySQLBackend
+func waitMySQLRegion(d, srcIP string) *Region {
+	for i := 0; i < 100; i++ {
+		if _, r, e := GetRegionFromCacheWithType(d, srcIP, dns.TypeA); e == nil && r != nil {
+			return r
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return nil
+}
+
+func TestGetRecordResultMySQL(t *testing.T) {
+	InitCache()
+	defer useTestMySQL(t)()
+
+	ok, result, e := GetRecordResult("mysql.test.com.", "1.2.3.4", dns.TypeA)
+	if !ok || e != nil || len(result.RR) != 1 || result.RR[0].(*dns.A).A.String() != "1.1.1.1" || result.RR[0].Header().Ttl != 600 {
+		t.Fatal(result, e)
+	}
+	// the answer is cached as the region of its RegionTable range
+	r := waitMySQLRegion("mysql.test.com.", "1.2.3.200")
+	if r == nil || r.Source != REGION_SOURCE_MYSQL || r.Network() != "1.2.3.0/24" || r.RR[0].(*dns.A).A.String() != "1.1.1.1" {
+		t.Fatal(r)
+	}
+	if ok, _, e := GetRecordResult("mysql.test.com.", "1.2.3.4", dns.TypeAAAA); ok || e == nil || e.ErrorNo != MyError.ERROR_TYPE {
+		t.Log(e)
+		t.Fail()
+	}
+
+	// a missing connection is a fault of the server, not of the request
+	mysqlLock.Lock()
+	db := RRMySQL
+	RRMySQL = nil
+	mysqlLock.Unlock()
+	_, _, e = GetRecordResult("mysql.test.com.", "5.6.7.8", dns.TypeA)
+	mysqlLock.Lock()
+	RRMySQL = db
+	mysqlLock.Unlock()
+	if e == nil || e.ErrorNo != MyError.ERROR_UNKNOWN {
+		t.Log(e)
+		t.Fail()
+	}
+	if e := PingMySQL(); e != nil {
+		t.Log(e)
+		t.Fail()
+	}
+}
+
+func TestSweepCacheMySQL(t *testing.T) {
+	InitCache()
+	restore := useTestMySQL(t)
+	if ok, _, e := GetRecordResult("mysql.test.com.", "1.2.3.4", dns.TypeA); !ok {
+		restore()
+		t.Fatal(e)
+	}
+	r := waitMySQLRegion("mysql.test.com.", "1.2.3.4")
+	// the source of the region protects it once the domain is no longer
+	// in domains_in_mysql
+	restore()
+	if r == nil {
+		t.FailNow()
+	}
+	cold, _ := NewDomainNode("cold.mysql.com.", "mysql.com.", 600)
+	for _, n := range []uint32{0x01020300, 0x01020400, 0x01020500} {
+		x, _ := NewRegion(r.RR, n, 24)
+		cold.DomainRegionTree.AddRegionToCache(x)
+	}
+	DomainRRCache.StoreDomainNodeToCache(cold)
+
+	// the cache is shared by the tests, only the regions of this one are checked
+	u := SweepCache(CacheBudget{MaxEntries: 1, ProtectHits: 100})
+	if _, e := DomainRRCache.GetDomainNodeFromCacheWithName("cold.mysql.com."); e == nil || u.EvictedRegions < 3 {
+		t.Log(u)
+		t.Fail()
+	}
+	if x := waitMySQLRegion("mysql.test.com.", "1.2.3.4"); x != r {
+		t.Log(x)
+		t.Fail()
+	}
+}
+
+func TestStoreDomainNodeTrees(t *testing.T) {
+	InitCache()
+	first, _ := NewDomainNode("www.race.com.", "race.com.", 600)
+	DomainRRCache.StoreDomainNodeToCache(first)
+	// a second first query of the domain stores its regions in the cached trees
+	for _, store := range []func(*DomainNode){
+		func(dn *DomainNode) { DomainRRCache.StoreDomainNodeToCache(dn) },
+		func(dn *DomainNode) { DomainRRCache.UpdateDomainNode(dn) },
+	} {
+		dn, _ := NewDomainNode("www.race.com.", "race.com.", 600)
+		store(dn)
+		if dn.DomainRegionTree != first.DomainRegionTree || dn.DomainRegionTreeAAAA != first.DomainRegionTreeAAAA {
+			t.Fail()
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"os"
+	"time"
+
+	"MyError"
+	"config"
+	"query"
+	"utils"
+)
+
+// Admin api, served on bind of [admin]. Every request is signed by an admin
+// client with id, t and sign like /q, but over the action:
+// sign = hex(hmac_sha256(secret, method|path|d|arg|t)), e.g.
+// "POST|/admin/purge|www.a.com||1500000000". arg is the "prefix" param for
+// /admin/purge_prefix, the "ip" param for /admin/refresh and empty for the
+// others.
+//
+//	POST /admin/purge?d=              remove the domain and all of its regions
+//	POST /admin/purge_prefix?d=&prefix=1.2.3.0/24[&type=AAAA]
+//	POST /admin/refresh?d=&ip=[&type=AAAA]
+//	POST /admin/drop_soa?d=           d is a SOA key or a cached domain
+//	GET  /admin/regions?d=[&format=json]
+type ADMIN_RESULT struct {
+	Action  string   `json:"action"`
+	Domain  string   `json:"domain"`
+	Code    string   `json:"code"`
+	Msg     string   `json:"msg,omitempty"`
+	Answers []string `json:"answers,omitempty"`
+}
+
+func NewAdminMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/purge", AdminPurgeServe)
+	mux.HandleFunc("/admin/purge_prefix", AdminPurgePrefixServe)
+	mux.HandleFunc("/admin/refresh", AdminRefreshServe)
+	mux.HandleFunc("/admin/drop_soa", AdminDropSOAServe)
+	mux.HandleFunc("/admin/regions", AdminRegionsServe)
+	return mux
+}
+
+// Start the admin api if [admin] bind is configured, it blocks like Serve
+func AdminServe() {
+	rc := config.GetRC().AdminConf
+	if rc == nil || rc.Bind == "" {
+		utils.ServerLogger.Info("admin api is disabled")
+		return
+	}
+	server := &http.Server{
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 30 * time.Second,
+		Handler:      InstrumentMux(NewAdminMux()),
+	}
+	listener, err := net.Listen("tcp", rc.Bind)
+	if nil != err {
+		utils.ServerLogger.Critical("Create admin listener error: %s", err.Error())
+		os.Exit(1)
+	}
+	defer listener.Close()
+	registerHTTPServer(server)
+	if err := server.Serve(listener); nil != err && err != http.ErrServerClosed {
+		utils.ServerLogger.Critical("Call admin server error: %s", err.Error())
+		os.Exit(1)
+	}
+}
+
+func AdminPurgeServe(w http.ResponseWriter, r *http.Request) {
+	d := r.URL.Query().Get("d")
+	if !checkAdminRequest(w, r, "purge", d, "") {
+		return
+	}
+	writeAdminResult(w, "purge", d, query.PurgeDomain(d), nil)
+}
+
+func AdminPurgePrefixServe(w http.ResponseWriter, r *http.Request) {
+	d, prefix := r.URL.Query().Get("d"), r.URL.Query().Get("prefix")
+	if !checkAdminRequest(w, r, "purge_prefix", d, prefix) {
+		return
+	}
+	qtype, ok := ParseQueryType(r.URL.Query().Get("type"))
+	if !ok {
+		writeAdminResult(w, "purge_prefix", d, MyError.NewError(MyError.ERROR_PARAM, "Error query type: "+r.URL.Query().Get("type")), nil)
+		return
+	}
+	_, ipnet, e := net.ParseCIDR(prefix)
+	if e != nil {
+		writeAdminResult(w, "purge_prefix", d, MyError.NewError(MyError.ERROR_PARAM, "Error prefix: "+prefix), nil)
+		return
+	}
+	writeAdminResult(w, "purge_prefix", d, query.PurgeRegion(d, ipnet, qtype), nil)
+}
+
+func AdminRefreshServe(w http.ResponseWriter, r *http.Request) {
+	d, ip := r.URL.Query().Get("d"), r.URL.Query().Get("ip")
+	if !checkAdminRequest(w, r, "refresh", d, ip) {
+		return
+	}
+	qtype, ok := ParseQueryType(r.URL.Query().Get("type"))
+	if !ok {
+		writeAdminResult(w, "refresh", d, MyError.NewError(MyError.ERROR_PARAM, "Error query type: "+r.URL.Query().Get("type")), nil)
+		return
+	}
+	if net.ParseIP(ip) == nil {
+		writeAdminResult(w, "refresh", d, MyError.NewError(MyError.ERROR_PARAM, "Error ip: "+ip), nil)
+		return
+	}
+	_, rr, e := query.RefreshRecord(d, ip, qtype)
+	var answers []string
+	for _, x := range rr {
+		answers = append(answers, GetRRData(x))
+	}
+	writeAdminResult(w, "refresh", d, e, answers)
+}
+
+func AdminDropSOAServe(w http.ResponseWriter, r *http.Request) {
+	d := r.URL.Query().Get("d")
+	if !checkAdminRequest(w, r, "drop_soa", d, "") {
+		return
+	}
+	writeAdminResult(w, "drop_soa", d, query.DropSOA(d), nil)
+}
+
+func AdminRegionsServe(w http.ResponseWriter, r *http.Request) {
+	if !checkAdminAuth(w, r, "regions", r.URL.Query().Get("d"), "") {
+		return
+	}
+	RegionTraverServe(w, r)
+}
+
+// Check the method and the signature of an admin request which changes
+// the cache, the error response has been written when false is returned
+func checkAdminRequest(w http.ResponseWriter, r *http.Request, action, domain, arg string) bool {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		writeJSON(w, http.StatusMethodNotAllowed, &ADMIN_RESULT{
+			Action: action, Domain: domain, Code: MyError.ERROR_PARAM, Msg: "POST is required",
+		})
+		return false
+	}
+	return checkAdminAuth(w, r, action, domain, arg)
+}
+
+func checkAdminAuth(w http.ResponseWriter, r *http.Request, action, domain, arg string) bool {
+	c := NewDispatcherClient(w, r)
+	status, e := c.AuthenticateAdmin(domain, arg)
+	if e == nil && !c.RC.IsAdminClient(c.Identifier) {
+		status, e = http.StatusForbidden, MyError.NewError(MyError.ERROR_FORBIDDEN,
+			"Client "+c.Identifier+" is not an admin client")
+	}
+	if e != nil {
+		writeJSON(w, status, &ADMIN_RESULT{Action: action, Domain: domain, Code: e.ErrorNo, Msg: e.Msg})
+		utils.ServerLogger.Warning("admin auth failed, client: %s addr: %s error: %s", c.Identifier, c.ClientAddr, e.Error())
+		return false
+	}
+	utils.ServerLogger.Info("admin %s domain: %s arg: %s client: %s addr: %s", action, domain, arg, c.Identifier, c.ClientAddr)
+	return true
+}
+
+func writeAdminResult(w http.ResponseWriter, action, domain string, e *MyError.MyError, answers []string) {
+	if e != nil {
+		writeJSON(w, ErrorStatus(e), &ADMIN_RESULT{Action: action, Domain: domain, Code: e.ErrorNo, Msg: e.Msg})
+		utils.ServerLogger.Error("admin %s domain: %s error: %s", action, domain, e.Error())
+		return
+	}
+	writeJSON(w, http.StatusOK, &ADMIN_RESULT{Action: action, Domain: domain, Code: CODE_OK, Answers: answers})
+}
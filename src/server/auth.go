@@ -0,0 +1,156 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"MyError"
+	"config"
+	"utils"
+)
+
+const (
+	AUTH_PARAM_ID        = "id"
+	AUTH_PARAM_TIMESTAMP = "t"
+	AUTH_PARAM_SIGN      = "sign"
+	AUTH_SIGN_SEP        = "\n"
+	ADMIN_SIGN_SEP       = "|"
+
+	DEFAULT_SIGNATURE_EXPIRE = 300
+)
+
+// Signatures already used, kept until they expire, so that a captured
+// request can not be replayed
+type signatureCache struct {
+	sync.Mutex
+	m         map[string]int64
+	lastSweep int64
+}
+
+var usedSignatures = &signatureCache{m: make(map[string]int64)}
+
+// Store sign which is valid until expireAt, return false if it is already used
+func (c *signatureCache) checkAndStore(sign string, expireAt, now int64) bool {
+	c.Lock()
+	defer c.Unlock()
+	if now != c.lastSweep {
+		for k, v := range c.m {
+			if v < now {
+				delete(c.m, k)
+			}
+		}
+		c.lastSweep = now
+	}
+	if _, ok := c.m[sign]; ok {
+		return false
+	}
+	c.m[sign] = expireAt
+	return true
+}
+
+func NewDispatcherClient(w http.ResponseWriter, r *http.Request) *DispatcherClient {
+	return &DispatcherClient{
+		RC:         config.GetRC(),
+		ClientAddr: getClientIP(r),
+		AuthToken:  r.URL.Query().Get(AUTH_PARAM_SIGN),
+		Identifier: r.URL.Query().Get(AUTH_PARAM_ID),
+		Writer:     w,
+		Request:    r,
+	}
+}
+
+// hex(hmac_sha256(secret, domain + "\n" + ip + "\n" + timestamp)), the
+// separators keep different splits of the fields from signing the same string
+func Signature(secret, domain, ip, timestamp string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strings.Join([]string{domain, ip, timestamp}, AUTH_SIGN_SEP)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// hex(hmac_sha256(secret, method|path|domain|arg|timestamp)) of the admin
+// api, the action is signed so a signature is only valid for its endpoint
+func AdminSignature(secret, method, path, domain, arg, timestamp string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strings.Join([]string{method, path, domain, arg, timestamp}, ADMIN_SIGN_SEP)))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Check the signature of domain and ip (the "ip" param, may be empty), the
+// returned int is the http status for the error
+func (c *DispatcherClient) Authenticate(domain, ip string) (int, *MyError.MyError) {
+	return c.authenticate(func(secret, timestamp string) string {
+		return Signature(secret, domain, ip, timestamp)
+	})
+}
+
+// Check the admin signature of the method and path of the request, domain
+// and arg
+func (c *DispatcherClient) AuthenticateAdmin(domain, arg string) (int, *MyError.MyError) {
+	return c.authenticate(func(secret, timestamp string) string {
+		return AdminSignature(secret, c.Request.Method, c.Request.URL.Path, domain, arg, timestamp)
+	})
+}
+
+func (c *DispatcherClient) authenticate(signature func(secret, timestamp string) string) (int, *MyError.MyError) {
+	timestamp := c.Request.URL.Query().Get(AUTH_PARAM_TIMESTAMP)
+	if c.Identifier == "" || c.AuthToken == "" || timestamp == "" {
+		return http.StatusUnauthorized, MyError.NewError(MyError.ERROR_AUTH,
+			"id, t and sign are required")
+	}
+	client, ok := c.RC.GetClientConf(c.Identifier)
+	if !ok {
+		return http.StatusForbidden, MyError.NewError(MyError.ERROR_AUTH,
+			"Unknown client: "+c.Identifier)
+	}
+
+	t, e := strconv.ParseInt(timestamp, 10, 64)
+	if e != nil {
+		return http.StatusUnauthorized, MyError.NewError(MyError.ERROR_AUTH,
+			"Error timestamp: "+timestamp)
+	}
+	// ok means AuthConf of c.RC is set
+	expire := c.RC.AuthConf.SignatureExpire
+	if expire <= 0 {
+		expire = DEFAULT_SIGNATURE_EXPIRE
+	}
+	now := time.Now().Unix()
+	if t < now-expire || t > now+expire {
+		return http.StatusUnauthorized, MyError.NewError(MyError.ERROR_EXPIRED,
+			"Signature expired, timestamp: "+timestamp)
+	}
+
+	sign := signature(client.Secret, timestamp)
+	if !hmac.Equal([]byte(sign), []byte(c.AuthToken)) {
+		return http.StatusForbidden, MyError.NewError(MyError.ERROR_AUTH,
+			"Signature mismatch for client: "+c.Identifier)
+	}
+	if !usedSignatures.checkAndStore(c.Identifier+sign, t+expire, now) {
+		return http.StatusForbidden, MyError.NewError(MyError.ERROR_REPLAY,
+			"Signature already used by client: "+c.Identifier)
+	}
+	return http.StatusOK, nil
+}
+
+// Authenticate the request with rc if auth_enable is set and return the
+// verified client id, empty when auth is disabled. The error response has
+// been written when false is returned
+func checkAuth(w http.ResponseWriter, r *http.Request, rc *config.RuntimeConfiguration, format, domain, ip string) (string, bool) {
+	if !rc.AuthEnabled {
+		return "", true
+	}
+	c := NewDispatcherClient(w, r)
+	c.RC = rc
+	_, e := c.Authenticate(domain, ip)
+	if e != nil {
+		writeQueryError(w, format, domain, c.ClientAddr, e)
+		utils.ServerLogger.Warning("auth failed, client: %s addr: %s error: %s", c.Identifier, c.ClientAddr, e.Error())
+		return "", false
+	}
+	return c.Identifier, true
+}
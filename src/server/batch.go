@@ -0,0 +1,176 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/miekg/dns"
+
+	"MyError"
+	"config"
+	"query"
+	"utils"
+)
+
+const (
+	BATCH_DOMAIN_SEP  = ","
+	BATCH_MAX_DOMAINS = 64
+	BATCH_MAX_BODY    = 64 * 1024
+)
+
+// Body of POST /batch
+type BatchRequest struct {
+	Domains []string `json:"domains"`
+	IP      string   `json:"ip"`
+	Type    string   `json:"type"`
+}
+
+// Result of one domain in a batch, Code is CODE_OK or MyError.ErrorNo
+type BatchResult struct {
+	Domain string
+	RR     []dns.RR
+	Code   string
+	Error  *MyError.MyError
+	Stale  bool
+}
+
+// Resolve qtype record of all domains for srcIP concurrently, the results keep
+// the order of domains. One domain failing does not affect the others. The
+// count of domains is checked by the handlers, see BATCH_MAX_DOMAINS. rc is
+// the configuration of the request
+func ResolveBatch(rc *config.RuntimeConfiguration, domains []string, srcIP string, qtype uint16) []*BatchResult {
+	results := make([]*BatchResult, len(domains))
+	wg := &sync.WaitGroup{}
+	for i, d := range domains {
+		wg.Add(1)
+		go func(i int, d string) {
+			defer wg.Done()
+			results[i] = resolveBatchDomain(rc, strings.TrimSpace(d), srcIP, qtype)
+		}(i, d)
+	}
+	wg.Wait()
+	return results
+}
+
+func resolveBatchDomain(rc *config.RuntimeConfiguration, d, srcIP string, qtype uint16) *BatchResult {
+	br := &BatchResult{Domain: d}
+	if _, ok := dns.IsDomainName(d); !ok || d == "" {
+		br.Error = MyError.NewError(MyError.ERROR_PARAM, d+" is not valid domain name")
+	} else if !rc.InWhiteList(d) {
+		br.Error = MyError.NewError(MyError.ERROR_FORBIDDEN, "Query for domain: "+d+" is not permited")
+	} else if ok, x, e := query.GetRecordResult(d, srcIP, qtype); ok {
+		br.RR, br.Stale = x.RR, x.Stale
+	} else if e != nil {
+		br.Error = e
+	} else {
+		br.Error = MyError.NewError(MyError.ERROR_UNKNOWN, "unkown error")
+	}
+
+	if br.Error != nil {
+		br.Code = br.Error.ErrorNo
+		utils.ServerLogger.Error("batch query domain: %s src_ip: %s  %s", d, srcIP, br.Error.Error())
+	} else {
+		br.Code = CODE_OK
+	}
+	return br
+}
+
+// json/jsonz: an array of RDATA/RDATA_Z, one per domain
+// text: one line per domain, "domain ip1 ip2 ..." or "domain errno"
+func writeBatchResult(w http.ResponseWriter, format, srcIP string, results []*BatchResult) {
+	if IsJSONFormat(format) {
+		rdata := make([]interface{}, 0, len(results))
+		for _, br := range results {
+			if br.Error != nil {
+				// same as the error of /q
+				rdata = append(rdata, NewErrorResultWithFormat(format, br.Domain, srcIP, br.Error))
+				continue
+			}
+			x := NewResultWithFormat(format, br.Domain, srcIP, br.Code, br.RR)
+			if br.Stale {
+				SetStale(x)
+			}
+			rdata = append(rdata, x)
+		}
+		writeJSON(w, http.StatusOK, rdata)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusOK)
+	for _, br := range results {
+		if br.Error != nil {
+			fmt.Fprintln(w, br.Domain, br.Code)
+			continue
+		}
+		line := []string{br.Domain}
+		for _, ree := range br.RR {
+			if ip, ok := GetRRIP(ree); ok {
+				line = append(line, ip.String())
+			}
+		}
+		fmt.Fprintln(w, strings.Join(line, " "))
+	}
+}
+
+// POST /batch {"domains": ["a.com", "b.com"], "ip": "1.2.3.4"}, format is
+// taken from the url as /q does, default is json. With auth_enable, the
+// signed domain is the domains joined by BATCH_DOMAIN_SEP
+func HttpDispacherBatchServe(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		fmt.Fprintln(w, "Method "+r.Method+" is not allowed")
+		return
+	}
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = FORMAT_JSON
+	}
+
+	req := &BatchRequest{}
+	if e := json.NewDecoder(io.LimitReader(r.Body, BATCH_MAX_BODY)).Decode(req); e != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, "Error batch request: "+e.Error())
+		utils.ServerLogger.Info("error batch request: %s", e.Error())
+		return
+	}
+
+	rc := config.GetRC()
+	id, ok := checkAuth(w, r, rc, format, strings.Join(req.Domains, BATCH_DOMAIN_SEP), req.IP)
+	if !ok {
+		return
+	}
+	if len(req.Domains) < 1 || len(req.Domains) > BATCH_MAX_DOMAINS {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Count of domains must be in [1, %d]\n", BATCH_MAX_DOMAINS)
+		return
+	}
+	if !checkRateLimit(w, r, id, len(req.Domains)) {
+		return
+	}
+
+	srcIP := req.IP
+	if srcIP == "" {
+		srcIP = getClientIP(r)
+	}
+	if x := net.ParseIP(srcIP); x == nil {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintln(w, "src ip : "+srcIP+" is not correct")
+		utils.ServerLogger.Warning("src ip : %s is not correct", srcIP)
+		return
+	}
+	qtype, ok := ParseQueryType(req.Type)
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, "Error query type: "+req.Type)
+		return
+	}
+	utils.QueryLogger.Info("src ip: %s batch domains: %v", srcIP, req.Domains)
+
+	writeBatchResult(w, format, srcIP, ResolveBatch(rc, req.Domains, srcIP, qtype))
+}
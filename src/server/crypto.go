@@ -0,0 +1,153 @@
+package server
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+
+	"MyError"
+	"config"
+	"utils"
+)
+
+// /q?enc=1&id=<identifier>&d=<encrypted domain>[&ip=<encrypted ip>]
+const ENCRYPT_PARAM = "enc"
+
+// Encrypted text is base64url(nonce + AES-GCM sealed data), GCM makes
+// tampered messages fail to decrypt
+func Encrypt(key, plain []byte) (string, error) {
+	gcm, e := newGCM(key)
+	if e != nil {
+		return "", e
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, e := io.ReadFull(rand.Reader, nonce); e != nil {
+		return "", e
+	}
+	return base64.RawURLEncoding.EncodeToString(gcm.Seal(nonce, nonce, plain, nil)), nil
+}
+
+func Decrypt(key []byte, s string) ([]byte, error) {
+	gcm, e := newGCM(key)
+	if e != nil {
+		return nil, e
+	}
+	b, e := base64.RawURLEncoding.DecodeString(s)
+	if e != nil {
+		return nil, e
+	}
+	if len(b) < gcm.NonceSize() {
+		return nil, errors.New("encrypted text is too short")
+	}
+	return gcm.Open(nil, b[:gcm.NonceSize()], b[gcm.NonceSize():], nil)
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, e := aes.NewCipher(key)
+	if e != nil {
+		return nil, e
+	}
+	return cipher.NewGCM(block)
+}
+
+// Try every active key of client c, return the plain text and the key
+func DecryptWithClientKeys(c *config.ClientConf, s string) ([]byte, []byte, *MyError.MyError) {
+	for _, key := range c.GetAESKeys() {
+		if plain, e := Decrypt(key, s); e == nil {
+			return plain, key, nil
+		}
+	}
+	return nil, nil, MyError.NewError(MyError.ERROR_DECRYPT, "Can not decrypt with keys of client: "+c.Identifier)
+}
+
+// Collect the response of a handler so that it can be encrypted
+type bufferedResponseWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func newBufferedResponseWriter() *bufferedResponseWriter {
+	return &bufferedResponseWriter{
+		header: make(http.Header),
+		status: http.StatusOK,
+	}
+}
+
+func (b *bufferedResponseWriter) Header() http.Header {
+	return b.header
+}
+
+func (b *bufferedResponseWriter) Write(p []byte) (int, error) {
+	return b.body.Write(p)
+}
+
+func (b *bufferedResponseWriter) WriteHeader(status int) {
+	b.status = status
+}
+
+// Decrypt d and ip with the keys of client id, run HttpDispacherQueryServe
+// with the plain params and return its body encrypted with the same key.
+func HttpDispacherEncryptedQueryServe(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	id := q.Get(AUTH_PARAM_ID)
+	c, ok := config.GetClientConf(id)
+	if id == "" || !ok {
+		w.WriteHeader(http.StatusUnauthorized)
+		fmt.Fprintln(w, "Unknown client: "+id)
+		utils.ServerLogger.Warning("encrypted query from unknown client: %s", id)
+		return
+	}
+
+	domain, key, e := DecryptWithClientKeys(c, q.Get("d"))
+	if e != nil {
+		w.WriteHeader(http.StatusForbidden)
+		fmt.Fprintln(w, e.ErrorNo+": "+e.Msg)
+		utils.ServerLogger.Warning("decrypt domain error: %s", e.Error())
+		return
+	}
+	q.Set("d", string(domain))
+	if x := q.Get("ip"); x != "" {
+		ip, ee := Decrypt(key, x)
+		if ee != nil {
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprintln(w, MyError.ERROR_DECRYPT+": Can not decrypt ip")
+			utils.ServerLogger.Warning("decrypt ip error: %s client: %s", ee.Error(), id)
+			return
+		}
+		q.Set("ip", string(ip))
+	}
+	q.Del(ENCRYPT_PARAM)
+
+	plainRequest := new(http.Request)
+	*plainRequest = *r
+	plainURL := *r.URL
+	plainURL.RawQuery = q.Encode()
+	plainRequest.URL = &plainURL
+
+	bw := newBufferedResponseWriter()
+	HttpDispacherQueryServe(bw, plainRequest)
+
+	body, ee := Encrypt(key, bw.body.Bytes())
+	if ee != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		utils.ServerLogger.Error("encrypt response error: %s client: %s", ee.Error(), id)
+		return
+	}
+	// headers of the handler such as Retry-After are kept, the content ones
+	// describe the plain body
+	for k, v := range bw.header {
+		if k != "Content-Type" && k != "Content-Length" {
+			w.Header()[k] = v
+		}
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(bw.status)
+	fmt.Fprint(w, body)
+}
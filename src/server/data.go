@@ -1,74 +1,265 @@
 package server
 
+import (
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"MyError"
+	"query"
+)
+
+const (
+	FORMAT_TEXT  = "text"
+	FORMAT_JSON  = "json"
+	FORMAT_JSONZ = "jsonz"
+)
+
+// Version of the short key mapping used by format=jsonz, must be increased
+// whenever a key of RDATA_Z or DNS_RR_Z is added, removed or renamed
+const JSONZ_VERSION = 3
+
+// Short key -> long key of RDATA_Z and DNS_RR_Z, served by /z so that clients
+// can check the mapping of JSONZ_VERSION
+var JSONZ_FIELDS = map[string]map[string]string{
+	"rdata": {
+		"v": "version",
+		"m": "domain",
+		"i": "device_ip",
+		"s": "device_sp",
+		"c": "code",
+		"d": "dns_rr",
+		"e": "error",
+		"o": "stale",
+	},
+	"dns_rr": {
+		"y": "priority",
+		"p": "ip",
+		"t": "ttl",
+	},
+}
+
+// RDATA.Code for a successful query, errors use MyError.ErrorNo
+const CODE_OK = "OK"
+
 type DNS_RR struct {
-	priority string `json:"priority"`
-	ip       string `json:"ip"`
-	ttl      string `json:"ttl"`
+	Priority string `json:"priority"`
+	IP       string `json:"ip"`
+	TTL      string `json:"ttl"`
 }
 
 type DNS_RR_Z struct {
-	y string `json:"priority"`
-	p string `json:"ip"`
-	t string `json:"ttl"`
+	Y string `json:"y"`
+	P string `json:"p"`
+	T string `json:"t"`
 }
 
 type RDATA struct {
-	domain    string   `json:"domain"`
-	device_ip string   `json:"device_ip"`
-	device_sp string   `json:"device_sp"`
-	code      string   `json:"code"`
-	dns       []DNS_RR `json:"dns_rr"`
+	Domain   string      `json:"domain"`
+	DeviceIP string      `json:"device_ip"`
+	DeviceSP string      `json:"device_sp"`
+	Code     string      `json:"code"`
+	DNS      []DNS_RR    `json:"dns_rr"`
+	Error    *ERROR_BODY `json:"error,omitempty"`
+	Stale    bool        `json:"stale,omitempty"` // expired answers, the backends failed
 }
 
 type RDATA_Z struct {
-	m string     `json:"domain"`
-	i string     `json:"device_ip"`
-	s string     `json:"device_sp"`
-	c string     `json:"code"`
-	d []DNS_RR_Z `json:"dns_rr_z"`
+	V int        `json:"v"`
+	M string     `json:"m"`
+	I string     `json:"i"`
+	S string     `json:"s"`
+	C string     `json:"c"`
+	D []DNS_RR_Z `json:"d"`
+	E string     `json:"e,omitempty"` // ERROR_BODY.Message
+	O bool       `json:"o,omitempty"` // RDATA.Stale
 }
 
 func NewDnsRR(y, p, t string) *DNS_RR {
 	return &DNS_RR{
-		priority: y,
-		ip:       p,
-		ttl:      t,
+		Priority: y,
+		IP:       p,
+		TTL:      t,
 	}
 }
 
 func NewDnsRRZ(y, p, t string) *DNS_RR_Z {
 	return &DNS_RR_Z{
-		y: y,
-		p: p,
-		t: t,
+		Y: y,
+		P: p,
+		T: t,
 	}
 }
 
 func NewRdata(m, i, s, c string, dns []DNS_RR) *RDATA {
+	if dns == nil {
+		// encode as "dns_rr": [] rather than null
+		dns = []DNS_RR{}
+	}
 	return &RDATA{
-		domain:    m,
-		device_ip: i,
-		device_sp: s,
-		code:      c,
-		dns:       dns,
+		Domain:   m,
+		DeviceIP: i,
+		DeviceSP: s,
+		Code:     c,
+		DNS:      dns,
 	}
 }
 func (r *RDATA) AddDNSRR(d DNS_RR) error {
-	r.dns = append(r.dns, d)
+	r.DNS = append(r.DNS, d)
+	return nil
+}
+
+// Address of an A or AAAA record
+func GetRRIP(rr dns.RR) (net.IP, bool) {
+	switch x := rr.(type) {
+	case *dns.A:
+		return x.A, true
+	case *dns.AAAA:
+		return x.AAAA, true
+	}
+	return nil, false
+}
+
+// "ip1;ip2,ttl" of the A/AAAA records in rr, for /q?ttl=1
+func FormatIPsWithTTL(rr []dns.RR, ttl uint32) string {
+	var ips []string
+	for _, x := range rr {
+		if ip, ok := GetRRIP(x); ok {
+			ips = append(ips, ip.String())
+		}
+	}
+	return strings.Join(ips, ";") + "," + strconv.FormatUint(uint64(ttl), 10)
+}
+
+// Fill r.DNS with the A/AAAA records in rr, the priority is the position of the
+// record in the answer (0 is the first choice)
+func (r *RDATA) AddDNSRRWithRR(rr []dns.RR) error {
+	for _, x := range rr {
+		if ip, ok := GetRRIP(x); ok {
+			r.AddDNSRR(*NewDnsRR(strconv.Itoa(len(r.DNS)), ip.String(), strconv.Itoa(int(x.Header().Ttl))))
+		}
+	}
 	return nil
 }
 
 func NewRdataZ(m, i, s, c string, dns []DNS_RR_Z) *RDATA_Z {
+	if dns == nil {
+		dns = []DNS_RR_Z{}
+	}
 	return &RDATA_Z{
-		m: m,
-		i: i,
-		s: s,
-		c: c,
-		d: dns,
+		V: JSONZ_VERSION,
+		M: m,
+		I: i,
+		S: s,
+		C: c,
+		D: dns,
 	}
 }
 
 func (r *RDATA_Z) AddDNSRR_Z(d DNS_RR_Z) error {
-	r.d = append(r.d, d)
+	r.D = append(r.D, d)
+	return nil
+}
+
+// Same as RDATA.AddDNSRRWithRR
+func (r *RDATA_Z) AddDNSRR_ZWithRR(rr []dns.RR) error {
+	for _, x := range rr {
+		if ip, ok := GetRRIP(x); ok {
+			r.AddDNSRR_Z(*NewDnsRRZ(strconv.Itoa(len(r.D)), ip.String(), strconv.Itoa(int(x.Header().Ttl))))
+		}
+	}
 	return nil
 }
+
+// Build the response body of format f (FORMAT_JSON or FORMAT_JSONZ) for
+// domain m queried by client i
+func NewResultWithFormat(f, m, i, c string, rr []dns.RR) interface{} {
+	if f == FORMAT_JSONZ {
+		r := NewRdataZ(m, i, "", c, nil)
+		r.AddDNSRR_ZWithRR(rr)
+		return r
+	}
+	r := NewRdata(m, i, "", c, nil)
+	r.AddDNSRRWithRR(rr)
+	return r
+}
+
+// Mark the result of NewResultWithFormat as stale
+func SetStale(r interface{}) {
+	switch x := r.(type) {
+	case *RDATA:
+		x.Stale = true
+	case *RDATA_Z:
+		x.O = true
+	}
+}
+
+// Same as NewResultWithFormat for the failed query, the code is e.ErrorNo
+func NewErrorResultWithFormat(f, m, i string, e *MyError.MyError) interface{} {
+	if f == FORMAT_JSONZ {
+		r := NewRdataZ(m, i, "", e.ErrorNo, nil)
+		r.E = e.Msg
+		return r
+	}
+	r := NewRdata(m, i, "", e.ErrorNo, nil)
+	r.Error = NewErrorBody(e)
+	return r
+}
+
+func IsJSONFormat(f string) bool {
+	return f == FORMAT_JSON || f == FORMAT_JSONZ
+}
+
+// One region of a domain, listed by /t
+type REGION_ENTRY struct {
+	Network      string   `json:"network"`
+	Type         string   `json:"type"`
+	Answers      []string `json:"answers"`
+	TTL          uint32   `json:"ttl"`
+	RemainingTTL uint32   `json:"remaining_ttl"`
+	UpdateTime   string   `json:"update_time"`
+	Source       string   `json:"source"`
+}
+
+func NewRegionEntry(r *query.Region) *REGION_ENTRY {
+	answers := []string{}
+	for _, rr := range r.RR {
+		answers = append(answers, GetRRData(rr))
+	}
+	return &REGION_ENTRY{
+		Network:      r.Network(),
+		Type:         dns.TypeToString[r.RrType],
+		Answers:      answers,
+		TTL:          r.TTL,
+		RemainingTTL: r.RemainingTTL(),
+		UpdateTime:   r.UpdateTime.Format(time.RFC3339),
+		Source:       r.Source,
+	}
+}
+
+// "1.2.3.0/24 A 1.1.1.1;2.2.2.2 ttl remaining_ttl update_time source"
+func (e *REGION_ENTRY) String() string {
+	return strings.Join([]string{
+		e.Network,
+		e.Type,
+		strings.Join(e.Answers, ";"),
+		strconv.FormatUint(uint64(e.TTL), 10),
+		strconv.FormatUint(uint64(e.RemainingTTL), 10),
+		e.UpdateTime,
+		e.Source,
+	}, " ")
+}
+
+// Address of A/AAAA, target of CNAME, or the whole rr for other types
+func GetRRData(rr dns.RR) string {
+	if ip, ok := GetRRIP(rr); ok {
+		return ip.String()
+	}
+	if c, ok := rr.(*dns.CNAME); ok {
+		return c.Target
+	}
+	return rr.String()
+}
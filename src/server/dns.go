@@ -0,0 +1,138 @@
+package server
+
+import (
+	"net"
+	"os"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"config"
+	"query"
+	"utils"
+)
+
+const DNS_TIMEOUT = 5 * time.Second
+
+// Classic dns server on dns_bind, network is "udp" or "tcp"
+func DNSServe(network string) {
+	bind := config.GetRC().DNSBind
+	if bind == "" {
+		return
+	}
+	server := &dns.Server{
+		Addr:         bind,
+		Net:          network,
+		Handler:      dns.HandlerFunc(DNSQueryServe),
+		ReadTimeout:  DNS_TIMEOUT,
+		WriteTimeout: DNS_TIMEOUT,
+	}
+	registerDNSServer(server)
+	if err := server.ListenAndServe(); nil != err && !isShuttingDown() {
+		utils.ServerLogger.Critical("Call dns server %s error: %s", network, err.Error())
+		os.Exit(1)
+	}
+}
+
+// Answer A/AAAA questions with the same cache and whitelist as /q
+func DNSQueryServe(w dns.ResponseWriter, req *dns.Msg) {
+	peer := w.RemoteAddr().String()
+	if host, _, e := net.SplitHostPort(peer); e == nil {
+		peer = host
+	}
+	m, _ := NewDNSReply(req, peer)
+	requests.Inc("dns/"+w.RemoteAddr().Network(), dns.RcodeToString[m.Rcode])
+	if e := w.WriteMsg(m); e != nil {
+		utils.ServerLogger.Error("dns write msg error: %s", e.Error())
+	}
+}
+
+// Resolve the question of req for client peer, the client subnet of the ECS
+// option is used as the client ip if there is one, and is echoed back with
+// the scope of the answer. The returned TTL is the remaining TTL of the
+// answers, 0 when there is none
+func NewDNSReply(req *dns.Msg, peer string) (*dns.Msg, uint32) {
+	rc := config.GetRC()
+	m := new(dns.Msg)
+	m.SetReply(req)
+	m.RecursionAvailable = true
+
+	srcIP, ecs := getDNSClientIP(req, peer)
+	if opt := req.IsEdns0(); opt != nil {
+		m.SetEdns0(opt.UDPSize(), opt.Do())
+	}
+	if len(req.Question) != 1 {
+		m.Rcode = dns.RcodeFormatError
+		return m, 0
+	}
+	q := req.Question[0]
+	utils.QueryLogger.Info("src ip: %s query_domain: %s type: %s dns", srcIP, q.Name, dns.TypeToString[q.Qtype])
+	if q.Qclass != dns.ClassINET || (q.Qtype != dns.TypeA && q.Qtype != dns.TypeAAAA) {
+		m.Rcode = dns.RcodeNotImplemented
+		return m, 0
+	}
+	if !rc.InWhiteList(q.Name) {
+		m.Rcode = dns.RcodeRefused
+		utils.ServerLogger.Info("Query for domain: %s is not permited", q.Name)
+		return m, 0
+	}
+
+	ok, re, ttl, scope, e := query.GetRecordWithScope(q.Name, srcIP, q.Qtype)
+	if !ok {
+		m.Rcode = ErrorRcode(e)
+		if e != nil {
+			utils.ServerLogger.Error("query domain: %s src_ip: %s  %s", q.Name, srcIP, e.Error())
+		}
+		return m, 0
+	}
+	m.Answer = NewDNSAnswer(q.Name, re, ttl)
+	if ecs != nil {
+		if scope > int(ecs.SourceNetmask) {
+			scope = int(ecs.SourceNetmask)
+		}
+		m.IsEdns0().Option = append(m.IsEdns0().Option, &dns.EDNS0_SUBNET{
+			Code:          dns.EDNS0SUBNET,
+			Family:        ecs.Family,
+			SourceNetmask: ecs.SourceNetmask,
+			SourceScope:   uint8(scope),
+			Address:       ecs.Address,
+		})
+	}
+	if len(m.Answer) == 0 {
+		return m, 0
+	}
+	return m, ttl
+}
+
+// The client subnet of the ECS option in req, or peer. The returned option
+// is nil if there is no usable ECS option
+func getDNSClientIP(req *dns.Msg, peer string) (string, *dns.EDNS0_SUBNET) {
+	if opt := req.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			if ecs, ok := o.(*dns.EDNS0_SUBNET); ok && ecs.SourceNetmask > 0 && ecs.Address != nil {
+				bits := 32
+				if ecs.Family == query.FAMILY_IPV6 {
+					bits = 128
+				}
+				return ecs.Address.Mask(net.CIDRMask(int(ecs.SourceNetmask), bits)).String(), ecs
+			}
+		}
+	}
+	return peer, nil
+}
+
+// Answers of a dns reply for qname, the CNAME chain followed by
+// query.GetRecord is flattened, so every answer is owned by qname
+func NewDNSAnswer(qname string, rr []dns.RR, ttl uint32) []dns.RR {
+	var answers []dns.RR
+	for _, x := range rr {
+		if _, ok := GetRRIP(x); !ok {
+			continue
+		}
+		a := dns.Copy(x)
+		a.Header().Name = qname
+		a.Header().Ttl = ttl
+		answers = append(answers, a)
+	}
+	return answers
+}
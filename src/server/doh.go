@@ -0,0 +1,70 @@
+package server
+
+import (
+	"encoding/base64"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+
+	"utils"
+)
+
+// RFC 8484 DNS-over-HTTPS, GET /dns-query?dns=<base64url> or POST with
+// the wire format message as body
+const (
+	DOH_PATH         = "/dns-query"
+	DOH_PARAM        = "dns"
+	DOH_CONTENT_TYPE = "application/dns-message"
+	DOH_MAX_MSG      = 65535
+)
+
+func HttpDNSQueryServe(w http.ResponseWriter, r *http.Request) {
+	var b []byte
+	switch r.Method {
+	case http.MethodGet:
+		var e error
+		// base64url without padding, padded messages are accepted as well
+		b, e = base64.RawURLEncoding.DecodeString(strings.TrimRight(r.URL.Query().Get(DOH_PARAM), "="))
+		if e != nil || len(b) == 0 {
+			http.Error(w, "Error dns param", http.StatusBadRequest)
+			return
+		}
+	case http.MethodPost:
+		if ct := r.Header.Get("Content-Type"); ct != DOH_CONTENT_TYPE {
+			http.Error(w, "Error content type: "+ct, http.StatusUnsupportedMediaType)
+			return
+		}
+		var e error
+		b, e = ioutil.ReadAll(http.MaxBytesReader(w, r.Body, DOH_MAX_MSG))
+		if e != nil || len(b) == 0 {
+			http.Error(w, "Error dns message", http.StatusBadRequest)
+			return
+		}
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	req := new(dns.Msg)
+	if e := req.Unpack(b); e != nil {
+		http.Error(w, "Error dns message: "+e.Error(), http.StatusBadRequest)
+		utils.ServerLogger.Info("unpack doh message error: %s", e.Error())
+		return
+	}
+	m, ttl := NewDNSReply(req, getClientIP(r))
+	out, e := m.Pack()
+	if e != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		utils.ServerLogger.Error("pack doh message error: %s", e.Error())
+		return
+	}
+	w.Header().Set("Content-Type", DOH_CONTENT_TYPE)
+	// the answer depends on the client address, shared caches must not keep it
+	w.Header().Set("Cache-Control", "private, max-age="+strconv.FormatUint(uint64(ttl), 10))
+	w.WriteHeader(http.StatusOK)
+	w.Write(out)
+}
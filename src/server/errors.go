@@ -0,0 +1,67 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/miekg/dns"
+
+	"MyError"
+)
+
+// HTTP status of each MyError.ErrorNo, the codes are part of the api and
+// must not be changed. Codes not listed are 500
+var ERROR_STATUS = map[string]int{
+	MyError.ERROR_PARAM:     http.StatusBadRequest,
+	MyError.ERROR_NOTVALID:  http.StatusBadRequest,
+	MyError.ERROR_TYPE:      http.StatusBadRequest,
+	MyError.ERROR_EXPIRED:   http.StatusUnauthorized,
+	MyError.ERROR_AUTH:      http.StatusForbidden,
+	MyError.ERROR_REPLAY:    http.StatusForbidden,
+	MyError.ERROR_DECRYPT:   http.StatusForbidden,
+	MyError.ERROR_FORBIDDEN: http.StatusForbidden,
+	MyError.ERROR_NOTFOUND:  http.StatusNotFound, // NXDOMAIN, or not in the cache for /t and admin
+	MyError.ERROR_NORESULT:  http.StatusNotFound, // the domain has no record of the type
+	MyError.ERROR_SUBDOMAIN: http.StatusNotFound,
+	MyError.ERROR_UPSTREAM:  http.StatusBadGateway,
+	MyError.ERROR_TIMEOUT:   http.StatusGatewayTimeout,
+	MyError.ERROR_UNKNOWN:   http.StatusInternalServerError,
+}
+
+// Rcode of dns replies and /resolve for each MyError.ErrorNo. Codes not
+// listed are SERVFAIL, which resolvers retry on other servers
+var ERROR_RCODE = map[string]int{
+	MyError.ERROR_PARAM:     dns.RcodeFormatError,
+	MyError.ERROR_FORBIDDEN: dns.RcodeRefused,
+	MyError.ERROR_NOTFOUND:  dns.RcodeNameError,
+	MyError.ERROR_SUBDOMAIN: dns.RcodeNameError,
+	MyError.ERROR_NORESULT:  dns.RcodeSuccess, // NODATA
+	MyError.ERROR_TYPE:      dns.RcodeSuccess, // the type is not in the backend
+}
+
+// Error of the json formats, the cause of the error is not included
+type ERROR_BODY struct {
+	Code    string `json:"code"`
+	Status  int    `json:"status"`
+	Message string `json:"message"`
+}
+
+func ErrorStatus(e *MyError.MyError) int {
+	if s, ok := ERROR_STATUS[e.ErrorNo]; ok {
+		return s
+	}
+	return http.StatusInternalServerError
+}
+
+func ErrorRcode(e *MyError.MyError) int {
+	if e == nil {
+		return dns.RcodeServerFailure
+	}
+	if c, ok := ERROR_RCODE[e.ErrorNo]; ok {
+		return c
+	}
+	return dns.RcodeServerFailure
+}
+
+func NewErrorBody(e *MyError.MyError) *ERROR_BODY {
+	return &ERROR_BODY{Code: e.ErrorNo, Status: ErrorStatus(e), Message: e.Msg}
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"time"
+
+	"config"
+	"query"
+)
+
+// Time of each readiness check, checks run at the same time
+const READY_TIMEOUT = 2 * time.Second
+
+const (
+	CHECK_OK   = "ok"
+	CHECK_FAIL = "fail"
+	CHECK_SKIP = "skip" // not configured
+)
+
+type CHECK_RESULT struct {
+	Name    string  `json:"name"`
+	Status  string  `json:"status"`
+	Latency float64 `json:"latency_ms"`
+	Error   string  `json:"error,omitempty"`
+}
+
+type HEALTH_RESULT struct {
+	Status string         `json:"status"`
+	Checks []CHECK_RESULT `json:"checks,omitempty"`
+}
+
+// A readiness check, Check returns false if it is skipped
+type ReadyCheck struct {
+	Name  string
+	Check func() (bool, error)
+}
+
+// The process is alive
+func HttpHealthServe(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, &HEALTH_RESULT{Status: CHECK_OK})
+}
+
+// The server can answer queries: MySQL (if enabled), ipdb, upstream
+// nameservers and the cache are usable. 503 if any check fails or the
+// server is shutting down
+func HttpReadyServe(w http.ResponseWriter, r *http.Request) {
+	x := RunReadyChecks(NewReadyChecks(config.GetRC()), READY_TIMEOUT)
+	if isShuttingDown() {
+		x.Status = CHECK_FAIL
+		x.Checks = append(x.Checks, CHECK_RESULT{Name: "shutdown", Status: CHECK_FAIL, Error: "server is shutting down"})
+	}
+	status := http.StatusOK
+	if x.Status != CHECK_OK {
+		status = http.StatusServiceUnavailable
+	}
+	writeJSON(w, status, x)
+}
+
+func NewReadyChecks(rc *config.RuntimeConfiguration) []ReadyCheck {
+	return []ReadyCheck{
+		{Name: "mysql", Check: func() (bool, error) {
+			if !rc.MySQLEnabled {
+				return false, nil
+			}
+			if e := query.PingMySQL(); e != nil {
+				return true, e
+			}
+			return true, nil
+		}},
+		{Name: "ipdb", Check: func() (bool, error) {
+			if rc.IPDB == "" {
+				return false, nil
+			}
+			f, e := os.Open(rc.IPDB)
+			if e != nil {
+				return true, e
+			}
+			return true, f.Close()
+		}},
+		{Name: "upstream", Check: func() (bool, error) {
+			if _, e := query.ProbeResolvers(READY_TIMEOUT / 2); e != nil {
+				return true, e
+			}
+			return true, nil
+		}},
+		{Name: "cache", Check: func() (bool, error) {
+			if !query.CacheInitialized() {
+				return true, errors.New("cache is not initialized")
+			}
+			return true, nil
+		}},
+	}
+}
+
+// Run checks at the same time, a check not done within timeout fails
+func RunReadyChecks(checks []ReadyCheck, timeout time.Duration) *HEALTH_RESULT {
+	type done struct {
+		i int
+		r CHECK_RESULT
+	}
+	c := make(chan done, len(checks))
+	for i, x := range checks {
+		go func(i int, x ReadyCheck) {
+			start := time.Now()
+			r := CHECK_RESULT{Name: x.Name, Status: CHECK_OK}
+			if ok, e := x.Check(); !ok {
+				r.Status = CHECK_SKIP
+			} else if e != nil {
+				r.Status, r.Error = CHECK_FAIL, e.Error()
+			}
+			r.Latency = float64(time.Since(start)) / float64(time.Millisecond)
+			c <- done{i, r}
+		}(i, x)
+	}
+
+	x := &HEALTH_RESULT{Status: CHECK_OK, Checks: make([]CHECK_RESULT, len(checks))}
+	for i, check := range checks {
+		x.Checks[i] = CHECK_RESULT{Name: check.Name, Status: CHECK_FAIL, Error: "timeout",
+			Latency: float64(timeout) / float64(time.Millisecond)}
+	}
+	deadline := time.After(timeout)
+wait:
+	for range checks {
+		select {
+		case d := <-c:
+			x.Checks[d.i] = d.r
+		case <-deadline:
+			break wait
+		}
+	}
+	for _, r := range x.Checks {
+		if r.Status == CHECK_FAIL {
+			x.Status = CHECK_FAIL
+		}
+	}
+	return x
+}
@@ -0,0 +1,48 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+
+	"metrics"
+	"utils"
+)
+
+var requests = metrics.NewCounterVec("httpdispacher_requests_total",
+	"Requests by endpoint and status, the status of dns requests is the rcode.", "endpoint", "status")
+
+// Prometheus metrics in the text format
+func HttpMetricsServe(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", metrics.CONTENT_TYPE)
+	w.WriteHeader(http.StatusOK)
+	if e := metrics.Write(w); e != nil {
+		utils.ServerLogger.Error("write metrics error: %s", e.Error())
+	}
+}
+
+// Count the requests of mux by the matched pattern and the status code,
+// requests matching no pattern are counted as "none"
+func InstrumentMux(mux *http.ServeMux) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, pattern := mux.Handler(r)
+		if pattern == "" {
+			pattern = "none"
+		}
+		sw := &statusWriter{ResponseWriter: w, status: http.StatusOK}
+		mux.ServeHTTP(sw, r)
+		requests.Inc(pattern, strconv.Itoa(sw.status))
+	})
+}
+
+type statusWriter struct {
+	http.ResponseWriter
+	status      int
+	wroteHeader bool
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status, w.wroteHeader = status, true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
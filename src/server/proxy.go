@@ -0,0 +1,187 @@
+package server
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"config"
+	"utils"
+)
+
+const PROXY_HEADER_TIMEOUT = 5 * time.Second
+
+var (
+	proxyV1Prefix = []byte("PROXY ")
+	proxyV2Sig    = []byte("\r\n\r\n\x00\r\nQUIT\n")
+)
+
+// Get the ip of the client. From a trusted proxy, the client is the right
+// most untrusted address of X-Forwarded-For, or X-Real-IP. Otherwise it is
+// the peer of the connection, RemoteAddr is "1.2.3.4:port" or "[2001:db8::1]:port"
+func getClientIP(r *http.Request) string {
+	peer := r.RemoteAddr
+	if host, _, e := net.SplitHostPort(r.RemoteAddr); e == nil {
+		peer = host
+	}
+	rc := config.GetRC()
+	if !rc.IsTrustedProxy(net.ParseIP(peer)) {
+		return peer
+	}
+
+	var xff []string
+	for _, h := range r.Header[http.CanonicalHeaderKey("X-Forwarded-For")] {
+		for _, x := range strings.Split(h, ",") {
+			if x = strings.TrimSpace(x); net.ParseIP(x) != nil {
+				xff = append(xff, x)
+			}
+		}
+	}
+	for i := len(xff) - 1; i >= 0; i-- {
+		if !rc.IsTrustedProxy(net.ParseIP(xff[i])) || i == 0 {
+			return xff[i]
+		}
+	}
+	if x := strings.TrimSpace(r.Header.Get("X-Real-IP")); net.ParseIP(x) != nil {
+		return x
+	}
+	return peer
+}
+
+// Listener that accepts PROXY protocol v1/v2 header from trusted proxies,
+// RemoteAddr of the accepted connection is the source address in the header
+type proxyProtoListener struct {
+	net.Listener
+}
+
+func NewProxyProtoListener(l net.Listener) net.Listener {
+	return &proxyProtoListener{Listener: l}
+}
+
+func (l *proxyProtoListener) Accept() (net.Conn, error) {
+	c, e := l.Listener.Accept()
+	if e != nil {
+		return nil, e
+	}
+	return &proxyProtoConn{Conn: c, reader: bufio.NewReader(c)}, nil
+}
+
+// The header is parsed on the first call of RemoteAddr or Read, which is
+// in the goroutine of the connection, so a slow peer does not block Accept
+type proxyProtoConn struct {
+	net.Conn
+	reader     *bufio.Reader
+	once       sync.Once
+	remoteAddr net.Addr
+	err        error
+}
+
+func (c *proxyProtoConn) init() {
+	c.remoteAddr = c.Conn.RemoteAddr()
+	tcpAddr, ok := c.remoteAddr.(*net.TCPAddr)
+	if !ok || !config.GetRC().IsTrustedProxy(tcpAddr.IP) {
+		return
+	}
+	c.Conn.SetReadDeadline(time.Now().Add(PROXY_HEADER_TIMEOUT))
+	defer c.Conn.SetReadDeadline(time.Time{})
+
+	addr, e := ReadProxyHeader(c.reader)
+	if e != nil {
+		c.err = e
+		utils.ServerLogger.Warning("read PROXY header from %s error: %s", c.remoteAddr.String(), e.Error())
+		return
+	}
+	if addr != nil {
+		c.remoteAddr = addr
+	}
+}
+
+func (c *proxyProtoConn) Read(b []byte) (int, error) {
+	c.once.Do(c.init)
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+func (c *proxyProtoConn) RemoteAddr() net.Addr {
+	c.once.Do(c.init)
+	return c.remoteAddr
+}
+
+// Read PROXY protocol v1 or v2 header from r, a nil address is returned
+// when there is no header, or for "UNKNOWN"/LOCAL headers
+func ReadProxyHeader(r *bufio.Reader) (*net.TCPAddr, error) {
+	if b, e := r.Peek(len(proxyV1Prefix)); e == nil && bytes.Equal(b, proxyV1Prefix) {
+		return readProxyHeaderV1(r)
+	}
+	if b, e := r.Peek(len(proxyV2Sig)); e == nil && bytes.Equal(b, proxyV2Sig) {
+		return readProxyHeaderV2(r)
+	}
+	return nil, nil
+}
+
+// PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\n
+func readProxyHeaderV1(r *bufio.Reader) (*net.TCPAddr, error) {
+	line, e := r.ReadSlice('\n')
+	if e != nil {
+		return nil, errors.New("PROXY v1 header is longer than buffer or incomplete")
+	}
+	if len(line) > 107 || !bytes.HasSuffix(line, []byte("\r\n")) {
+		return nil, errors.New("invalid PROXY v1 header")
+	}
+	fields := strings.Fields(string(line[:len(line)-2]))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, errors.New("invalid PROXY v1 header: " + string(line))
+	}
+	ip := net.ParseIP(fields[2])
+	port, e := strconv.Atoi(fields[4])
+	if ip == nil || e != nil || port < 0 || port > 65535 {
+		return nil, errors.New("invalid PROXY v1 address: " + string(line))
+	}
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+func readProxyHeaderV2(r *bufio.Reader) (*net.TCPAddr, error) {
+	hdr := make([]byte, 16)
+	if _, e := io.ReadFull(r, hdr); e != nil {
+		return nil, e
+	}
+	verCmd, fam := hdr[12], hdr[13]
+	l := int(binary.BigEndian.Uint16(hdr[14:16]))
+	if verCmd>>4 != 2 {
+		return nil, errors.New("invalid PROXY v2 version")
+	}
+	body := make([]byte, l)
+	if _, e := io.ReadFull(r, body); e != nil {
+		return nil, e
+	}
+	if verCmd&0x0f == 0 {
+		// LOCAL, health check of the proxy itself
+		return nil, nil
+	}
+	switch fam >> 4 {
+	case 1:
+		if l < 12 {
+			return nil, errors.New("invalid PROXY v2 ipv4 address")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:4]), Port: int(binary.BigEndian.Uint16(body[8:10]))}, nil
+	case 2:
+		if l < 36 {
+			return nil, errors.New("invalid PROXY v2 ipv6 address")
+		}
+		return &net.TCPAddr{IP: net.IP(body[0:16]), Port: int(binary.BigEndian.Uint16(body[32:34]))}, nil
+	}
+	return nil, nil
+}
@@ -0,0 +1,227 @@
+package server
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"config"
+	"utils"
+)
+
+const (
+	DEFAULT_IPV4_PREFIX = 32
+	DEFAULT_IPV6_PREFIX = 64
+
+	// buckets not used for this long are removed
+	RATELIMIT_SWEEP_INTERVAL = time.Minute
+)
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// Token bucket rate limiter, one bucket per key
+type RateLimiter struct {
+	sync.Mutex
+	rate      float64
+	burst     float64
+	buckets   map[string]*tokenBucket
+	lastSweep time.Time
+	allowed   uint64
+	limited   uint64
+}
+
+func NewRateLimiter(rate float64, burst int) *RateLimiter {
+	if burst < 1 {
+		burst = int(math.Ceil(rate))
+	}
+	return &RateLimiter{
+		rate:      rate,
+		burst:     float64(burst),
+		buckets:   make(map[string]*tokenBucket),
+		lastSweep: time.Now(),
+	}
+}
+
+// Take one token of key, if there is none, return false and how long to
+// wait for the next token
+func (l *RateLimiter) Allow(key string, now time.Time) (bool, time.Duration) {
+	return l.AllowN(key, 1, now)
+}
+
+// Take n tokens of key. A cost over the burst is allowed with a full bucket
+// and leaves the bucket in debt, so large batches are slowed, not blocked
+func (l *RateLimiter) AllowN(key string, n int, now time.Time) (bool, time.Duration) {
+	l.Lock()
+	defer l.Unlock()
+	if now.Sub(l.lastSweep) > RATELIMIT_SWEEP_INTERVAL {
+		for k, b := range l.buckets {
+			// a bucket in debt is kept until the debt is paid
+			if idle := now.Sub(b.last); idle > RATELIMIT_SWEEP_INTERVAL && b.tokens+idle.Seconds()*l.rate >= 0 {
+				delete(l.buckets, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &tokenBucket{tokens: l.burst, last: now}
+		l.buckets[key] = b
+	}
+	if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens = math.Min(l.burst, b.tokens+elapsed*l.rate)
+		b.last = now
+	}
+	need := math.Min(float64(n), l.burst)
+	if b.tokens >= need {
+		b.tokens -= float64(n)
+		l.allowed++
+		return true, 0
+	}
+	l.limited++
+	return false, time.Duration((need - b.tokens) / l.rate * float64(time.Second))
+}
+
+type RateLimiterStats struct {
+	Rate    float64 `json:"rate"`
+	Burst   float64 `json:"burst"`
+	Buckets int     `json:"buckets"`
+	Allowed uint64  `json:"allowed"`
+	Limited uint64  `json:"limited"`
+}
+
+func (l *RateLimiter) Stats() RateLimiterStats {
+	l.Lock()
+	defer l.Unlock()
+	return RateLimiterStats{
+		Rate:    l.rate,
+		Burst:   l.burst,
+		Buckets: len(l.buckets),
+		Allowed: l.allowed,
+		Limited: l.limited,
+	}
+}
+
+// Limiters of the http api, replaced as a whole by InitRateLimiter. nil
+// when the limit is disabled
+type rateLimiters struct {
+	ip     *RateLimiter
+	client *RateLimiter
+}
+
+var currentLimiters atomic.Value // *rateLimiters
+
+func loadRateLimiters() *rateLimiters {
+	if x, ok := currentLimiters.Load().(*rateLimiters); ok {
+		return x
+	}
+	return &rateLimiters{}
+}
+
+// Limiter of the client networks, nil when the limit is disabled
+func IPLimiter() *RateLimiter {
+	return loadRateLimiters().ip
+}
+
+// Limiter of the client identifiers, nil when the limit is disabled
+func ClientLimiter() *RateLimiter {
+	return loadRateLimiters().client
+}
+
+// Swap the limiters for rc, a limiter whose rate and burst are not changed
+// is kept with its buckets
+func InitRateLimiter(rc *config.RateLimitConf) {
+	old, x := loadRateLimiters(), &rateLimiters{}
+	if rc != nil {
+		x.ip = keepRateLimiter(old.ip, rc.IPRate, rc.IPBurst)
+		x.client = keepRateLimiter(old.client, rc.ClientRate, rc.ClientBurst)
+	}
+	currentLimiters.Store(x)
+}
+
+// l if it has the same rate and burst, otherwise a new limiter
+func keepRateLimiter(l *RateLimiter, rate float64, burst int) *RateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	x := NewRateLimiter(rate, burst)
+	if l != nil && l.rate == x.rate && l.burst == x.burst {
+		return l
+	}
+	return x
+}
+
+// Key of the ip bucket, the network of ip with ipv4_prefix/ipv6_prefix
+func rateLimitIPKey(ip string) string {
+	x := net.ParseIP(ip)
+	if x == nil {
+		return ip
+	}
+	v4, v6 := DEFAULT_IPV4_PREFIX, DEFAULT_IPV6_PREFIX
+	if rc := config.GetRC().RateLimitConf; rc != nil {
+		if rc.IPv4Prefix > 0 && rc.IPv4Prefix <= 32 {
+			v4 = rc.IPv4Prefix
+		}
+		if rc.IPv6Prefix > 0 && rc.IPv6Prefix <= 128 {
+			v6 = rc.IPv6Prefix
+		}
+	}
+	if utils.IsIPv4(x) {
+		return x.Mask(net.CIDRMask(v4, 32)).String() + "/" + strconv.Itoa(v4)
+	}
+	return x.Mask(net.CIDRMask(v6, 128)).String() + "/" + strconv.Itoa(v6)
+}
+
+// Reject the request with 429 when the client network is over its limit.
+// One token is taken before the handler, the queries of the request are
+// charged by checkRateLimit after authentication
+func RateLimit(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if ipLimiter := IPLimiter(); ipLimiter != nil {
+			key := rateLimitIPKey(getClientIP(r))
+			if ok, wait := ipLimiter.Allow(key, time.Now()); !ok {
+				writeRateLimited(w, wait)
+				utils.ServerLogger.Info("rate limited, ip: %s url: %s", key, r.URL.String())
+				return
+			}
+		}
+		h(w, r)
+	}
+}
+
+// Charge the n domains of a query: n-1 more tokens of the client network,
+// whose first token was taken by RateLimit, and n tokens of the client id.
+// id must be authenticated, the empty id is not limited
+func checkRateLimit(w http.ResponseWriter, r *http.Request, id string, n int) bool {
+	now := time.Now()
+	if ipLimiter := IPLimiter(); ipLimiter != nil && n > 1 {
+		key := rateLimitIPKey(getClientIP(r))
+		if ok, wait := ipLimiter.AllowN(key, n-1, now); !ok {
+			writeRateLimited(w, wait)
+			utils.ServerLogger.Info("rate limited, ip: %s domains: %d", key, n)
+			return false
+		}
+	}
+	if clientLimiter := ClientLimiter(); clientLimiter != nil && id != "" {
+		if ok, wait := clientLimiter.AllowN(id, n, now); !ok {
+			writeRateLimited(w, wait)
+			utils.ServerLogger.Info("rate limited, client: %s domains: %d", id, n)
+			return false
+		}
+	}
+	return true
+}
+
+func writeRateLimited(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+	w.WriteHeader(http.StatusTooManyRequests)
+	fmt.Fprintln(w, "Too many requests")
+}
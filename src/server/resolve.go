@@ -0,0 +1,157 @@
+package server
+
+import (
+	"encoding/json"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+
+	"config"
+	"query"
+	"utils"
+)
+
+// JSON dns api in the application/dns-json schema,
+// /resolve?name=www.a.com[&type=A][&edns_client_subnet=1.2.3.0/24]
+const (
+	RESOLVE_PATH         = "/resolve"
+	RESOLVE_CONTENT_TYPE = "application/dns-json"
+)
+
+type RESOLVE_QUESTION struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+}
+
+type RESOLVE_ANSWER struct {
+	Name string `json:"name"`
+	Type uint16 `json:"type"`
+	TTL  uint32 `json:"TTL"`
+	Data string `json:"data"`
+}
+
+type RESOLVE_RESULT struct {
+	Status           int                `json:"Status"`
+	TC               bool               `json:"TC"`
+	RD               bool               `json:"RD"`
+	RA               bool               `json:"RA"`
+	AD               bool               `json:"AD"`
+	CD               bool               `json:"CD"`
+	Question         []RESOLVE_QUESTION `json:"Question"`
+	Answer           []RESOLVE_ANSWER   `json:"Answer,omitempty"`
+	EdnsClientSubnet string             `json:"edns_client_subnet,omitempty"`
+	Stale            bool               `json:"stale,omitempty"` // expired answers, the backends failed
+	Comment          string             `json:"Comment,omitempty"`
+}
+
+func HttpResolveServe(w http.ResponseWriter, r *http.Request) {
+	rc := config.GetRC()
+	name := r.URL.Query().Get("name")
+	if _, ok := dns.IsDomainName(name); !ok || name == "" {
+		writeResolveResult(w, http.StatusBadRequest, &RESOLVE_RESULT{
+			Status: dns.RcodeFormatError, Comment: "Error name: " + name,
+		})
+		return
+	}
+	name = dns.Fqdn(name)
+	qtype, ok := ParseResolveType(r.URL.Query().Get("type"))
+	if !ok {
+		writeResolveResult(w, http.StatusBadRequest, &RESOLVE_RESULT{
+			Status: dns.RcodeFormatError, Comment: "Error type: " + r.URL.Query().Get("type"),
+		})
+		return
+	}
+	x := &RESOLVE_RESULT{
+		RD:       true,
+		RA:       true,
+		CD:       r.URL.Query().Get("cd") == "1" || r.URL.Query().Get("cd") == "true",
+		Question: []RESOLVE_QUESTION{{Name: name, Type: qtype}},
+	}
+
+	srcIP := getClientIP(r)
+	var ecs *net.IPNet
+	if s := r.URL.Query().Get("edns_client_subnet"); s != "" {
+		nets, e := config.ParseCIDRs([]string{s})
+		if e != nil {
+			x.Status, x.Comment = dns.RcodeFormatError, "Error edns_client_subnet: "+s
+			writeResolveResult(w, http.StatusBadRequest, x)
+			return
+		}
+		ecs = nets[0]
+		srcIP = ecs.IP.String()
+	}
+
+	if qtype != dns.TypeA && qtype != dns.TypeAAAA {
+		x.Status = dns.RcodeNotImplemented
+		writeResolveResult(w, http.StatusOK, x)
+		return
+	}
+	if !rc.InWhiteList(name) {
+		x.Status = dns.RcodeRefused
+		writeResolveResult(w, http.StatusOK, x)
+		utils.ServerLogger.Info("Query for domain: %s is not permited", name)
+		return
+	}
+
+	utils.QueryLogger.Info("src ip: %s query_domain: %s type: %s resolve", srcIP, name, dns.TypeToString[qtype])
+	ok, result, e := query.GetRecordResult(name, srcIP, qtype)
+	if !ok {
+		x.Status = ErrorRcode(e)
+		if e != nil {
+			x.Comment = e.ErrorNo + ": " + e.Msg
+			utils.ServerLogger.Error("query domain: %s src_ip: %s  %s", name, srcIP, e.Error())
+		}
+		writeResolveResult(w, http.StatusOK, x)
+		return
+	}
+	x.Stale = result.Stale
+	for _, rr := range append(result.CNAME, result.RR...) {
+		x.Answer = append(x.Answer, RESOLVE_ANSWER{
+			Name: rr.Header().Name,
+			Type: rr.Header().Rrtype,
+			TTL:  result.TTL,
+			Data: GetRRData(rr),
+		})
+	}
+	if ecs != nil {
+		ones, _ := ecs.Mask.Size()
+		scope := result.Scope
+		if scope > ones {
+			scope = ones
+		}
+		x.EdnsClientSubnet = ecs.IP.String() + "/" + strconv.Itoa(scope)
+	}
+	writeResolveResult(w, http.StatusOK, x)
+}
+
+// A, AAAA, MX ... or the type number
+func ParseResolveType(t string) (uint16, bool) {
+	if t == "" {
+		return dns.TypeA, true
+	}
+	if n, e := strconv.ParseUint(t, 10, 16); e == nil && n > 0 {
+		return uint16(n), true
+	}
+	if n, ok := dns.StringToType[strings.ToUpper(t)]; ok {
+		return n, true
+	}
+	return dns.TypeNone, false
+}
+
+func writeResolveResult(w http.ResponseWriter, status int, x *RESOLVE_RESULT) {
+	if x.Question == nil {
+		x.Question = []RESOLVE_QUESTION{}
+	}
+	b, e := json.Marshal(x)
+	if e != nil {
+		utils.ServerLogger.Error("json.Marshal error: %s param: %v", e.Error(), x)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", RESOLVE_CONTENT_TYPE)
+	w.WriteHeader(status)
+	w.Write(b)
+}
@@ -1,6 +1,7 @@
 package server
 
 import (
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net"
@@ -12,6 +13,7 @@ import (
 
 	"github.com/miekg/dns"
 
+	"MyError"
 	"config"
 	"utils"
 )
@@ -25,6 +27,7 @@ type DispatcherClient struct {
 	Identifier string
 	Writer     http.ResponseWriter
 	Request    *http.Request
+	RC         *config.RuntimeConfiguration // taken once for the request
 }
 
 func (s *myHandler) ServerHttp(w http.ResponseWriter, r *http.Request) {
@@ -33,47 +36,96 @@ func (s *myHandler) ServerHttp(w http.ResponseWriter, r *http.Request) {
 	utils.ServerLogger.Debug("Request header: %s  RequestURI: %s  URI: %s", r.Header, r.RequestURI, r.URL)
 }
 
+// Dump the region trees of domain d, format=json or plain text lines of
+// REGION_ENTRY
 func RegionTraverServe(w http.ResponseWriter, r *http.Request) {
 	url_path := r.URL.Path
 	query_string := r.URL.Query().Get("d")
+	format := r.URL.Query().Get("format")
 
 	utils.QueryLogger.Info("query_domain: ", query_string, " url_path: ", url_path)
-	//fmt.Println(query_string)
-	//fmt.Println(url_path)
-	w.Write([]byte(r.RemoteAddr))
-	w.Write([]byte("\n"))
-
-	fmt.Fprintln(w, r.Header)
-	fmt.Fprintln(w, r.RequestURI)
-	//fmt.Println(w, r.URL)
 	t, e := query.DomainRRCache.GetDomainNodeFromCacheWithName(query_string)
-	if e == nil {
-		t.DomainRegionTree.TraverseRegionTree()
-	} else {
-		w.Write([]byte(e.Error()))
+	if e != nil {
+		status := ErrorStatus(e)
+		if IsJSONFormat(format) {
+			writeJSON(w, status, map[string]interface{}{"domain": query_string, "code": e.ErrorNo, "error": NewErrorBody(e)})
+		} else {
+			w.Header().Set("Content-Type", "text/plain")
+			w.WriteHeader(status)
+			fmt.Fprintln(w, e.ErrorNo+": "+e.Msg)
+		}
 		utils.ServerLogger.Error("query_domain: %s  url_path: %s is error: %s", query_string, url_path, e.Error())
+		return
 	}
 
+	regions := []*REGION_ENTRY{}
+	for _, tree := range []*query.RegionTree{t.DomainRegionTree, t.DomainRegionTreeAAAA} {
+		if tree == nil {
+			continue
+		}
+		for _, x := range tree.Regions() {
+			regions = append(regions, NewRegionEntry(x))
+		}
+	}
+	if IsJSONFormat(format) {
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"domain":  t.DomainName,
+			"regions": regions,
+		})
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(http.StatusOK)
+	for _, x := range regions {
+		fmt.Fprintln(w, x.String())
+	}
 }
 
+// Kept for the old load balancer configurations, see /healthz and /readyz
 func HttpHelloWorldServe(w http.ResponseWriter, r *http.Request) {
 	fmt.Fprintln(w, "hello, world!")
 	return
 }
 
 func HttpDispacherQueryServe(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get(ENCRYPT_PARAM) != "" {
+		HttpDispacherEncryptedQueryServe(w, r)
+		return
+	}
 	url_path := r.URL.Path
 	query_domain := r.URL.Query().Get("d")
 	srcIP := r.URL.Query().Get("ip")
-	if _, ok := dns.IsDomainName(query_domain); !ok {
+	format := r.URL.Query().Get("format")
+	qtype, ok := ParseQueryType(r.URL.Query().Get("type"))
+	if !ok {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintln(w, "Error query type: ", r.URL.Query().Get("type"))
+		return
+	}
+	rc := config.GetRC()
+	id, ok := checkAuth(w, r, rc, format, query_domain, srcIP)
+	if !ok {
+		return
+	}
+	// d=a.com,b.com is a batch query, every domain is checked by ResolveBatch
+	domains := strings.Split(query_domain, BATCH_DOMAIN_SEP)
+	if len(domains) > BATCH_MAX_DOMAINS {
+		w.WriteHeader(http.StatusBadRequest)
+		fmt.Fprintf(w, "Count of domains must be in [1, %d]\n", BATCH_MAX_DOMAINS)
+		return
+	}
+	if !checkRateLimit(w, r, id, len(domains)) {
+		return
+	}
+	isBatch := len(domains) > 1
+	if _, ok := dns.IsDomainName(query_domain); !isBatch && !ok {
 		fmt.Fprintln(w, "Error domain name: ", query_domain)
 		utils.ServerLogger.Info("error domain name : %s ", query_domain)
 		return
 	}
 
 	if srcIP == "" {
-		hp := strings.Split(r.RemoteAddr, ":")
-		srcIP = hp[0]
+		srcIP = getClientIP(r)
 	}
 	utils.QueryLogger.Info("src ip: %s query_domain: %s url_path: %s", string(srcIP), query_domain, url_path)
 	if x := net.ParseIP(srcIP); x == nil {
@@ -84,52 +136,169 @@ func HttpDispacherQueryServe(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	if config.InWhiteList(query_domain) {
-		ok, re, e := query.GetARecord(query_domain, srcIP)
+	if isBatch {
+		writeBatchResult(w, format, srcIP, ResolveBatch(rc, domains, srcIP, qtype))
+		return
+	}
+
+	if rc.InWhiteList(query_domain) {
+		ok, result, e := query.GetRecordResult(query_domain, srcIP, qtype)
 		if ok {
+			re, ttl := result.RR, result.TTL
+			if IsJSONFormat(format) {
+				rdata := NewResultWithFormat(format, query_domain, srcIP, CODE_OK, re)
+				if result.Stale {
+					SetStale(rdata)
+				}
+				writeJSON(w, http.StatusOK, rdata)
+				utils.ServerLogger.Debug("query result: %v ", rdata)
+				return
+			}
 			w.Header().Set("Content-Type", "text/plain")
 			w.WriteHeader(http.StatusOK)
+			if r.URL.Query().Get("ttl") == "1" {
+				line := FormatIPsWithTTL(re, ttl)
+				fmt.Fprintln(w, line)
+				utils.ServerLogger.Debug("query result: %s ", line)
+				return
+			}
 			for _, ree := range re {
-				if a, ok := ree.(*dns.A); ok {
-					fmt.Fprintln(w, a.A.String())
-					utils.ServerLogger.Debug("query result: %s ", a.A.String())
+				if ip, ok := GetRRIP(ree); ok {
+					fmt.Fprintln(w, ip.String())
+					utils.ServerLogger.Debug("query result: %s ", ip.String())
 				} else {
 					fmt.Fprintln(w, ree.String())
 					utils.ServerLogger.Debug("query result: %s ", ree.String())
 				}
 			}
 		} else if e != nil {
-			fmt.Fprintln(w, e.Error())
+			writeQueryError(w, format, query_domain, srcIP, e)
 			utils.ServerLogger.Error("query domain: %s src_ip: %s  %s", query_domain, srcIP, e.Error())
 		} else {
-			fmt.Fprintln(w, "unkown error!\n")
+			writeQueryError(w, format, query_domain, srcIP, MyError.NewError(MyError.ERROR_UNKNOWN, "unkown error!"))
 			utils.ServerLogger.Error("query domain: %s src_ip: %s fail unkown error!", query_domain, srcIP)
 		}
+	} else if IsJSONFormat(format) {
+		writeQueryError(w, format, query_domain, srcIP,
+			MyError.NewError(MyError.ERROR_FORBIDDEN, "Query for domain: "+query_domain+" is not permited"))
+		utils.ServerLogger.Info("Query for domain: %s is not permited", query_domain)
 	} else {
 		w.WriteHeader(http.StatusForbidden)
-		fmt.Fprintln(w, "Query for domain: "+query_domain+" is not permited\n")
+		fmt.Fprintln(w, "Query for domain: "+query_domain+" is not permited")
 		utils.ServerLogger.Info("Query for domain: %s is not permited", query_domain)
 		return
 	}
 }
 
+// type=A (default) or type=AAAA
+func ParseQueryType(t string) (uint16, bool) {
+	switch strings.ToUpper(t) {
+	case "", "A":
+		return dns.TypeA, true
+	case "AAAA":
+		return dns.TypeAAAA, true
+	}
+	return dns.TypeNone, false
+}
+
+// Runtime state of the server in json
+func HttpStatsServe(w http.ResponseWriter, r *http.Request) {
+	limiters := map[string]interface{}{}
+	if l := IPLimiter(); l != nil {
+		limiters["ip"] = l.Stats()
+	}
+	if l := ClientLimiter(); l != nil {
+		limiters["client"] = l.Stats()
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"ratelimit": limiters,
+		"refresh":   map[string]int{"queue": query.Refresher.Len(), "running": query.Refresher.Running()},
+	})
+}
+
+// Document the short keys of format=jsonz
+func JsonzMappingServe(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"version": JSONZ_VERSION,
+		"fields":  JSONZ_FIELDS,
+	})
+}
+
+// Write e as RDATA/RDATA_Z for json formats or as a "code: message" line,
+// with the status of ErrorStatus. The cause of e is not written
+func writeQueryError(w http.ResponseWriter, format string, domain, srcIP string, e *MyError.MyError) {
+	status := ErrorStatus(e)
+	if IsJSONFormat(format) {
+		writeJSON(w, status, NewErrorResultWithFormat(format, domain, srcIP, e))
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.WriteHeader(status)
+	fmt.Fprintln(w, e.ErrorNo+": "+e.Msg)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	b, e := json.Marshal(v)
+	if e != nil {
+		utils.ServerLogger.Error("json.Marshal error: %s param: %v", e.Error(), v)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	w.Write(b)
+}
+
 func Serve() {
+	rc := config.GetRC()
+	InitRateLimiter(rc.RateLimitConf)
+	query.InitRefresher(rc.RefreshConf)
+	query.InitCacheBudget(rc.CacheConf)
+	if e := query.OpenRegionDB(rc.RegionDB); e != nil {
+		utils.ServerLogger.Error(e.Error())
+	}
+	LoadSnapshot()
+	go SnapshotServe()
+	go AdminServe()
+	go DNSServe("udp")
+	go DNSServe("tcp")
 	mux := http.NewServeMux()
-	mux.HandleFunc("/q", HttpDispacherQueryServe)
+	mux.HandleFunc("/q", RateLimit(HttpDispacherQueryServe))
 	mux.HandleFunc("/t", RegionTraverServe)
 	mux.HandleFunc("/h", HttpHelloWorldServe)
+	mux.HandleFunc("/healthz", HttpHealthServe)
+	mux.HandleFunc("/readyz", HttpReadyServe)
+	mux.HandleFunc("/z", JsonzMappingServe)
+	mux.HandleFunc("/batch", RateLimit(HttpDispacherBatchServe))
+	mux.HandleFunc("/stats", HttpStatsServe)
+	mux.HandleFunc("/metrics", HttpMetricsServe)
+	mux.HandleFunc(DOH_PATH, RateLimit(HttpDNSQueryServe))
+	mux.HandleFunc(RESOLVE_PATH, RateLimit(HttpResolveServe))
+	handler := InstrumentMux(mux)
+	if rc.TLSBind != "" {
+		if rc.Bind == "" {
+			// https only
+			TLSServe(handler)
+			return
+		}
+		go TLSServe(handler)
+	}
 	server := &http.Server{
 		ReadTimeout:  10 * time.Second,
 		WriteTimeout: 10 * time.Second,
-		Handler:      mux,
+		Handler:      handler,
 	}
-	listener, err := net.Listen("tcp", config.RC.Bind)
+	listener, err := net.Listen("tcp", rc.Bind)
 	if nil != err {
 		utils.ServerLogger.Critical("Create listener error: %s", err.Error())
 		os.Exit(1)
 	}
+	if rc.ProxyProtocol {
+		listener = NewProxyProtoListener(listener)
+	}
 	defer listener.Close()
-	if err := server.Serve(listener); nil != err {
+	registerHTTPServer(server)
+	if err := server.Serve(listener); nil != err && err != http.ErrServerClosed {
 		utils.ServerLogger.Critical("Call server error: %s", err.Error())
 		os.Exit(1)
 	}
@@ -1 +1,1199 @@
 package server
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"MyError"
+	"config"
+	"query"
+)
+
+func TestRdataJSON(t *testing.T) {
+	rr := []dns.RR{
+		&dns.A{Hdr: dns.RR_Header{Name: "www.a.com.", Rrtype: dns.TypeA, Ttl: 60}, A: net.ParseIP("1.1.1.1")},
+		&dns.A{Hdr: dns.RR_Header{Name: "www.a.com.", Rrtype: dns.TypeA, Ttl: 60}, A: net.ParseIP("2.2.2.2")},
+	}
+	rdata := NewRdata("www.a.com.", "124.207.129.171", "", CODE_OK, nil)
+	rdata.AddDNSRRWithRR(rr)
+	b, e := json.Marshal(rdata)
+	if e != nil {
+		t.Fatal(e)
+	}
+	t.Log(string(b))
+	x := `{"domain":"www.a.com.","device_ip":"124.207.129.171","device_sp":"","code":"OK",` +
+		`"dns_rr":[{"priority":"0","ip":"1.1.1.1","ttl":"60"},{"priority":"1","ip":"2.2.2.2","ttl":"60"}]}`
+	if string(b) != x {
+		t.Fail()
+	}
+
+	b, _ = json.Marshal(NewRdata("www.a.com.", "124.207.129.171", "", "ERROR_NOTFOUND", nil))
+	t.Log(string(b))
+	if string(b) != `{"domain":"www.a.com.","device_ip":"124.207.129.171","device_sp":"","code":"ERROR_NOTFOUND","dns_rr":[]}` {
+		t.Fail()
+	}
+}
+
+func TestRdataZJSON(t *testing.T) {
+	rr := []dns.RR{
+		&dns.A{Hdr: dns.RR_Header{Name: "www.a.com.", Rrtype: dns.TypeA, Ttl: 60}, A: net.ParseIP("1.1.1.1")},
+	}
+	b, e := json.Marshal(NewResultWithFormat(FORMAT_JSONZ, "www.a.com.", "124.207.129.171", CODE_OK, rr))
+	if e != nil {
+		t.Fatal(e)
+	}
+	t.Log(string(b))
+	if string(b) != `{"v":3,"m":"www.a.com.","i":"124.207.129.171","s":"","c":"OK","d":[{"y":"0","p":"1.1.1.1","t":"60"}]}` {
+		t.Fail()
+	}
+	x := map[string]interface{}{}
+	json.Unmarshal(b, &x)
+	for k := range x {
+		if _, ok := JSONZ_FIELDS["rdata"][k]; !ok {
+			t.Log("key not documented in JSONZ_FIELDS: ", k)
+			t.Fail()
+		}
+	}
+}
+
+func TestResolveBatch(t *testing.T) {
+	config.SetRC(&config.RuntimeConfiguration{Domains: []string{"www.a.com."}})
+	re := ResolveBatch(config.GetRC(), []string{"a..com", "www.b.com"}, "124.207.129.171", dns.TypeA)
+	if len(re) != 2 {
+		t.Fatal(re)
+	}
+	if re[0].Domain != "a..com" || re[0].Code != MyError.ERROR_PARAM {
+		t.Log(re[0])
+		t.Fail()
+	}
+	if re[1].Domain != "www.b.com" || re[1].Code != MyError.ERROR_FORBIDDEN {
+		t.Log(re[1])
+		t.Fail()
+	}
+
+	req := httptest.NewRequest("POST", "/batch?format=jsonz", strings.NewReader(`{"domains":["www.b.com"],"ip":"1.2.3.4"}`))
+	w := httptest.NewRecorder()
+	HttpDispacherBatchServe(w, req)
+	t.Log(w.Body.String())
+	if w.Code != http.StatusOK || w.Body.String() != `[{"v":3,"m":"www.b.com","i":"1.2.3.4","s":"","c":"ERROR_FORBIDDEN","d":[],"e":"Query for domain: www.b.com is not permited"}]` {
+		t.Fail()
+	}
+	// failed domains carry the error body of /q
+	req = httptest.NewRequest("POST", "/batch", strings.NewReader(`{"domains":["www.b.com"],"ip":"1.2.3.4"}`))
+	w = httptest.NewRecorder()
+	HttpDispacherBatchServe(w, req)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"error":{"code":"ERROR_FORBIDDEN","status":403,"message":"Query for domain: www.b.com is not permited"}`) {
+		t.Log(w.Body.String())
+		t.Fail()
+	}
+
+	// too many domains are rejected by both apis, not truncated
+	domains := strings.TrimSuffix(strings.Repeat("www.b.com,", BATCH_MAX_DOMAINS+1), ",")
+	w = httptest.NewRecorder()
+	HttpDispacherQueryServe(w, httptest.NewRequest("GET", "/q?d="+domains+"&ip=1.2.3.4", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Log(w.Code, w.Body.String())
+		t.Fail()
+	}
+	b, _ := json.Marshal(&BatchRequest{Domains: strings.Split(domains, BATCH_DOMAIN_SEP), IP: "1.2.3.4"})
+	w = httptest.NewRecorder()
+	HttpDispacherBatchServe(w, httptest.NewRequest("POST", "/batch", bytes.NewReader(b)))
+	if w.Code != http.StatusBadRequest {
+		t.Log(w.Code, w.Body.String())
+		t.Fail()
+	}
+	if re := ResolveBatch(config.GetRC(), strings.Split(domains, BATCH_DOMAIN_SEP), "1.2.3.4", dns.TypeA); len(re) != BATCH_MAX_DOMAINS+1 {
+		t.Fail()
+	}
+}
+
+func TestGetClientIP(t *testing.T) {
+	config.SetRC(&config.RuntimeConfiguration{})
+	x := map[string]string{
+		"124.207.129.171:52341":  "124.207.129.171",
+		"[2001:db8::1]:52341":    "2001:db8::1",
+		"[::ffff:1.2.3.4]:52341": "::ffff:1.2.3.4",
+	}
+	for k, v := range x {
+		r := httptest.NewRequest("GET", "/q?d=www.a.com", nil)
+		r.RemoteAddr = k
+		if ip := getClientIP(r); ip != v {
+			t.Log(k, ip)
+			t.Fail()
+		}
+	}
+	if q, ok := ParseQueryType("aaaa"); !ok || q != dns.TypeAAAA {
+		t.Fail()
+	}
+	if _, ok := ParseQueryType("MX"); ok {
+		t.Fail()
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	config.SetRC(&config.RuntimeConfiguration{
+		AuthEnabled: true,
+		AuthConf: &config.AuthConf{
+			SignatureExpire: 60,
+			Clients:         []*config.ClientConf{{Identifier: "app", Secret: "secret"}},
+		},
+	})
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	old := strconv.FormatInt(time.Now().Unix()-120, 10)
+	sign := Signature("secret", "www.a.com", "1.2.3.4", now)
+
+	x := []struct {
+		url    string
+		status int
+	}{
+		{"/q?d=www.a.com&ip=1.2.3.4", http.StatusUnauthorized},
+		{"/q?d=www.a.com&ip=1.2.3.4&id=other&t=" + now + "&sign=" + sign, http.StatusForbidden},
+		{"/q?d=www.a.com&ip=1.2.3.5&id=app&t=" + now + "&sign=" + sign, http.StatusForbidden},
+		{"/q?d=www.a.com&ip=1.2.3.4&id=app&t=" + old + "&sign=" + Signature("secret", "www.a.com", "1.2.3.4", old), http.StatusUnauthorized},
+		{"/q?d=www.a.com&ip=1.2.3.4&id=app&t=" + now + "&sign=" + sign, http.StatusOK},
+		// replay
+		{"/q?d=www.a.com&ip=1.2.3.4&id=app&t=" + now + "&sign=" + sign, http.StatusForbidden},
+	}
+	for _, xx := range x {
+		r := httptest.NewRequest("GET", xx.url, nil)
+		c := NewDispatcherClient(httptest.NewRecorder(), r)
+		status, e := c.Authenticate(r.URL.Query().Get("d"), r.URL.Query().Get("ip"))
+		if status != xx.status {
+			t.Log(xx.url, status, e)
+			t.Fail()
+		}
+	}
+
+	// the fields are separated, a different split does not sign the same
+	if Signature("secret", "www.a.com", "1.2.3.4", now) == Signature("secret", "www.a.com1", ".2.3.4", now) ||
+		Signature("secret", "www.a.com", "", "1"+now) == Signature("secret", "www.a.com", "1", now) {
+		t.Fail()
+	}
+
+	// the client is checked with the configuration it was created with,
+	// a reload without [auth] in the middle does not affect it
+	t1 := strconv.FormatInt(time.Now().Unix()-1, 10)
+	r := httptest.NewRequest("GET", "/q?d=www.a.com&ip=1.2.3.4&id=app&t="+t1+"&sign="+Signature("secret", "www.a.com", "1.2.3.4", t1), nil)
+	c := NewDispatcherClient(httptest.NewRecorder(), r)
+	config.SetRC(&config.RuntimeConfiguration{AuthEnabled: true})
+	if status, e := c.Authenticate("www.a.com", "1.2.3.4"); status != http.StatusOK {
+		t.Log(status, e)
+		t.Fail()
+	}
+	c = NewDispatcherClient(httptest.NewRecorder(), r)
+	if status, _ := c.Authenticate("www.a.com", "1.2.3.4"); status != http.StatusForbidden {
+		t.Fail()
+	}
+}
+
+func TestEncryptedQuery(t *testing.T) {
+	key := "000102030405060708090a0b0c0d0e0f"
+	config.SetRC(&config.RuntimeConfiguration{
+		Domains: []string{"www.a.com."},
+		AuthConf: &config.AuthConf{
+			Clients: []*config.ClientConf{{Identifier: "app", AESKeys: []string{"ffeeddccbbaa99887766554433221100", key}}},
+		},
+	})
+	k, _ := hex.DecodeString(key)
+	d, _ := Encrypt(k, []byte("www.b.com"))
+	ip, _ := Encrypt(k, []byte("1.2.3.4"))
+
+	r := httptest.NewRequest("GET", "/q?enc=1&id=app&format=json&d="+d+"&ip="+ip, nil)
+	w := httptest.NewRecorder()
+	HttpDispacherQueryServe(w, r)
+	plain, e := Decrypt(k, w.Body.String())
+	t.Log(w.Code, string(plain), e)
+	if e != nil || w.Code != http.StatusForbidden ||
+		string(plain) != `{"domain":"www.b.com","device_ip":"1.2.3.4","device_sp":"","code":"ERROR_FORBIDDEN","dns_rr":[],`+
+			`"error":{"code":"ERROR_FORBIDDEN","status":403,"message":"Query for domain: www.b.com is not permited"}}` {
+		t.Fail()
+	}
+
+	// tampered domain
+	r = httptest.NewRequest("GET", "/q?enc=1&id=app&d=A"+d[1:], nil)
+	w = httptest.NewRecorder()
+	HttpDispacherQueryServe(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Fail()
+	}
+
+	// headers of the plain response are kept
+	InitRateLimiter(&config.RateLimitConf{IPRate: 1, IPBurst: 1})
+	defer InitRateLimiter(nil)
+	d, _ = Encrypt(k, []byte("www.a.com,www.b.com,www.c.com"))
+	for i := 0; i < 2; i++ {
+		r = httptest.NewRequest("GET", "/q?enc=1&id=app&d="+d, nil)
+		r.RemoteAddr = "5.6.7.8:1"
+		w = httptest.NewRecorder()
+		HttpDispacherQueryServe(w, r)
+	}
+	if w.Code != http.StatusTooManyRequests || w.Header().Get("Retry-After") == "" || w.Header().Get("Content-Type") != "text/plain" {
+		t.Log(w.Code, w.Header())
+		t.Fail()
+	}
+}
+
+func TestGetClientIPFromProxy(t *testing.T) {
+	nets, _ := config.ParseCIDRs([]string{"10.0.0.0/8", "2001:db8::1"})
+	config.SetRC(&config.RuntimeConfiguration{TrustedProxyNets: nets})
+	x := []struct {
+		remote, xff, xri, ip string
+	}{
+		{"1.1.1.1:1234", "2.2.2.2", "", "1.1.1.1"},
+		{"10.0.0.1:1234", "", "", "10.0.0.1"},
+		{"10.0.0.1:1234", "3.3.3.3, 2.2.2.2, 10.0.0.2", "", "2.2.2.2"},
+		{"10.0.0.1:1234", "10.0.0.3, 10.0.0.2", "", "10.0.0.3"},
+		{"10.0.0.1:1234", "", "4.4.4.4", "4.4.4.4"},
+		{"[2001:db8::1]:1234", "240e::1", "", "240e::1"},
+	}
+	for _, xx := range x {
+		r := httptest.NewRequest("GET", "/q?d=www.a.com", nil)
+		r.RemoteAddr = xx.remote
+		if xx.xff != "" {
+			r.Header.Set("X-Forwarded-For", xx.xff)
+		}
+		if xx.xri != "" {
+			r.Header.Set("X-Real-IP", xx.xri)
+		}
+		if ip := getClientIP(r); ip != xx.ip {
+			t.Log(xx, ip)
+			t.Fail()
+		}
+	}
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("PROXY TCP4 192.168.0.1 192.168.0.11 56324 443\r\nGET / HTTP/1.1\r\n"))
+	addr, e := ReadProxyHeader(r)
+	if e != nil || addr.String() != "192.168.0.1:56324" {
+		t.Log(addr, e)
+		t.Fail()
+	}
+	if l, _ := r.ReadString('\n'); l != "GET / HTTP/1.1\r\n" {
+		t.Fail()
+	}
+
+	v2 := []byte("\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x0c")
+	v2 = append(v2, 1, 2, 3, 4, 5, 6, 7, 8, 0x1f, 0x90, 0x01, 0xbb)
+	v2 = append(v2, []byte("GET")...)
+	r = bufio.NewReader(bytes.NewReader(v2))
+	addr, e = ReadProxyHeader(r)
+	if e != nil || addr.String() != "1.2.3.4:8080" {
+		t.Log(addr, e)
+		t.Fail()
+	}
+
+	r = bufio.NewReader(strings.NewReader("GET / HTTP/1.1\r\n"))
+	if addr, e = ReadProxyHeader(r); addr != nil || e != nil {
+		t.Fail()
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	config.SetRC(&config.RuntimeConfiguration{
+		RateLimitConf: &config.RateLimitConf{IPRate: 1, IPBurst: 2, IPv4Prefix: 24},
+	})
+	InitRateLimiter(config.GetRC().RateLimitConf)
+	h := RateLimit(func(w http.ResponseWriter, r *http.Request) {})
+	codes := []int{}
+	for _, remote := range []string{"1.2.3.4:1", "1.2.3.5:1", "1.2.3.6:1", "1.2.4.1:1"} {
+		r := httptest.NewRequest("GET", "/q?d=www.a.com", nil)
+		r.RemoteAddr = remote
+		w := httptest.NewRecorder()
+		h(w, r)
+		codes = append(codes, w.Code)
+		if w.Code == http.StatusTooManyRequests && w.Header().Get("Retry-After") != "1" {
+			t.Log(w.Header())
+			t.Fail()
+		}
+	}
+	if codes[0] != http.StatusOK || codes[1] != http.StatusOK || codes[2] != http.StatusTooManyRequests || codes[3] != http.StatusOK {
+		t.Log(codes)
+		t.Fail()
+	}
+	if s := IPLimiter().Stats(); s.Allowed != 3 || s.Limited != 1 || s.Buckets != 2 {
+		t.Log(s)
+		t.Fail()
+	}
+
+	l := NewRateLimiter(10, 1)
+	now := time.Now()
+	if ok, _ := l.Allow("x", now); !ok {
+		t.Fail()
+	}
+	if ok, wait := l.Allow("x", now); ok || wait != 100*time.Millisecond {
+		t.Log(wait)
+		t.Fail()
+	}
+	if ok, _ := l.Allow("x", now.Add(100*time.Millisecond)); !ok {
+		t.Fail()
+	}
+	// a cost over the burst needs a full bucket and leaves a debt
+	if ok, _ := l.AllowN("y", 3, now); !ok {
+		t.Fail()
+	}
+	if ok, wait := l.AllowN("y", 1, now); ok || wait != 300*time.Millisecond {
+		t.Log(wait)
+		t.Fail()
+	}
+
+	// the client bucket is charged per domain and only for a verified id
+	config.SetRC(&config.RuntimeConfiguration{
+		AuthEnabled: true,
+		AuthConf: &config.AuthConf{
+			SignatureExpire: 60,
+			Clients:         []*config.ClientConf{{Identifier: "app", Secret: "secret"}},
+		},
+		RateLimitConf: &config.RateLimitConf{IPRate: 1, IPBurst: 3, ClientRate: 1, ClientBurst: 3},
+	})
+	InitRateLimiter(config.GetRC().RateLimitConf)
+	h = RateLimit(HttpDispacherQueryServe)
+	codes = []int{}
+	for i, d := range []string{"www.a.com,www.b.com", "www.a.com,www.b.com,www.c.com", "www.a.com,www.b.com"} {
+		ts := strconv.FormatInt(time.Now().Unix()-int64(i), 10)
+		u := "/q?d=" + d + "&ip=1.2.3.4&id=app&t=" + ts + "&sign=" + Signature("secret", d, "1.2.3.4", ts)
+		if i == 1 {
+			u = "/q?d=" + d + "&ip=1.2.3.4&id=app&t=" + ts + "&sign=bad"
+		}
+		r := httptest.NewRequest("GET", u, nil)
+		r.RemoteAddr = "1.2.3." + strconv.Itoa(i) + ":1"
+		w := httptest.NewRecorder()
+		h(w, r)
+		codes = append(codes, w.Code)
+	}
+	if codes[0] != http.StatusOK || codes[1] != http.StatusForbidden || codes[2] != http.StatusTooManyRequests {
+		t.Log(codes)
+		t.Fail()
+	}
+	if s := ClientLimiter().Stats(); s.Allowed != 1 || s.Limited != 1 {
+		t.Log(s)
+		t.Fail()
+	}
+
+	// a reload keeps the limiters whose settings are not changed, and swaps
+	// the others while requests are served
+	ip, client := IPLimiter(), ClientLimiter()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			r := httptest.NewRequest("GET", "/q?d=www.a.com", nil)
+			h(httptest.NewRecorder(), r)
+		}
+	}()
+	InitRateLimiter(&config.RateLimitConf{IPRate: 1, IPBurst: 3, IPv4Prefix: 24, ClientRate: 2, ClientBurst: 3})
+	<-done
+	if IPLimiter() != ip || ClientLimiter() == client || ClientLimiter().Stats().Rate != 2 {
+		t.Fail()
+	}
+	InitRateLimiter(nil)
+	if IPLimiter() != nil || ClientLimiter() != nil {
+		t.Fail()
+	}
+}
+
+func TestFormatIPsWithTTL(t *testing.T) {
+	rr := []dns.RR{
+		&dns.A{Hdr: dns.RR_Header{Name: "www.a.com.", Rrtype: dns.TypeA, Ttl: 600}, A: net.ParseIP("1.1.1.1")},
+		&dns.A{Hdr: dns.RR_Header{Name: "www.a.com.", Rrtype: dns.TypeA, Ttl: 600}, A: net.ParseIP("2.2.2.2")},
+	}
+	if x := FormatIPsWithTTL(rr, 123); x != "1.1.1.1;2.2.2.2,123" {
+		t.Log(x)
+		t.Fail()
+	}
+}
+
+func TestRegionTraverServe(t *testing.T) {
+	query.InitCache()
+	d, _ := query.NewDomainNode("www.t.com", "t.com.", 600)
+	a := []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "www.t.com.", Rrtype: dns.TypeA, Ttl: 60}, A: net.ParseIP("1.1.1.1")}}
+	r1, _ := query.NewRegion(a, query.DefaultRadixNetaddr, query.DefaultRadixNetMask)
+	r2, _ := query.NewRegion(a, 0x01020300, 24)
+	d.DomainRegionTree.AddRegionToCache(r1)
+	d.DomainRegionTree.AddRegionToCache(r2)
+	query.DomainRRCache.StoreDomainNodeToCache(d)
+
+	w := httptest.NewRecorder()
+	RegionTraverServe(w, httptest.NewRequest("GET", "/t?d=www.t.com&format=json", nil))
+	var x struct {
+		Domain  string         `json:"domain"`
+		Regions []REGION_ENTRY `json:"regions"`
+	}
+	if e := json.Unmarshal(w.Body.Bytes(), &x); e != nil || len(x.Regions) != 2 {
+		t.Log(w.Body.String())
+		t.FailNow()
+	}
+	sources := map[string]string{}
+	for _, r := range x.Regions {
+		sources[r.Network] = r.Source
+		if r.Type != "A" || r.TTL != 60 || len(r.Answers) != 1 || r.Answers[0] != "1.1.1.1" {
+			t.Log(r)
+			t.Fail()
+		}
+	}
+	if sources["1.2.3.0/24"] != query.REGION_SOURCE_ECS || sources["128.0.0.0/1"] != query.REGION_SOURCE_DEFAULT {
+		t.Log(sources)
+		t.Fail()
+	}
+
+	w = httptest.NewRecorder()
+	RegionTraverServe(w, httptest.NewRequest("GET", "/t?d=www.t.com", nil))
+	if !strings.Contains(w.Body.String(), "1.2.3.0/24 A 1.1.1.1 60 ") {
+		t.Log(w.Body.String())
+		t.Fail()
+	}
+
+	w = httptest.NewRecorder()
+	RegionTraverServe(w, httptest.NewRequest("GET", "/t?d=www.none.com", nil))
+	if w.Code != http.StatusNotFound {
+		t.Log(w.Code, w.Body.String())
+		t.Fail()
+	}
+}
+
+func TestAdmin(t *testing.T) {
+	config.SetRC(&config.RuntimeConfiguration{
+		AuthConf: &config.AuthConf{
+			Clients: []*config.ClientConf{{Identifier: "app", Secret: "secret"}, {Identifier: "admin", Secret: "admin_secret"}},
+		},
+		AdminConf: &config.AdminConf{Bind: "127.0.0.1:0", Clients: []string{"admin"}},
+	})
+	query.InitCache()
+	d, _ := query.NewDomainNode("www.admin.com", "admin.com.", 600)
+	a := []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "www.admin.com.", Rrtype: dns.TypeA, Ttl: 60}, A: net.ParseIP("1.1.1.1")}}
+	r1, _ := query.NewRegion(a, query.DefaultRadixNetaddr, query.DefaultRadixNetMask)
+	r2, _ := query.NewRegion(a, 0x01020300, 24)
+	d.DomainRegionTree.AddRegionToCache(r1)
+	d.DomainRegionTree.AddRegionToCache(r2)
+	query.DomainRRCache.StoreDomainNodeToCache(d)
+	soa := &dns.SOA{Hdr: dns.RR_Header{Name: "admin.com.", Rrtype: dns.TypeSOA}}
+	query.DomainSOACache.StoreDomainSOANodeToCache(query.NewDomainSOANode(soa, nil))
+
+	mux := NewAdminMux()
+	// signatures can not be replayed, every request uses its own timestamp
+	do := func(i int, method, path, id, secret, domain, arg string) *httptest.ResponseRecorder {
+		now := strconv.FormatInt(time.Now().Unix()-int64(i), 10)
+		sign := AdminSignature(secret, method, strings.SplitN(path, "?", 2)[0], domain, arg, now)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest(method, path+"&id="+id+"&t="+now+"&sign="+sign, nil))
+		return w
+	}
+
+	// a signature of one action is not valid for another, nor is the
+	// signature of /q
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	for _, sign := range []string{
+		AdminSignature("admin_secret", "GET", "/admin/regions", "www.admin.com", "", now),
+		Signature("admin_secret", "www.admin.com", "", now),
+	} {
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, httptest.NewRequest("POST", "/admin/purge?d=www.admin.com&id=admin&t="+now+"&sign="+sign, nil))
+		if w.Code != http.StatusForbidden {
+			t.Log(w.Code, w.Body.String())
+			t.Fail()
+		}
+	}
+
+	x := []struct {
+		method, path, id, secret, domain, arg string
+		status                                int
+	}{
+		{"POST", "/admin/purge?d=www.admin.com", "app", "secret", "www.admin.com", "", http.StatusForbidden},
+		{"POST", "/admin/purge?d=www.admin.com", "admin", "secret", "www.admin.com", "", http.StatusForbidden},
+		{"GET", "/admin/purge?d=www.admin.com", "admin", "admin_secret", "www.admin.com", "", http.StatusMethodNotAllowed},
+		{"POST", "/admin/purge_prefix?d=www.admin.com&prefix=1.2.3.0/24", "admin", "admin_secret", "www.admin.com", "1.2.3.0/24", http.StatusOK},
+		{"POST", "/admin/purge_prefix?d=www.admin.com&prefix=1.2.3.0/24", "admin", "admin_secret", "www.admin.com", "1.2.3.0/24", http.StatusNotFound},
+		{"POST", "/admin/purge_prefix?d=www.admin.com&prefix=1.2.3", "admin", "admin_secret", "www.admin.com", "1.2.3", http.StatusBadRequest},
+		{"POST", "/admin/drop_soa?d=www.admin.com", "admin", "admin_secret", "www.admin.com", "", http.StatusOK},
+		{"POST", "/admin/drop_soa?d=admin.com", "admin", "admin_secret", "admin.com", "", http.StatusNotFound},
+		{"POST", "/admin/purge?d=www.admin.com", "admin", "admin_secret", "www.admin.com", "", http.StatusOK},
+		{"GET", "/admin/regions?d=www.admin.com", "admin", "admin_secret", "www.admin.com", "", http.StatusNotFound},
+	}
+	for i, xx := range x {
+		if w := do(i, xx.method, xx.path, xx.id, xx.secret, xx.domain, xx.arg); w.Code != xx.status {
+			t.Log(xx.method, xx.path, w.Code, w.Body.String())
+			t.Fail()
+		}
+	}
+	if rs := d.DomainRegionTree.Regions(); len(rs) != 1 || rs[0].Source != query.REGION_SOURCE_DEFAULT {
+		t.Log(rs)
+		t.Fail()
+	}
+}
+
+type testDNSWriter struct {
+	dns.ResponseWriter
+	remote net.Addr
+	msg    *dns.Msg
+}
+
+func (w *testDNSWriter) RemoteAddr() net.Addr {
+	return w.remote
+}
+
+func (w *testDNSWriter) WriteMsg(m *dns.Msg) error {
+	w.msg = m
+	return nil
+}
+
+func TestDNSQueryServe(t *testing.T) {
+	config.SetRC(&config.RuntimeConfiguration{Domains: []string{"www.dns.com."}})
+	query.InitCache()
+	d, _ := query.NewDomainNode("www.dns.com", "dns.com.", 600)
+	a := []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "www.dns.com.", Rrtype: dns.TypeA, Ttl: 60}, A: net.ParseIP("1.1.1.1")}}
+	r, _ := query.NewRegion(a, 0x01020000, 16)
+	d.DomainRegionTree.AddRegionToCache(r)
+	query.DomainRRCache.StoreDomainNodeToCache(d)
+
+	req := new(dns.Msg)
+	req.SetQuestion("www.dns.com.", dns.TypeA)
+	req.SetEdns0(4096, false)
+	req.IsEdns0().Option = append(req.IsEdns0().Option, &dns.EDNS0_SUBNET{
+		Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.ParseIP("1.2.3.4").To4(),
+	})
+	w := &testDNSWriter{remote: &net.UDPAddr{IP: net.ParseIP("5.6.7.8"), Port: 53}}
+	DNSQueryServe(w, req)
+	if w.msg == nil || w.msg.Rcode != dns.RcodeSuccess || len(w.msg.Answer) != 1 {
+		t.Log(w.msg)
+		t.FailNow()
+	}
+	if x, ok := w.msg.Answer[0].(*dns.A); !ok || !x.A.Equal(net.ParseIP("1.1.1.1")) || x.Hdr.Ttl > 60 {
+		t.Log(w.msg.Answer)
+		t.Fail()
+	}
+	var ecs *dns.EDNS0_SUBNET
+	if opt := w.msg.IsEdns0(); opt != nil {
+		for _, o := range opt.Option {
+			ecs, _ = o.(*dns.EDNS0_SUBNET)
+		}
+	}
+	if ecs == nil || ecs.SourceNetmask != 24 || ecs.SourceScope != 16 || !ecs.Address.Equal(net.ParseIP("1.2.3.4")) {
+		t.Log(w.msg)
+		t.Fail()
+	}
+
+	req = new(dns.Msg)
+	req.SetQuestion("www.other.com.", dns.TypeA)
+	DNSQueryServe(w, req)
+	if w.msg.Rcode != dns.RcodeRefused {
+		t.Log(w.msg)
+		t.Fail()
+	}
+	req.SetQuestion("www.dns.com.", dns.TypeMX)
+	DNSQueryServe(w, req)
+	if w.msg.Rcode != dns.RcodeNotImplemented {
+		t.Log(w.msg)
+		t.Fail()
+	}
+}
+
+func TestHttpDNSQueryServe(t *testing.T) {
+	config.SetRC(&config.RuntimeConfiguration{Domains: []string{"www.doh.com."}})
+	query.InitCache()
+	d, _ := query.NewDomainNode("www.doh.com", "doh.com.", 600)
+	a := []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "www.doh.com.", Rrtype: dns.TypeA, Ttl: 60}, A: net.ParseIP("1.1.1.1")}}
+	r, _ := query.NewRegion(a, 0x01020300, 24)
+	d.DomainRegionTree.AddRegionToCache(r)
+	query.DomainRRCache.StoreDomainNodeToCache(d)
+
+	req := new(dns.Msg)
+	req.SetQuestion("www.doh.com.", dns.TypeA)
+	b, _ := req.Pack()
+
+	check := func(w *httptest.ResponseRecorder) {
+		if w.Code != http.StatusOK || w.Header().Get("Content-Type") != DOH_CONTENT_TYPE {
+			t.Log(w.Code, w.Body.String())
+			t.FailNow()
+		}
+		m := new(dns.Msg)
+		if e := m.Unpack(w.Body.Bytes()); e != nil || m.Id != req.Id || len(m.Answer) != 1 {
+			t.Log(e, m)
+			t.FailNow()
+		}
+		if cc := w.Header().Get("Cache-Control"); cc != "private, max-age="+strconv.Itoa(int(m.Answer[0].Header().Ttl)) {
+			t.Log(cc, m.Answer)
+			t.Fail()
+		}
+	}
+
+	hr := httptest.NewRequest("GET", DOH_PATH+"?dns="+base64.RawURLEncoding.EncodeToString(b), nil)
+	hr.RemoteAddr = "1.2.3.4:1234"
+	w := httptest.NewRecorder()
+	HttpDNSQueryServe(w, hr)
+	check(w)
+
+	hr = httptest.NewRequest("POST", DOH_PATH, bytes.NewReader(b))
+	hr.Header.Set("Content-Type", DOH_CONTENT_TYPE)
+	hr.RemoteAddr = "1.2.3.4:1234"
+	w = httptest.NewRecorder()
+	HttpDNSQueryServe(w, hr)
+	check(w)
+
+	w = httptest.NewRecorder()
+	HttpDNSQueryServe(w, httptest.NewRequest("GET", DOH_PATH+"?dns=!!", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Log(w.Code)
+		t.Fail()
+	}
+	w = httptest.NewRecorder()
+	HttpDNSQueryServe(w, httptest.NewRequest("POST", DOH_PATH, bytes.NewReader(b)))
+	if w.Code != http.StatusUnsupportedMediaType {
+		t.Log(w.Code)
+		t.Fail()
+	}
+}
+
+func TestHttpResolveServe(t *testing.T) {
+	config.SetRC(&config.RuntimeConfiguration{Domains: []string{"www.res.com."}})
+	query.InitCache()
+	d, _ := query.NewDomainNode("www.res.com", "res.com.", 600)
+	c := []dns.RR{&dns.CNAME{Hdr: dns.RR_Header{Name: "www.res.com.", Rrtype: dns.TypeCNAME, Ttl: 300}, Target: "cdn.res.com."}}
+	r, _ := query.NewRegion(c, query.DefaultRadixNetaddr, query.DefaultRadixNetMask)
+	d.DomainRegionTree.AddRegionToCache(r)
+	query.DomainRRCache.StoreDomainNodeToCache(d)
+	cdn, _ := query.NewDomainNode("cdn.res.com", "res.com.", 600)
+	a := []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "cdn.res.com.", Rrtype: dns.TypeA, Ttl: 60}, A: net.ParseIP("1.1.1.1")}}
+	r, _ = query.NewRegion(a, 0x01020000, 16)
+	cdn.DomainRegionTree.AddRegionToCache(r)
+	query.DomainRRCache.StoreDomainNodeToCache(cdn)
+
+	w := httptest.NewRecorder()
+	HttpResolveServe(w, httptest.NewRequest("GET", "/resolve?name=www.res.com&type=A&edns_client_subnet=1.2.3.0/24", nil))
+	var x RESOLVE_RESULT
+	if e := json.Unmarshal(w.Body.Bytes(), &x); e != nil || w.Code != http.StatusOK || x.Status != dns.RcodeSuccess || len(x.Answer) != 2 {
+		t.Log(w.Code, w.Body.String())
+		t.FailNow()
+	}
+	if x.Answer[0].Type != dns.TypeCNAME || x.Answer[0].Data != "cdn.res.com." || x.Answer[1].Name != "cdn.res.com." || x.Answer[1].Data != "1.1.1.1" {
+		t.Log(x.Answer)
+		t.Fail()
+	}
+	if x.EdnsClientSubnet != "1.2.3.0/16" || w.Header().Get("Content-Type") != RESOLVE_CONTENT_TYPE {
+		t.Log(x.EdnsClientSubnet)
+		t.Fail()
+	}
+
+	for u, status := range map[string]int{
+		"/resolve?name=www.other.com":                           dns.RcodeRefused,
+		"/resolve?name=www.res.com&type=MX":                     dns.RcodeNotImplemented,
+		"/resolve?name=www.res.com&type=XX":                     dns.RcodeFormatError,
+		"/resolve?name=www.res.com&type=1&edns_client_subnet=x": dns.RcodeFormatError,
+	} {
+		w := httptest.NewRecorder()
+		HttpResolveServe(w, httptest.NewRequest("GET", u, nil))
+		var x RESOLVE_RESULT
+		if e := json.Unmarshal(w.Body.Bytes(), &x); e != nil || x.Status != status {
+			t.Log(u, w.Body.String())
+			t.Fail()
+		}
+	}
+}
+
+// Write a self signed certificate for names to dir, return the cert and key files
+func writeTestCert(t *testing.T, dir, file string, names ...string) (string, string) {
+	key, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: names[0]},
+		DNSNames:     names,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, e := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if e != nil {
+		t.Fatal(e)
+	}
+	kder, _ := x509.MarshalECPrivateKey(key)
+	certFile, keyFile := filepath.Join(dir, file+".crt"), filepath.Join(dir, file+".key")
+	ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: kder}), 0600)
+	return certFile, keyFile
+}
+
+func TestCertStore(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "httpdispacher_tls")
+	defer os.RemoveAll(dir)
+	c1, k1 := writeTestCert(t, dir, "default", "dns.a.com")
+	c2, k2 := writeTestCert(t, dir, "b", "*.b.com")
+	c3, k3 := writeTestCert(t, dir, "x", "x.b.com")
+	rc := &config.RuntimeConfiguration{TLSCert: c1, TLSKey: k1, TLSCerts: []*config.CertConf{{Cert: c2, Key: k2}, {Cert: c3, Key: k3}}}
+
+	s := &CertStore{}
+	if _, e := s.GetCertificate(&tls.ClientHelloInfo{}); e == nil {
+		t.Fail()
+	}
+	if e := s.Load(rc); e != nil {
+		t.Fatal(e)
+	}
+	// an exact name is preferred over a wildcard loaded before it
+	for name, want := range map[string]string{"dns.a.com": "dns.a.com", "X.b.com.": "x.b.com", "y.b.com": "*.b.com", "": "dns.a.com", "c.com": "dns.a.com"} {
+		c, e := s.GetCertificate(&tls.ClientHelloInfo{ServerName: name})
+		if e != nil || c.Leaf.DNSNames[0] != want {
+			t.Log(name, e)
+			t.Fail()
+		}
+	}
+
+	old, _ := s.GetCertificate(&tls.ClientHelloInfo{})
+	writeTestCert(t, dir, "default", "dns.a.com")
+	if e := s.Load(rc); e != nil {
+		t.Fatal(e)
+	}
+	if c, _ := s.GetCertificate(&tls.ClientHelloInfo{}); c.Leaf.SerialNumber.Cmp(old.Leaf.SerialNumber) == 0 {
+		t.Log("certificate is not reloaded")
+		t.Fail()
+	}
+	// a broken file keeps the loaded certificates
+	ioutil.WriteFile(c2, []byte("broken"), 0600)
+	if e := s.Load(rc); e == nil {
+		t.Fail()
+	}
+	if c, _ := s.GetCertificate(&tls.ClientHelloInfo{ServerName: "y.b.com"}); c == nil || c.Leaf.DNSNames[0] != "*.b.com" {
+		t.Fail()
+	}
+}
+
+func TestReload(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "httpdispacher_conf")
+	defer os.RemoveAll(dir)
+	config.ConfigFile = filepath.Join(dir, "httpdispacher.toml")
+	old := &config.RuntimeConfiguration{Bind: "127.0.0.1:8080", Domains: []string{"www.a.com."}, LogLevel: "WARNING"}
+	config.SetRC(old)
+
+	ioutil.WriteFile(config.ConfigFile, []byte("bind = \"127.0.0.1:8080\"\ndomains = [\"www.b.com.\"]\nlog_level = \"NOTHING\"\n"), 0600)
+	if e := Reload(); e == nil || config.GetRC() != old {
+		t.Log(e)
+		t.Fail()
+	}
+	ioutil.WriteFile(config.ConfigFile, []byte("bind = \"127.0.0.1:8080\"\ndomains = [\"www.b.com.\"]\nlog_level = \"INFO\"\n[ratelimit]\nip_rate = 5.0\n"), 0600)
+	if e := Reload(); e != nil || config.GetRC() == old {
+		t.Log(e)
+		t.FailNow()
+	}
+	if !config.InWhiteList("www.b.com") || config.InWhiteList("www.a.com") || IPLimiter() == nil {
+		t.Log(config.GetRC())
+		t.Fail()
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	config.SetRC(&config.RuntimeConfiguration{Domains: []string{"www.metrics.com."}})
+	query.InitCache()
+	d, _ := query.NewDomainNode("www.metrics.com", "metrics.com.", 600)
+	a := []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "www.metrics.com.", Rrtype: dns.TypeA, Ttl: 60}, A: net.ParseIP("1.1.1.1")}}
+	r, _ := query.NewRegion(a, 0x01020000, 16)
+	d.DomainRegionTree.AddRegionToCache(r)
+	query.DomainRRCache.StoreDomainNodeToCache(d)
+	if ok, _, _ := query.GetRecordResult("www.metrics.com.", "1.2.3.4", dns.TypeA); !ok {
+		t.FailNow()
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/h", HttpHelloWorldServe)
+	mux.HandleFunc("/metrics", HttpMetricsServe)
+	handler := InstrumentMux(mux)
+	for _, path := range []string{"/h", "/nothing", "/metrics"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/metrics", nil))
+	if w.Code != http.StatusOK || !strings.HasPrefix(w.Header().Get("Content-Type"), "text/plain; version=0.0.4") {
+		t.Fail()
+	}
+	samples := map[string]float64{}
+	for _, l := range strings.Split(w.Body.String(), "\n") {
+		if i := strings.LastIndex(l, " "); i > 0 && !strings.HasPrefix(l, "#") {
+			samples[l[:i]], _ = strconv.ParseFloat(l[i+1:], 64)
+		}
+	}
+	for k, min := range map[string]float64{
+		`httpdispacher_requests_total{endpoint="/h",status="200"}`:       1,
+		`httpdispacher_requests_total{endpoint="none",status="404"}`:     1,
+		`httpdispacher_requests_total{endpoint="/metrics",status="200"}`: 1,
+		`httpdispacher_cache_lookups_total{type="A",result="hit"}`:       1,
+		`httpdispacher_cache_domains`:                                    1,
+		`httpdispacher_cache_regions{type="A"}`:                          1,
+		`httpdispacher_cache_regions{type="AAAA"}`:                       0,
+		`httpdispacher_cache_soa`:                                        0,
+		`httpdispacher_refresh_queue`:                                    0,
+		`httpdispacher_refresh_running`:                                  0,
+		`httpdispacher_cache_entries`:                                    0,
+		`httpdispacher_cache_bytes`:                                      0,
+	} {
+		if v, ok := samples[k]; !ok || v < min {
+			t.Log(k, v, ok)
+			t.Fail()
+		}
+	}
+}
+
+func TestReadyChecks(t *testing.T) {
+	w := httptest.NewRecorder()
+	HttpHealthServe(w, httptest.NewRequest("GET", "/healthz", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"status":"ok"`) {
+		t.Fail()
+	}
+
+	x := RunReadyChecks([]ReadyCheck{
+		{Name: "ok", Check: func() (bool, error) { return true, nil }},
+		{Name: "skip", Check: func() (bool, error) { return false, nil }},
+		{Name: "slow", Check: func() (bool, error) { time.Sleep(time.Second); return true, nil }},
+	}, 100*time.Millisecond)
+	if x.Status != CHECK_FAIL || x.Checks[0].Status != CHECK_OK || x.Checks[1].Status != CHECK_SKIP ||
+		x.Checks[2].Status != CHECK_FAIL || x.Checks[2].Error != "timeout" {
+		t.Log(x)
+		t.Fail()
+	}
+	x = RunReadyChecks([]ReadyCheck{
+		{Name: "fail", Check: func() (bool, error) { return true, errors.New("down") }},
+	}, time.Second)
+	if x.Status != CHECK_FAIL || x.Checks[0].Error != "down" {
+		t.Log(x)
+		t.Fail()
+	}
+
+	// upstream probe against a local nameserver
+	pc, _ := net.ListenPacket("udp", "127.0.0.1:0")
+	ns := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(req)
+		w.WriteMsg(m)
+	})}
+	go ns.ActivateAndServe()
+	defer ns.Shutdown()
+	host, port, _ := net.SplitHostPort(pc.LocalAddr().String())
+	if ds, e := query.ProbeUpstream([]string{"127.0.0.2", host}, port, time.Second); e != nil || ds != host {
+		t.Log(ds, e)
+		t.Fail()
+	}
+	if _, e := query.ProbeUpstream(nil, port, time.Second); e == nil {
+		t.Fail()
+	}
+
+	config.SetRC(&config.RuntimeConfiguration{IPDB: "/nonexistent/ip.db"})
+	query.InitCache()
+	w = httptest.NewRecorder()
+	HttpReadyServe(w, httptest.NewRequest("GET", "/readyz", nil))
+	var result HEALTH_RESULT
+	if e := json.Unmarshal(w.Body.Bytes(), &result); e != nil || w.Code != http.StatusServiceUnavailable || len(result.Checks) != 4 {
+		t.Log(w.Body.String())
+		t.FailNow()
+	}
+	for _, c := range result.Checks {
+		want := map[string]string{"mysql": CHECK_SKIP, "ipdb": CHECK_FAIL, "cache": CHECK_OK}[c.Name]
+		if want != "" && c.Status != want {
+			t.Log(c)
+			t.Fail()
+		}
+	}
+}
+
+func TestWriteQueryError(t *testing.T) {
+	cause := errors.New("read udp 10.0.0.1:53: i/o timeout")
+	e := MyError.Wrap(MyError.ERROR_TIMEOUT, "Query timeout www.a.com.", cause)
+	if !strings.Contains(e.Error(), cause.Error()) {
+		t.Fail()
+	}
+
+	w := httptest.NewRecorder()
+	writeQueryError(w, FORMAT_JSON, "www.a.com.", "1.2.3.4", e)
+	if w.Code != http.StatusGatewayTimeout || w.Body.String() != `{"domain":"www.a.com.","device_ip":"1.2.3.4","device_sp":"","code":"ERROR_TIMEOUT","dns_rr":[],`+
+		`"error":{"code":"ERROR_TIMEOUT","status":504,"message":"Query timeout www.a.com."}}` {
+		t.Log(w.Code, w.Body.String())
+		t.Fail()
+	}
+	w = httptest.NewRecorder()
+	writeQueryError(w, FORMAT_JSONZ, "www.a.com.", "1.2.3.4", MyError.NewError(MyError.ERROR_UPSTREAM, "Query failed"))
+	if w.Code != http.StatusBadGateway || !strings.HasSuffix(w.Body.String(), `"c":"ERROR_UPSTREAM","d":[],"e":"Query failed"}`) {
+		t.Log(w.Code, w.Body.String())
+		t.Fail()
+	}
+	w = httptest.NewRecorder()
+	writeQueryError(w, FORMAT_TEXT, "www.a.com.", "1.2.3.4", e)
+	if w.Code != http.StatusGatewayTimeout || w.Body.String() != "ERROR_TIMEOUT: Query timeout www.a.com.\n" {
+		t.Log(w.Code, w.Body.String())
+		t.Fail()
+	}
+
+	for code, status := range map[string]int{
+		MyError.ERROR_NOTFOUND: 404, MyError.ERROR_NORESULT: 404, MyError.ERROR_PARAM: 400,
+		MyError.ERROR_UPSTREAM: 502, MyError.ERROR_CNAME: 500, "ERROR_NEW": 500,
+	} {
+		if ErrorStatus(MyError.NewError(code, "")) != status {
+			t.Log(code)
+			t.Fail()
+		}
+	}
+}
+
+// Nameserver on a local udp port answering with rcode[qname], the queries
+// of every name are counted
+type testNameserver struct {
+	sync.Mutex
+	server  *dns.Server
+	port    string
+	rcode   map[string]int
+	queries map[string]int
+}
+
+func startTestNameserver(rcode map[string]int) *testNameserver {
+	pc, _ := net.ListenPacket("udp", "127.0.0.1:0")
+	ns := &testNameserver{rcode: rcode, queries: map[string]int{}}
+	ns.server = &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, req *dns.Msg) {
+		q := req.Question[0]
+		ns.Lock()
+		ns.queries[q.Name]++
+		ns.Unlock()
+		m := new(dns.Msg)
+		m.SetRcode(req, ns.rcode[q.Name])
+		if m.Rcode == dns.RcodeNameError || m.Rcode == dns.RcodeSuccess {
+			m.Ns = []dns.RR{&dns.SOA{Hdr: dns.RR_Header{Name: "nx.com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 60},
+				Ns: "ns1.nx.com.", Mbox: "admin.nx.com.", Serial: 1, Expire: 600, Minttl: 60}}
+		}
+		w.WriteMsg(m)
+	})}
+	go ns.server.ActivateAndServe()
+	_, ns.port, _ = net.SplitHostPort(pc.LocalAddr().String())
+	return ns
+}
+
+func (ns *testNameserver) Queries(name string) int {
+	ns.Lock()
+	defer ns.Unlock()
+	return ns.queries[name]
+}
+
+func TestQueryNXDOMAIN(t *testing.T) {
+	ns := startTestNameserver(map[string]int{
+		"nx.nx.com.":     dns.RcodeNameError,
+		"nodata.nx.com.": dns.RcodeSuccess,
+		"fail.nx.com.":   dns.RcodeServerFailure,
+	})
+	defer ns.server.Shutdown()
+	port := query.NSServerPort
+	query.NSServerPort = ns.port
+	defer func() { query.NSServerPort = port }()
+
+	config.SetRC(&config.RuntimeConfiguration{Domains: []string{".nx.com"}})
+	query.InitCache()
+	soa := &dns.SOA{Hdr: dns.RR_Header{Name: "nx.com.", Rrtype: dns.TypeSOA}, Expire: 600}
+	query.DomainSOACache.StoreDomainSOANodeToCache(query.NewDomainSOANode(soa, []*dns.NS{{Ns: "127.0.0.1"}}))
+	for _, d := range []string{"nx.nx.com.", "nodata.nx.com.", "fail.nx.com."} {
+		dn, _ := query.NewDomainNode(d, "nx.com.", 600)
+		query.DomainRRCache.StoreDomainNodeToCache(dn)
+	}
+
+	for _, x := range []struct {
+		name    string
+		errno   string
+		status  int
+		rcode   int
+		queries int
+	}{
+		{"nx.nx.com.", MyError.ERROR_NOTFOUND, http.StatusNotFound, dns.RcodeNameError, 1},
+		{"nodata.nx.com.", MyError.ERROR_NORESULT, http.StatusNotFound, dns.RcodeSuccess, 1},
+		{"fail.nx.com.", MyError.ERROR_UPSTREAM, http.StatusBadGateway, dns.RcodeServerFailure, 0},
+	} {
+		ok, _, e := query.GetRecordResult(x.name, "1.2.3.4", dns.TypeA)
+		if ok || e == nil || e.ErrorNo != x.errno {
+			t.Log(x.name, e)
+			t.Fail()
+		}
+		// not retried by doQuery nor by GetRecordResult
+		if n := ns.Queries(x.name); x.queries > 0 && n != x.queries {
+			t.Log(x.name, n)
+			t.Fail()
+		}
+		w := httptest.NewRecorder()
+		HttpDispacherQueryServe(w, httptest.NewRequest("GET", "/q?d="+x.name+"&ip=1.2.3.4", nil))
+		if w.Code != x.status {
+			t.Log(x.name, w.Code, w.Body.String())
+			t.Fail()
+		}
+
+		req := new(dns.Msg)
+		req.SetQuestion(x.name, dns.TypeA)
+		dw := &testDNSWriter{remote: &net.UDPAddr{IP: net.ParseIP("1.2.3.4"), Port: 53}}
+		DNSQueryServe(dw, req)
+		if dw.msg == nil || dw.msg.Rcode != x.rcode || len(dw.msg.Answer) != 0 {
+			t.Log(x.name, dw.msg)
+			t.Fail()
+		}
+		w = httptest.NewRecorder()
+		HttpResolveServe(w, httptest.NewRequest("GET", "/resolve?name="+x.name+"&edns_client_subnet=1.2.3.4", nil))
+		var res RESOLVE_RESULT
+		if e := json.Unmarshal(w.Body.Bytes(), &res); e != nil || res.Status != x.rcode {
+			t.Log(x.name, w.Body.String())
+			t.Fail()
+		}
+	}
+}
+
+func TestServeStale(t *testing.T) {
+	config.SetRC(&config.RuntimeConfiguration{Domains: []string{"www.stale.com."}, ServeStale: 3600})
+	query.InitCache()
+	// nothing listens on the port of the nameserver of stale.com., the
+	// refetch fails
+	pc, _ := net.ListenPacket("udp", "127.0.0.1:0")
+	_, closed, _ := net.SplitHostPort(pc.LocalAddr().String())
+	pc.Close()
+	port := query.NSServerPort
+	query.NSServerPort = closed
+	defer func() { query.NSServerPort = port }()
+	soa := &dns.SOA{Hdr: dns.RR_Header{Name: "stale.com.", Rrtype: dns.TypeSOA}, Expire: 600}
+	query.DomainSOACache.StoreDomainSOANodeToCache(query.NewDomainSOANode(soa, []*dns.NS{{Ns: "127.0.0.1"}}))
+	d, _ := query.NewDomainNode("www.stale.com.", "stale.com.", 600)
+	a := []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "www.stale.com.", Rrtype: dns.TypeA, Ttl: 60}, A: net.ParseIP("1.1.1.1")}}
+	addExpired := func() *query.Region {
+		r, _ := query.NewRegion(a, query.DefaultRadixNetaddr, query.DefaultRadixNetMask)
+		r.UpdateTime = time.Now().Add(-time.Minute * 10)
+		d.DomainRegionTree.AddRegionToCache(r)
+		return r
+	}
+	r := addExpired()
+	query.DomainRRCache.StoreDomainNodeToCache(d)
+	if !r.Expired() || r.StaleFor() < 8*time.Minute {
+		t.FailNow()
+	}
+
+	ok, result, e := query.GetRecordResult("www.stale.com.", "1.2.3.4", dns.TypeA)
+	if !ok || e != nil || !result.Stale || result.TTL != query.STALE_ANSWER_TTL || len(result.RR) != 1 {
+		t.Log(result, e)
+		t.FailNow()
+	}
+	w := httptest.NewRecorder()
+	HttpDispacherQueryServe(w, httptest.NewRequest("GET", "/q?d=www.stale.com.&ip=1.2.3.4&format=json", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"stale":true`) {
+		t.Log(w.Code, w.Body.String())
+		t.Fail()
+	}
+
+	// outside the serve-stale window the region is removed
+	rc := *config.GetRC()
+	rc.ServeStale = 60
+	config.SetRC(&rc)
+	if ok, _, e := query.GetRecordResult("www.stale.com.", "1.2.3.4", dns.TypeA); ok || e == nil {
+		t.Fail()
+	}
+	if _, _, e := query.GetRegionFromCacheWithType("www.stale.com.", "1.2.3.4", dns.TypeA); e == nil || e.ErrorNo == MyError.ERROR_STALE {
+		t.Log(e)
+		t.Fail()
+	}
+
+	// NXDOMAIN and NODATA are answers, the expired region is removed
+	// instead of being served
+	config.SetRC(&config.RuntimeConfiguration{Domains: []string{"www.stale.com."}, ServeStale: 3600})
+	for _, rcode := range []int{dns.RcodeNameError, dns.RcodeSuccess} {
+		ns := startTestNameserver(map[string]int{"www.stale.com.": rcode})
+		query.NSServerPort = ns.port
+		addExpired()
+		if ok, result, e := query.GetRecordResult("www.stale.com.", "1.2.3.4", dns.TypeA); ok || e == nil {
+			t.Log(dns.RcodeToString[rcode], result, e)
+			t.Fail()
+		}
+		if _, _, e := query.GetRegionFromCacheWithType("www.stale.com.", "1.2.3.4", dns.TypeA); e == nil || e.ErrorNo == MyError.ERROR_STALE {
+			t.Log(dns.RcodeToString[rcode], e)
+			t.Fail()
+		}
+		ns.server.Shutdown()
+	}
+}
+
+func TestSnapshot(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "snapshot")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cache.snapshot")
+	config.SetRC(&config.RuntimeConfiguration{Domains: []string{"www.snapshot.com."}, SnapshotConf: &config.SnapshotConf{Path: path}})
+	query.InitCache()
+	LoadSnapshot() // no file yet
+
+	soa := &dns.SOA{Hdr: dns.RR_Header{Name: "snapshot.com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 600},
+		Ns: "ns.snapshot.com.", Mbox: "admin.snapshot.com.", Expire: 600}
+	query.DomainSOACache.StoreDomainSOANodeToCache(query.NewDomainSOANode(soa, []*dns.NS{
+		{Hdr: dns.RR_Header{Name: "snapshot.com.", Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 600}, Ns: "ns.snapshot.com."}}))
+	d, _ := query.NewDomainNode("www.snapshot.com.", "snapshot.com.", 600)
+	a := []dns.RR{&dns.A{Hdr: dns.RR_Header{Name: "www.snapshot.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP("1.1.1.1")}}
+	r, _ := query.NewRegion(a, 0x01020300, 24)
+	d.DomainRegionTree.AddRegionToCache(r)
+	expired, _ := query.NewRegion(a, 0x05060700, 24)
+	expired.UpdateTime = time.Now().Add(-time.Hour)
+	d.DomainRegionTree.AddRegionToCache(expired)
+	query.DomainRRCache.StoreDomainNodeToCache(d)
+	if e := SaveSnapshot(); e != nil {
+		t.Fatal(e)
+	}
+
+	query.PurgeDomain("www.snapshot.com.")
+	query.DropSOA("snapshot.com.")
+	LoadSnapshot()
+	// the expired region is discarded
+	if dn, e := query.DomainRRCache.GetDomainNodeFromCacheWithName("www.snapshot.com."); e != nil || len(dn.DomainRegionTree.Regions()) != 1 {
+		t.FailNow()
+	}
+	// the restored region is refreshed like a region of the backend
+	if !query.Refresher.Cancel(query.RefreshKey{Domain: "www.snapshot.com.", Qtype: dns.TypeA, Network: "1.2.3.0/24"}) {
+		t.Fail()
+	}
+	if ok, result, e := query.GetRecordResult("www.snapshot.com.", "1.2.3.4", dns.TypeA); !ok || e != nil || result.Stale ||
+		result.RR[0].(*dns.A).A.String() != "1.1.1.1" {
+		t.Log(result, e)
+		t.Fail()
+	}
+	if _, e := query.DomainSOACache.GetDomainSOANodeFromCacheWithDomainName("snapshot.com."); e != nil {
+		t.Fail()
+	}
+}
+
+func TestShutdown(t *testing.T) {
+	listener, _ := net.Listen("tcp", "127.0.0.1:0")
+	started, done := make(chan bool), make(chan error)
+	s := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started <- true
+		time.Sleep(100 * time.Millisecond)
+		w.Write([]byte("ok"))
+	})}
+	registerHTTPServer(s)
+	go func() { done <- s.Serve(listener) }()
+
+	var body []byte
+	got := make(chan bool)
+	go func() {
+		if resp, e := http.Get("http://" + listener.Addr().String()); e == nil {
+			body, _ = ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+		}
+		got <- true
+	}()
+	<-started
+	Shutdown(time.Second)
+	<-got
+	if e := <-done; e != http.ErrServerClosed || string(body) != "ok" || !isShuttingDown() {
+		t.Log(e, string(body))
+		t.Fail()
+	}
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"config"
+	"query"
+	"utils"
+)
+
+// Time for in-flight requests to finish on shutdown
+const SHUTDOWN_TIMEOUT = 30 * time.Second
+
+// Running servers, stopped by Shutdown
+var servers = struct {
+	sync.Mutex
+	http         []*http.Server
+	dns          []*dns.Server
+	shuttingDown bool
+}{}
+
+func registerHTTPServer(s *http.Server) {
+	servers.Lock()
+	servers.http = append(servers.http, s)
+	servers.Unlock()
+}
+
+func registerDNSServer(s *dns.Server) {
+	servers.Lock()
+	servers.dns = append(servers.dns, s)
+	servers.Unlock()
+}
+
+func isShuttingDown() bool {
+	servers.Lock()
+	defer servers.Unlock()
+	return servers.shuttingDown
+}
+
+// Stop accepting requests, wait for in-flight http requests within timeout,
+// drop the pending refreshes of the cache and save its snapshot
+func Shutdown(timeout time.Duration) {
+	servers.Lock()
+	servers.shuttingDown = true
+	httpServers, dnsServers := servers.http, servers.dns
+	servers.Unlock()
+
+	for _, s := range dnsServers {
+		if e := s.Shutdown(); e != nil {
+			utils.ServerLogger.Warning("shutdown dns server %s %s error: %s", s.Net, s.Addr, e.Error())
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, s := range httpServers {
+		wg.Add(1)
+		go func(s *http.Server) {
+			defer wg.Done()
+			if e := s.Shutdown(ctx); e != nil {
+				utils.ServerLogger.Warning("shutdown http server error: %s", e.Error())
+			}
+		}(s)
+	}
+	wg.Wait()
+
+	n := query.Refresher.Stop()
+	if e := SaveSnapshot(); e != nil {
+		utils.ServerLogger.Error(e.Error())
+	}
+	utils.ServerLogger.Info("server is shut down, %d pending refreshes are dropped", n)
+}
+
+// Load the configuration file again and apply it: whitelist, log level,
+// MySQL, region database, rate limits, refresh and cache limits, snapshot,
+// auth clients and tls certificates. The cache is kept, the listen addresses
+// are only changed by a restart. The current configuration is kept if the
+// file is invalid
+func Reload() error {
+	old, rc, e := config.ReloadConf()
+	if e != nil {
+		utils.ServerLogger.Error("reload configuration error: %s, keep the old one", e.Error())
+		return e
+	}
+	if e := utils.SetLogLevel(rc.LogLevel); e != nil {
+		utils.ServerLogger.Error("set log level %s error: %s", rc.LogLevel, e.Error())
+	}
+	if rc.MySQLEnabled && (!old.MySQLEnabled || !reflect.DeepEqual(old.MySQLConf, rc.MySQLConf)) {
+		if !query.SetMySQLConf(rc.MySQLConf) {
+			utils.ServerLogger.Error("connect mysql with the new configuration error")
+		}
+	}
+	// the region database may be rebuilt with the same path
+	if e := query.OpenRegionDB(rc.RegionDB); e != nil {
+		utils.ServerLogger.Error("%s, keep the old one", e.Error())
+	}
+	if !reflect.DeepEqual(old.CacheConf, rc.CacheConf) {
+		query.InitCacheBudget(rc.CacheConf)
+	}
+	if !reflect.DeepEqual(old.RefreshConf, rc.RefreshConf) {
+		query.InitRefresher(rc.RefreshConf)
+	}
+	if !reflect.DeepEqual(old.RateLimitConf, rc.RateLimitConf) {
+		InitRateLimiter(rc.RateLimitConf)
+	}
+	if rc.TLSBind != "" {
+		if e := TLSCerts.Load(rc); e != nil {
+			utils.ServerLogger.Error("reload tls certificates error: %s, keep the old ones", e.Error())
+		}
+	}
+	if old.Bind != rc.Bind || old.TLSBind != rc.TLSBind || old.DNSBind != rc.DNSBind {
+		utils.ServerLogger.Warning("listen addresses are changed, restart to apply them")
+	}
+	utils.ServerLogger.Info("configuration reloaded")
+	return nil
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"MyError"
+	"config"
+	"query"
+	"utils"
+)
+
+// Wait of SnapshotServe when the interval is not configured, so that a
+// reloaded configuration is applied
+const SNAPSHOT_CHECK_INTERVAL = time.Minute
+
+var snapshotLock sync.Mutex
+
+func snapshotPath() string {
+	if rc := config.GetRC().SnapshotConf; rc != nil {
+		return rc.Path
+	}
+	return ""
+}
+
+// Warm the cache with the snapshot of [snapshot], a missing file is not an
+// error
+func LoadSnapshot() {
+	path := snapshotPath()
+	if path == "" {
+		return
+	}
+	if e := query.LoadCacheSnapshot(path); e != nil {
+		if os.IsNotExist(e.Cause) {
+			utils.ServerLogger.Info("no cache snapshot %s, start with an empty cache", path)
+			return
+		}
+		utils.ServerLogger.Error("%s, start with an empty cache", e.Error())
+	}
+}
+
+// Save the cache to the snapshot of [snapshot], nothing is done if it is
+// not configured
+func SaveSnapshot() *MyError.MyError {
+	path := snapshotPath()
+	if path == "" {
+		return nil
+	}
+	snapshotLock.Lock()
+	defer snapshotLock.Unlock()
+	return query.SaveCacheSnapshot(path)
+}
+
+// Save the snapshot every interval of [snapshot] until shutdown
+func SnapshotServe() {
+	for {
+		wait := SNAPSHOT_CHECK_INTERVAL
+		rc := config.GetRC().SnapshotConf
+		if rc != nil && rc.Interval > 0 {
+			wait = time.Duration(rc.Interval) * time.Second
+		}
+		time.Sleep(wait)
+		if isShuttingDown() {
+			return
+		}
+		if rc := config.GetRC().SnapshotConf; rc == nil || rc.Interval <= 0 {
+			continue
+		}
+		if e := SaveSnapshot(); e != nil {
+			utils.ServerLogger.Error(e.Error())
+		}
+	}
+}
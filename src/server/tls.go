@@ -0,0 +1,107 @@
+package server
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"config"
+	"utils"
+)
+
+// Certificates of the tls listener, replaced as a whole by Load so that
+// handshakes in progress keep the old ones
+type CertStore struct {
+	sync.RWMutex
+	certs []*tls.Certificate // certs[0] is the default one
+}
+
+var TLSCerts = &CertStore{}
+
+// Load tls_cert/tls_key and tls_certs, the current certificates are kept
+// when any of them fails to load
+func (s *CertStore) Load(rc *config.RuntimeConfiguration) error {
+	pairs := []*config.CertConf{{Cert: rc.TLSCert, Key: rc.TLSKey}}
+	pairs = append(pairs, rc.TLSCerts...)
+	var certs []*tls.Certificate
+	for _, p := range pairs {
+		cert, e := tls.LoadX509KeyPair(p.Cert, p.Key)
+		if e != nil {
+			return errors.New("load certificate " + p.Cert + " error: " + e.Error())
+		}
+		if cert.Leaf, e = x509.ParseCertificate(cert.Certificate[0]); e != nil {
+			return errors.New("parse certificate " + p.Cert + " error: " + e.Error())
+		}
+		certs = append(certs, &cert)
+	}
+	s.Lock()
+	s.certs = certs
+	s.Unlock()
+	return nil
+}
+
+// tls.Config.GetCertificate, the first certificate with the SNI name in its
+// SANs, then the first one valid for it by a wildcard, or the default one
+func (s *CertStore) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	s.RLock()
+	defer s.RUnlock()
+	if len(s.certs) == 0 {
+		return nil, errors.New("no certificate is loaded")
+	}
+	if name := strings.TrimSuffix(strings.ToLower(hello.ServerName), "."); name != "" {
+		for _, c := range s.certs {
+			for _, x := range c.Leaf.DNSNames {
+				if strings.ToLower(x) == name {
+					return c, nil
+				}
+			}
+		}
+		for _, c := range s.certs {
+			if c.Leaf.VerifyHostname(name) == nil {
+				return c, nil
+			}
+		}
+	}
+	return s.certs[0], nil
+}
+
+// Https listener on tls_bind, it blocks like Serve. The certificates are
+// loaded again by Reload
+func TLSServe(handler http.Handler) {
+	rc := config.GetRC()
+	if e := TLSCerts.Load(rc); e != nil {
+		utils.ServerLogger.Critical("Load tls certificates error: %s", e.Error())
+		os.Exit(1)
+	}
+
+	server := &http.Server{
+		ReadTimeout:  10 * time.Second,
+		WriteTimeout: 10 * time.Second,
+		Handler:      handler,
+		TLSConfig: &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: TLSCerts.GetCertificate,
+		},
+	}
+	listener, err := net.Listen("tcp", rc.TLSBind)
+	if nil != err {
+		utils.ServerLogger.Critical("Create tls listener error: %s", err.Error())
+		os.Exit(1)
+	}
+	if rc.ProxyProtocol {
+		// the PROXY header is sent before the tls handshake
+		listener = NewProxyProtoListener(listener)
+	}
+	defer listener.Close()
+	registerHTTPServer(server)
+	if err := server.ServeTLS(listener, "", ""); nil != err && err != http.ErrServerClosed {
+		utils.ServerLogger.Critical("Call tls server error: %s", err.Error())
+		os.Exit(1)
+	}
+}
@@ -2,9 +2,241 @@
 package storage
 
 import (
-//	"fmt"
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"utils"
 )
 
+// Region database shared by the processes of a host: a read-only file of
+// IPv4 ranges and their region ids, built offline and memory-mapped.
+//
+//	header (32 bytes): magic, version (uint16), 0 (uint16), count (uint32),
+//	built time (unix seconds, int64), crc32 (IEEE) of the records, 0 (uint32)
+//	records (12 bytes): start ip, end ip, region id (uint32)
+//
+// Integers are big endian, records are sorted by start ip and do not
+// overlap
+
 const (
-	MMFILE = "ip_database"
+	MMFILE = "ip_database" // default file name
+
+	REGIONDB_MAGIC   = "HDREGNDB"
+	REGIONDB_VERSION = uint16(1)
+
+	regionDBHeaderSize = 32
+	regionDBRecordSize = 12
 )
+
+// Range of IPv4 addresses (inclusive) of a region, ips are
+// utils.Ip4ToInt32 values
+type RegionRange struct {
+	Start uint32
+	End   uint32
+	ID    uint32
+}
+
+type RegionDB struct {
+	data  []byte // the mapped file
+	recs  []byte // the records in data
+	count int
+	built time.Time
+}
+
+// Map the region database path, the file must not be changed in place, a
+// new one replaces it by rename
+func OpenRegionDB(path string) (*RegionDB, error) {
+	f, e := os.Open(path)
+	if e != nil {
+		return nil, e
+	}
+	defer f.Close()
+	fi, e := f.Stat()
+	if e != nil {
+		return nil, e
+	}
+	if fi.Size() < regionDBHeaderSize {
+		return nil, errors.New("region database " + path + " is too short")
+	}
+	data, e := syscall.Mmap(int(f.Fd()), 0, int(fi.Size()), syscall.PROT_READ, syscall.MAP_SHARED)
+	if e != nil {
+		return nil, e
+	}
+	db, e := newRegionDB(data)
+	if e != nil {
+		syscall.Munmap(data)
+		return nil, fmt.Errorf("region database %s: %s", path, e.Error())
+	}
+	return db, nil
+}
+
+func newRegionDB(data []byte) (*RegionDB, error) {
+	if string(data[:len(REGIONDB_MAGIC)]) != REGIONDB_MAGIC {
+		return nil, errors.New("not a region database")
+	}
+	if v := binary.BigEndian.Uint16(data[8:]); v != REGIONDB_VERSION {
+		return nil, fmt.Errorf("version %d is not supported, want %d", v, REGIONDB_VERSION)
+	}
+	count := int(binary.BigEndian.Uint32(data[12:]))
+	if len(data) != regionDBHeaderSize+count*regionDBRecordSize {
+		return nil, fmt.Errorf("size %d does not match %d records", len(data), count)
+	}
+	recs := data[regionDBHeaderSize:]
+	if crc32.ChecksumIEEE(recs) != binary.BigEndian.Uint32(data[24:]) {
+		return nil, errors.New("checksum mismatch")
+	}
+	return &RegionDB{
+		data:  data,
+		recs:  recs,
+		count: count,
+		built: time.Unix(int64(binary.BigEndian.Uint64(data[16:])), 0),
+	}, nil
+}
+
+// Region of ip, ok is false if no range has it. It does not allocate
+func (db *RegionDB) Lookup(ip uint32) (id, start, end uint32, ok bool) {
+	// the last range starting at or before ip
+	i, j := 0, db.count
+	for i < j {
+		h := int(uint(i+j) >> 1)
+		if binary.BigEndian.Uint32(db.recs[h*regionDBRecordSize:]) <= ip {
+			i = h + 1
+		} else {
+			j = h
+		}
+	}
+	if i == 0 {
+		return 0, 0, 0, false
+	}
+	r := db.recs[(i-1)*regionDBRecordSize:]
+	start, end, id = binary.BigEndian.Uint32(r), binary.BigEndian.Uint32(r[4:]), binary.BigEndian.Uint32(r[8:])
+	if ip > end {
+		return 0, 0, 0, false
+	}
+	return id, start, end, true
+}
+
+// Number of ranges
+func (db *RegionDB) Len() int {
+	return db.count
+}
+
+// When the database was built
+func (db *RegionDB) Built() time.Time {
+	return db.built
+}
+
+// Unmap the file, no lookup may be done after it
+func (db *RegionDB) Close() error {
+	if db.data == nil {
+		return nil
+	}
+	e := syscall.Munmap(db.data)
+	db.data, db.recs, db.count = nil, nil, 0
+	return e
+}
+
+// Sort ranges and check they are valid and do not overlap
+func SortRegionRanges(ranges []RegionRange) error {
+	sort.Slice(ranges, func(i, j int) bool { return ranges[i].Start < ranges[j].Start })
+	for i, r := range ranges {
+		if r.Start > r.End {
+			return fmt.Errorf("invalid range %s-%s", utils.Int32ToIP4(r.Start), utils.Int32ToIP4(r.End))
+		}
+		if i > 0 && r.Start <= ranges[i-1].End {
+			return fmt.Errorf("range %s-%s overlaps %s-%s", utils.Int32ToIP4(r.Start), utils.Int32ToIP4(r.End),
+				utils.Int32ToIP4(ranges[i-1].Start), utils.Int32ToIP4(ranges[i-1].End))
+		}
+	}
+	return nil
+}
+
+// Write the region database of ranges, see SortRegionRanges
+func WriteRegionDB(w io.Writer, ranges []RegionRange) error {
+	if e := SortRegionRanges(ranges); e != nil {
+		return e
+	}
+	recs := make([]byte, len(ranges)*regionDBRecordSize)
+	for i, r := range ranges {
+		b := recs[i*regionDBRecordSize:]
+		binary.BigEndian.PutUint32(b, r.Start)
+		binary.BigEndian.PutUint32(b[4:], r.End)
+		binary.BigEndian.PutUint32(b[8:], r.ID)
+	}
+	h := make([]byte, regionDBHeaderSize)
+	copy(h, REGIONDB_MAGIC)
+	binary.BigEndian.PutUint16(h[8:], REGIONDB_VERSION)
+	binary.BigEndian.PutUint32(h[12:], uint32(len(ranges)))
+	binary.BigEndian.PutUint64(h[16:], uint64(time.Now().Unix()))
+	binary.BigEndian.PutUint32(h[24:], crc32.ChecksumIEEE(recs))
+	if _, e := w.Write(h); e != nil {
+		return e
+	}
+	_, e := w.Write(recs)
+	return e
+}
+
+// Write the region database to path through a temporary file, the
+// processes which mapped the old file keep using it until they open path
+// again
+func BuildRegionDB(path string, ranges []RegionRange) error {
+	tmp := path + ".tmp"
+	f, e := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if e != nil {
+		return e
+	}
+	b := bufio.NewWriter(f)
+	if e = WriteRegionDB(b, ranges); e == nil {
+		if e = b.Flush(); e == nil {
+			e = f.Sync()
+		}
+	}
+	if ee := f.Close(); e == nil {
+		e = ee
+	}
+	if e != nil {
+		os.Remove(tmp)
+		return e
+	}
+	return os.Rename(tmp, path)
+}
+
+// Read ranges from lines of "start end id", ips are dotted or integers,
+// fields are separated by spaces, tabs or commas. Empty lines and lines
+// starting with # are skipped
+func ParseRegionRanges(r io.Reader) ([]RegionRange, error) {
+	var ranges []RegionRange
+	s := bufio.NewScanner(r)
+	for n := 1; s.Scan(); n++ {
+		l := strings.TrimSpace(s.Text())
+		if l == "" || strings.HasPrefix(l, "#") {
+			continue
+		}
+		f := strings.FieldsFunc(l, func(c rune) bool { return c == ' ' || c == '\t' || c == ',' })
+		if len(f) != 3 {
+			return nil, fmt.Errorf("line %d: want start, end and id", n)
+		}
+		var x [3]uint32
+		for i, v := range f {
+			if ip := utils.StrToIP(v); i < 2 && ip != nil && utils.IsIPv4(ip) {
+				x[i] = utils.Ip4ToInt32(ip)
+			} else if u, e := strconv.ParseUint(v, 10, 32); e == nil {
+				x[i] = uint32(u)
+			} else {
+				return nil, fmt.Errorf("line %d: invalid %s", n, v)
+			}
+		}
+		ranges = append(ranges, RegionRange{Start: x[0], End: x[1], ID: x[2]})
+	}
+	return ranges, s.Err()
+}
@@ -0,0 +1,97 @@
+package storage
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"utils"
+)
+
+func ip4(s string) uint32 {
+	return utils.Ip4ToInt32(utils.StrToIP(s))
+}
+
+func TestRegionDB(t *testing.T) {
+	dir, e := ioutil.TempDir("", "regiondb")
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, MMFILE)
+
+	ranges, e := ParseRegionRanges(strings.NewReader(`
+# start end id
+10.0.0.0	10.0.255.255	3
+1.0.0.0, 1.0.0.255, 1
+16843008 16843263 2
+`))
+	if e != nil {
+		t.Fatal(e)
+	}
+	if len(ranges) != 3 || ranges[2] != (RegionRange{Start: ip4("1.1.1.0"), End: ip4("1.1.1.255"), ID: 2}) {
+		t.Fatalf("parse ranges got %v", ranges)
+	}
+	if e := BuildRegionDB(path, ranges); e != nil {
+		t.Fatal(e)
+	}
+	db, e := OpenRegionDB(path)
+	if e != nil {
+		t.Fatal(e)
+	}
+	defer db.Close()
+	if db.Len() != 3 {
+		t.Fatalf("region database has %d ranges, want 3", db.Len())
+	}
+
+	for _, c := range []struct {
+		ip, start, end string
+		id             uint32
+		ok             bool
+	}{
+		{"1.0.0.0", "1.0.0.0", "1.0.0.255", 1, true},
+		{"1.1.1.1", "1.1.1.0", "1.1.1.255", 2, true},
+		{"10.0.255.255", "10.0.0.0", "10.0.255.255", 3, true},
+		{"0.255.255.255", "", "", 0, false},
+		{"1.0.1.0", "", "", 0, false},
+		{"10.1.0.0", "", "", 0, false},
+	} {
+		id, start, end, ok := db.Lookup(ip4(c.ip))
+		if ok != c.ok || id != c.id || (ok && (start != ip4(c.start) || end != ip4(c.end))) {
+			t.Errorf("lookup %s got %d %s-%s %v", c.ip, id, utils.Int32ToIP4(start), utils.Int32ToIP4(end), ok)
+		}
+	}
+	ip := ip4("10.0.1.1")
+	if n := testing.AllocsPerRun(100, func() { db.Lookup(ip) }); n != 0 {
+		t.Errorf("lookup allocates %v times", n)
+	}
+
+	overlap := append(ranges, RegionRange{Start: ip4("1.1.1.128"), End: ip4("1.1.2.0"), ID: 4})
+	if e := BuildRegionDB(path, overlap); e == nil {
+		t.Error("overlapping ranges are not rejected")
+	}
+	if _, e := ParseRegionRanges(strings.NewReader("1.0.0.0 1.0.0.255\n")); e == nil {
+		t.Error("line without id is not rejected")
+	}
+
+	// the mapping of an old file is kept after it is replaced
+	b, e := ioutil.ReadFile(path)
+	if e != nil {
+		t.Fatal(e)
+	}
+	b[len(b)-1] ^= 0xff
+	if e := ioutil.WriteFile(path+".bad", b, 0644); e != nil {
+		t.Fatal(e)
+	}
+	if e := os.Rename(path+".bad", path); e != nil {
+		t.Fatal(e)
+	}
+	if _, e := OpenRegionDB(path); e == nil {
+		t.Error("corrupted region database is opened")
+	}
+	if id, _, _, ok := db.Lookup(ip); !ok || id != 3 {
+		t.Errorf("lookup of the old mapping got %d %v", id, ok)
+	}
+}
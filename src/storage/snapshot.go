@@ -0,0 +1,354 @@
+package storage
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"utils"
+)
+
+// Snapshot of the cache in a binary file:
+//
+//	magic, version (uint16), time (unix nano)
+//	SOA entries: key, SOA record, NS records
+//	domain entries: name, SOA key, ttl, regions
+//	crc32 (IEEE) of all the bytes before it
+//
+// Integers are big endian, counts and lengths are uvarints, records are in
+// the dns wire format. Readers refuse other versions
+
+const (
+	SNAPSHOT_MAGIC   = "HDSNAPSH"
+	SNAPSHOT_VERSION = uint16(1)
+
+	maxSnapshotCount = 1 << 24 // entries of a list
+	maxSnapshotBytes = 1 << 16 // a string or a record
+)
+
+type SOAEntry struct {
+	Key string
+	SOA *dns.SOA
+	NS  []*dns.NS
+}
+
+// A region of a domain, Qtype is the region tree (A or AAAA) it is in
+type RegionEntry struct {
+	Qtype      uint16
+	Family     uint16
+	Addr       uint32
+	Addr6      utils.Uint128
+	Mask       int
+	TTL        uint32
+	UpdateTime time.Time
+	Source     string
+	RR         []dns.RR
+}
+
+// Whether the ttl of the region has run out at t
+func (r *RegionEntry) ExpiredAt(t time.Time) bool {
+	return !r.UpdateTime.Add(time.Duration(r.TTL) * time.Second).After(t)
+}
+
+type DomainEntry struct {
+	Name    string
+	SOAKey  string
+	TTL     uint32
+	Regions []*RegionEntry
+}
+
+type Snapshot struct {
+	Time    time.Time
+	SOA     []*SOAEntry
+	Domains []*DomainEntry
+}
+
+// Whether the records can be written to a snapshot and read back
+func PackableRR(rrs ...dns.RR) bool {
+	for _, rr := range rrs {
+		if rr == nil {
+			return false
+		}
+		b := make([]byte, dns.Len(rr)+64)
+		n, e := dns.PackRR(rr, b, 0, nil, false)
+		if e != nil {
+			return false
+		}
+		if _, _, e := dns.UnpackRR(b[:n], 0); e != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// Write s to path through a temporary file, so that the old snapshot is
+// kept if it fails
+func SaveSnapshot(path string, s *Snapshot) error {
+	tmp := path + ".tmp"
+	f, e := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if e != nil {
+		return e
+	}
+	if e = WriteSnapshot(f, s); e == nil {
+		e = f.Sync()
+	}
+	if ee := f.Close(); e == nil {
+		e = ee
+	}
+	if e != nil {
+		os.Remove(tmp)
+		return e
+	}
+	return os.Rename(tmp, path)
+}
+
+func LoadSnapshot(path string) (*Snapshot, error) {
+	f, e := os.Open(path)
+	if e != nil {
+		return nil, e
+	}
+	defer f.Close()
+	return ReadSnapshot(bufio.NewReader(f))
+}
+
+func WriteSnapshot(w io.Writer, s *Snapshot) error {
+	b := bufio.NewWriter(w)
+	sw := &snapshotWriter{w: b, crc: crc32.NewIEEE()}
+	sw.bytes([]byte(SNAPSHOT_MAGIC))
+	sw.uint(uint64(SNAPSHOT_VERSION), 2)
+	sw.uint(uint64(s.Time.UnixNano()), 8)
+
+	sw.uvarint(uint64(len(s.SOA)))
+	for _, x := range s.SOA {
+		sw.string(x.Key)
+		sw.rr(x.SOA)
+		sw.uvarint(uint64(len(x.NS)))
+		for _, ns := range x.NS {
+			sw.rr(ns)
+		}
+	}
+	sw.uvarint(uint64(len(s.Domains)))
+	for _, d := range s.Domains {
+		sw.string(d.Name)
+		sw.string(d.SOAKey)
+		sw.uint(uint64(d.TTL), 4)
+		sw.uvarint(uint64(len(d.Regions)))
+		for _, r := range d.Regions {
+			sw.uint(uint64(r.Qtype), 2)
+			sw.uint(uint64(r.Family), 2)
+			sw.uint(uint64(r.Addr), 4)
+			sw.uint(r.Addr6.Hi, 8)
+			sw.uint(r.Addr6.Lo, 8)
+			sw.uvarint(uint64(r.Mask))
+			sw.uint(uint64(r.TTL), 4)
+			sw.uint(uint64(r.UpdateTime.UnixNano()), 8)
+			sw.string(r.Source)
+			sw.uvarint(uint64(len(r.RR)))
+			for _, rr := range r.RR {
+				sw.rr(rr)
+			}
+		}
+	}
+	if sw.e != nil {
+		return sw.e
+	}
+	var crc [4]byte
+	binary.BigEndian.PutUint32(crc[:], sw.crc.Sum32())
+	if _, e := b.Write(crc[:]); e != nil {
+		return e
+	}
+	return b.Flush()
+}
+
+func ReadSnapshot(r io.Reader) (*Snapshot, error) {
+	sr := &snapshotReader{r: r, crc: crc32.NewIEEE()}
+	if magic := sr.bytes(len(SNAPSHOT_MAGIC)); sr.e == nil && string(magic) != SNAPSHOT_MAGIC {
+		return nil, errors.New("not a snapshot file")
+	}
+	if v := uint16(sr.uint(2)); sr.e == nil && v != SNAPSHOT_VERSION {
+		return nil, fmt.Errorf("snapshot version %d is not supported, want %d", v, SNAPSHOT_VERSION)
+	}
+	s := &Snapshot{Time: time.Unix(0, int64(sr.uint(8)))}
+
+	for i, n := 0, sr.count(); i < n; i++ {
+		x := &SOAEntry{Key: sr.string()}
+		x.SOA, _ = sr.rr().(*dns.SOA)
+		for j, m := 0, sr.count(); j < m; j++ {
+			if ns, ok := sr.rr().(*dns.NS); ok {
+				x.NS = append(x.NS, ns)
+			}
+		}
+		if sr.e == nil && x.SOA == nil {
+			sr.e = errors.New("no SOA record of " + x.Key)
+		}
+		s.SOA = append(s.SOA, x)
+	}
+	for i, n := 0, sr.count(); i < n; i++ {
+		d := &DomainEntry{Name: sr.string(), SOAKey: sr.string(), TTL: uint32(sr.uint(4))}
+		for j, m := 0, sr.count(); j < m; j++ {
+			x := &RegionEntry{
+				Qtype:  uint16(sr.uint(2)),
+				Family: uint16(sr.uint(2)),
+				Addr:   uint32(sr.uint(4)),
+				Addr6:  utils.Uint128{Hi: sr.uint(8), Lo: sr.uint(8)},
+				Mask:   sr.count(),
+				TTL:    uint32(sr.uint(4)),
+			}
+			x.UpdateTime = time.Unix(0, int64(sr.uint(8)))
+			x.Source = sr.string()
+			for k, l := 0, sr.count(); k < l; k++ {
+				if rr := sr.rr(); rr != nil {
+					x.RR = append(x.RR, rr)
+				}
+			}
+			d.Regions = append(d.Regions, x)
+		}
+		s.Domains = append(s.Domains, d)
+	}
+	if sr.e != nil {
+		return nil, sr.e
+	}
+	sum := sr.crc.Sum32()
+	var crc [4]byte
+	if _, e := io.ReadFull(r, crc[:]); e != nil {
+		return nil, e
+	}
+	if binary.BigEndian.Uint32(crc[:]) != sum {
+		return nil, errors.New("snapshot checksum mismatch")
+	}
+	return s, nil
+}
+
+// Writer keeping the first error
+type snapshotWriter struct {
+	w   io.Writer
+	crc hash.Hash32
+	e   error
+}
+
+func (w *snapshotWriter) bytes(b []byte) {
+	if w.e != nil {
+		return
+	}
+	if _, w.e = w.w.Write(b); w.e == nil {
+		w.crc.Write(b)
+	}
+}
+
+// v in n bytes
+func (w *snapshotWriter) uint(v uint64, n int) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	w.bytes(b[8-n:])
+}
+
+func (w *snapshotWriter) uvarint(v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	w.bytes(b[:binary.PutUvarint(b[:], v)])
+}
+
+func (w *snapshotWriter) string(s string) {
+	w.uvarint(uint64(len(s)))
+	w.bytes([]byte(s))
+}
+
+func (w *snapshotWriter) rr(rr dns.RR) {
+	if w.e != nil {
+		return
+	}
+	b := make([]byte, dns.Len(rr)+64)
+	n, e := dns.PackRR(rr, b, 0, nil, false)
+	if e != nil {
+		w.e = fmt.Errorf("pack %s error: %s", rr.String(), e.Error())
+		return
+	}
+	w.uvarint(uint64(n))
+	w.bytes(b[:n])
+}
+
+// Reader keeping the first error
+type snapshotReader struct {
+	r   io.Reader
+	crc hash.Hash32
+	e   error
+}
+
+func (r *snapshotReader) bytes(n int) []byte {
+	if r.e != nil {
+		return nil
+	}
+	b := make([]byte, n)
+	if _, r.e = io.ReadFull(r.r, b); r.e != nil {
+		return nil
+	}
+	r.crc.Write(b)
+	return b
+}
+
+func (r *snapshotReader) uint(n int) uint64 {
+	var b [8]byte
+	copy(b[8-n:], r.bytes(n))
+	return binary.BigEndian.Uint64(b[:])
+}
+
+func (r *snapshotReader) ReadByte() (byte, error) {
+	b := r.bytes(1)
+	if r.e != nil {
+		return 0, r.e
+	}
+	return b[0], nil
+}
+
+func (r *snapshotReader) uvarint() uint64 {
+	v, e := binary.ReadUvarint(r)
+	if r.e == nil {
+		r.e = e
+	}
+	return v
+}
+
+// A count or length, which is limited so that a corrupted file can not
+// allocate too much
+func (r *snapshotReader) count() int {
+	v := r.uvarint()
+	if r.e == nil && v > maxSnapshotCount {
+		r.e = fmt.Errorf("invalid count %d in snapshot", v)
+	}
+	if r.e != nil {
+		return 0
+	}
+	return int(v)
+}
+
+func (r *snapshotReader) string() string {
+	n := r.count()
+	if r.e == nil && n > maxSnapshotBytes {
+		r.e = fmt.Errorf("invalid string length %d in snapshot", n)
+	}
+	return string(r.bytes(n))
+}
+
+func (r *snapshotReader) rr() dns.RR {
+	n := r.count()
+	if r.e == nil && n > maxSnapshotBytes {
+		r.e = fmt.Errorf("invalid record length %d in snapshot", n)
+	}
+	b := r.bytes(n)
+	if r.e != nil {
+		return nil
+	}
+	rr, _, e := dns.UnpackRR(b, 0)
+	if e != nil {
+		r.e = fmt.Errorf("unpack record error: %s", e.Error())
+		return nil
+	}
+	return rr
+}
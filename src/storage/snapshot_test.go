@@ -0,0 +1,78 @@
+package storage
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+
+	"utils"
+)
+
+func TestSnapshot(t *testing.T) {
+	now := time.Unix(0, time.Now().UnixNano())
+	soa := &dns.SOA{Hdr: dns.RR_Header{Name: "a.com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 600},
+		Ns: "ns1.a.com.", Mbox: "admin.a.com.", Serial: 1, Expire: 3600}
+	ns := &dns.NS{Hdr: dns.RR_Header{Name: "a.com.", Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: 600}, Ns: "ns1.a.com."}
+	a := &dns.A{Hdr: dns.RR_Header{Name: "www.a.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 60}, A: net.ParseIP("1.1.1.1")}
+	aaaa := &dns.AAAA{Hdr: dns.RR_Header{Name: "www.a.com.", Rrtype: dns.TypeAAAA, Class: dns.ClassINET, Ttl: 60}, AAAA: net.ParseIP("2001:db8::1")}
+	s := &Snapshot{
+		Time: now,
+		SOA:  []*SOAEntry{{Key: "a.com.", SOA: soa, NS: []*dns.NS{ns}}},
+		Domains: []*DomainEntry{{Name: "www.a.com.", SOAKey: "a.com.", TTL: 3600, Regions: []*RegionEntry{
+			{Qtype: dns.TypeA, Family: 1, Addr: 0x01020300, Mask: 24, TTL: 60, UpdateTime: now, Source: "ecs", RR: []dns.RR{a}},
+			{Qtype: dns.TypeAAAA, Family: 2, Addr6: utils.Uint128{Hi: 0x20010db8 << 32}, Mask: 56, TTL: 60,
+				UpdateTime: now.Add(-time.Hour), Source: "ecs", RR: []dns.RR{aaaa}},
+		}}},
+	}
+	var b bytes.Buffer
+	if e := WriteSnapshot(&b, s); e != nil {
+		t.Fatal(e)
+	}
+	x, e := ReadSnapshot(bytes.NewReader(b.Bytes()))
+	if e != nil {
+		t.Fatal(e)
+	}
+	if !x.Time.Equal(now) || len(x.SOA) != 1 || x.SOA[0].SOA.String() != soa.String() || x.SOA[0].NS[0].String() != ns.String() ||
+		len(x.Domains) != 1 || len(x.Domains[0].Regions) != 2 {
+		t.Log(x)
+		t.FailNow()
+	}
+	r4, r6 := x.Domains[0].Regions[0], x.Domains[0].Regions[1]
+	if r4.Addr != 0x01020300 || r4.Mask != 24 || r4.RR[0].String() != a.String() || r4.ExpiredAt(now) ||
+		r6.Addr6 != s.Domains[0].Regions[1].Addr6 || r6.RR[0].String() != aaaa.String() || !r6.ExpiredAt(now) {
+		t.Log(r4, r6)
+		t.Fail()
+	}
+
+	// a corrupted file or another version is refused
+	c := append([]byte(nil), b.Bytes()...)
+	c[len(c)-10] ^= 0xff
+	if _, e := ReadSnapshot(bytes.NewReader(c)); e == nil {
+		t.Fail()
+	}
+	c = append([]byte(nil), b.Bytes()...)
+	c[len(SNAPSHOT_MAGIC)+1]++
+	if _, e := ReadSnapshot(bytes.NewReader(c)); e == nil {
+		t.Fail()
+	}
+	if _, e := ReadSnapshot(bytes.NewReader(b.Bytes()[:b.Len()/2])); e == nil {
+		t.Fail()
+	}
+
+	dir, _ := ioutil.TempDir("", "snapshot")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cache.snapshot")
+	if e := SaveSnapshot(path, s); e != nil {
+		t.Fatal(e)
+	}
+	if x, e := LoadSnapshot(path); e != nil || len(x.Domains) != 1 {
+		t.Log(e)
+		t.Fail()
+	}
+}
@@ -17,6 +17,10 @@ import (
 var QueryLogger = logging.MustGetLogger("query")
 var ServerLogger = logging.MustGetLogger("server")
 
+// Backends and files set by InitLogger, for SetLogLevel and CloseLogger
+var logBackends []logging.LeveledBackend
+var logFiles []*os.File
+
 func GetDebugLine() string {
 	_, file, line, ok := runtime.Caller(1)
 	if ok {
@@ -38,17 +42,18 @@ func CheckIPv4(ip string) {
 }
 
 func InitLogger() {
-	qfd := createLog(config.RC.QueryLog)
-	sfd := createLog(config.RC.ServerLog)
+	rc := config.GetRC()
+	qfd := createLog(rc.QueryLog)
+	sfd := createLog(rc.ServerLog)
 
-	loglevel, e := logging.LogLevel(config.RC.LogLevel)
+	loglevel, e := logging.LogLevel(rc.LogLevel)
 	if e != nil {
-		fmt.Println("Translate LogLevel fail loglevel: ", config.RC.LogLevel, " error: ", e.Error())
+		fmt.Println("Translate LogLevel fail loglevel: ", rc.LogLevel, " error: ", e.Error())
 		os.Exit(1)
 	}
 
-	querylogformat := getLogFormat(config.RC.QueryLogFormat)
-	serverlogformat := getLogFormat(config.RC.ServerLogFormat)
+	querylogformat := getLogFormat(rc.QueryLogFormat)
+	serverlogformat := getLogFormat(rc.ServerLogFormat)
 
 	backend1 := logging.NewLogBackend(qfd, "", 0)
 	backend2 := logging.NewLogBackend(sfd, "", 0)
@@ -64,6 +69,29 @@ func InitLogger() {
 
 	QueryLogger.SetBackend(backend1Leveled)
 	ServerLogger.SetBackend(backend2Leveled)
+	logBackends = []logging.LeveledBackend{backend1Leveled, backend2Leveled}
+	logFiles = []*os.File{qfd, sfd}
+}
+
+// Change the level of QueryLogger and ServerLogger
+func SetLogLevel(level string) error {
+	loglevel, e := logging.LogLevel(level)
+	if e != nil {
+		return e
+	}
+	for _, b := range logBackends {
+		b.SetLevel(loglevel, "")
+	}
+	return nil
+}
+
+// Flush and close the log files, called before exit
+func CloseLogger() {
+	for _, fd := range logFiles {
+		fd.Sync()
+		fd.Close()
+	}
+	logFiles = nil
 }
 
 func createLog(logname string) *os.File {
@@ -101,9 +129,12 @@ func NetworkRange(network *net.IPNet) (net.IP, net.IP) {
 	return firstIP, lastIP
 }
 
-// Converts a 4 bytes IP into a 32 bit integer
+// Converts a 4 bytes IP into a 32 bit integer, 0 for an IPv6 address
 func Ip4ToInt32(ip net.IP) uint32 {
-	return uint32(binary.BigEndian.Uint32(ip.To4()))
+	if ip4 := ip.To4(); ip4 != nil {
+		return uint32(binary.BigEndian.Uint32(ip4))
+	}
+	return uint32(0)
 }
 
 // Converts 32 bit integer into a 4 bytes IP address
@@ -113,6 +144,71 @@ func Int32ToIP4(n uint32) net.IP {
 	return net.IP(b)
 }
 
+// 128 bit integer of an IPv6 address, Hi holds the first 8 bytes
+type Uint128 struct {
+	Hi uint64
+	Lo uint64
+}
+
+// Bit i of x, bit 0 is the most significant one
+func (x Uint128) Bit(i int) uint {
+	if i < 64 {
+		return uint(x.Hi>>uint(63-i)) & 1
+	}
+	return uint(x.Lo>>uint(127-i)) & 1
+}
+
+// Keep the first "bits" bits of x
+func (x Uint128) Mask(bits int) Uint128 {
+	switch {
+	case bits <= 0:
+		return Uint128{}
+	case bits < 64:
+		return Uint128{Hi: x.Hi & (^uint64(0) << uint(64-bits))}
+	case bits < 128:
+		return Uint128{Hi: x.Hi, Lo: x.Lo & (^uint64(0) << uint(128-bits))}
+	}
+	return x
+}
+
+func IsIPv4(ip net.IP) bool {
+	return ip != nil && ip.To4() != nil
+}
+
+func IsIPv6(ip net.IP) bool {
+	return ip != nil && ip.To4() == nil && ip.To16() != nil
+}
+
+// Converts a 16 bytes IP into a 128 bit integer
+func Ip6ToUint128(ip net.IP) Uint128 {
+	ip6 := ip.To16()
+	if ip6 == nil {
+		return Uint128{}
+	}
+	return Uint128{
+		Hi: binary.BigEndian.Uint64(ip6[:8]),
+		Lo: binary.BigEndian.Uint64(ip6[8:]),
+	}
+}
+
+// Converts 128 bit integer into a 16 bytes IP address
+func Uint128ToIP6(n Uint128) net.IP {
+	b := make([]byte, 16)
+	binary.BigEndian.PutUint64(b[:8], n.Hi)
+	binary.BigEndian.PutUint64(b[8:], n.Lo)
+	return net.IP(b)
+}
+
+//Parse IPv6 *net.IPNet to ip(Uint128) and mask(int)
+func IpNetToUint128(ipnet *net.IPNet) (ip Uint128, mask int) {
+	if ipnet == nil {
+		return Uint128{}, int(0)
+	}
+	ip = Ip6ToUint128(ipnet.IP)
+	mask, _ = ipnet.Mask.Size()
+	return ip, mask
+}
+
 //ParseEdnsIPNet, Parse ends data to *net.IPNet
 func ParseEdnsIPNet(ip net.IP, mask uint8, family uint16) (*net.IPNet, *MyError.MyError) {
 	cidr := strings.Join([]string{ip.String(), strconv.Itoa(int(mask))}, "/")
@@ -539,3 +539,31 @@ func TestGetCIDRMaskWithUint32Range(t *testing.T) {
 		t.Log(x)
 	}
 }
+
+func TestIp6ToUint128(t *testing.T) {
+	for _, s := range []string{"2001:db8::1", "240e:1234:5678::ff", "::1"} {
+		ip := net.ParseIP(s)
+		if !IsIPv6(ip) || IsIPv4(ip) {
+			t.Log(s)
+			t.Fail()
+		}
+		x := Ip6ToUint128(ip)
+		if !Uint128ToIP6(x).Equal(ip) {
+			t.Log(s, x, Uint128ToIP6(x))
+			t.Fail()
+		}
+	}
+	if Ip4ToInt32(net.ParseIP("2001:db8::1")) != 0 {
+		t.Fail()
+	}
+
+	_, ipnet, _ := net.ParseCIDR("2001:db8:ab00::/40")
+	x, mask := IpNetToUint128(ipnet)
+	if mask != 40 || Ip6ToUint128(net.ParseIP("2001:db8:abcd::1")).Mask(mask) != x {
+		t.Log(x, mask)
+		t.Fail()
+	}
+	if x.Bit(0) != 0 || x.Bit(2) != 1 || x.Bit(127) != 0 {
+		t.Fail()
+	}
+}